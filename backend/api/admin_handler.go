@@ -1,15 +1,22 @@
 package api
 
 import (
+	"errors"
 	"net/http"
+	"strconv"
 
 	"github.com/labstack/echo/v4"
+	"github.com/zaunist/filebox/backend/model"
+	"github.com/zaunist/filebox/backend/service"
 	"gorm.io/gorm"
 )
 
 // AdminHandler 管理员处理程序
 type AdminHandler struct {
-	DB *gorm.DB
+	DB             *gorm.DB
+	ScrubService   *service.ScrubService
+	TieringService *service.TieringService
+	ScanService    *service.ScanService
 }
 
 // GetStats 获取系统统计信息
@@ -22,10 +29,167 @@ func (h *AdminHandler) GetStats(c echo.Context) error {
 	h.DB.Table("files").Count(&fileCount)
 	h.DB.Table("shares").Count(&shareCount)
 
+	var damagedCount int64
+	h.DB.Table("files").Where("verify_status IN ?", []string{model.VerifyStatusCorrupted, model.VerifyStatusMissing}).Count(&damagedCount)
+
+	var pendingScanCount, quarantinedCount int64
+	h.DB.Table("files").Where("scan_status = ?", model.ScanStatusPending).Count(&pendingScanCount)
+	h.DB.Table("files").Where("scan_status IN ?", []string{model.ScanStatusInfected, model.ScanStatusFailed}).Count(&quarantinedCount)
+
+	tiers, err := h.TieringService.TierStats()
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"user_count":         userCount,
+		"file_count":         fileCount,
+		"share_count":        shareCount,
+		"damaged_file_count": damagedCount,
+		"pending_scan_count": pendingScanCount,
+		"quarantined_count":  quarantinedCount,
+		"tiers":              tiers,
+	})
+}
+
+// GetFiles 获取所有文件，包含文件所在的存储层级
+func (h *AdminHandler) GetFiles(c echo.Context) error {
+	page, _ := strconv.Atoi(c.QueryParam("page"))
+	if page <= 0 {
+		page = 1
+	}
+
+	pageSize, _ := strconv.Atoi(c.QueryParam("page_size"))
+	if pageSize <= 0 || pageSize > 100 {
+		pageSize = 20
+	}
+
+	query := h.DB.Model(&model.File{})
+	// 只查看内容与声明类型不一致的文件
+	if c.QueryParam("type_mismatch") == "true" {
+		query = query.Where("type_mismatch = ?", true)
+	}
+	// 按恶意软件扫描状态筛选
+	if status := c.QueryParam("scan_status"); status != "" {
+		query = query.Where("scan_status = ?", status)
+	}
+
+	var files []model.File
+	var total int64
+	if err := query.Count(&total).Error; err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	if err := query.Order("created_at DESC").Offset((page - 1) * pageSize).Limit(pageSize).Find(&files).Error; err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	for i := range files {
+		files[i].Tier = h.TieringService.Tier(files[i].Backend)
+	}
+
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"files":     files,
+		"total":     total,
+		"page":      page,
+		"page_size": pageSize,
+	})
+}
+
+// GetTieringStatus 获取冷热分层的配置和最近一次分层的结果
+func (h *AdminHandler) GetTieringStatus(c echo.Context) error {
+	return c.JSON(http.StatusOK, h.TieringService.Status())
+}
+
+// GetScrubStatus 获取完整性校验任务的状态
+func (h *AdminHandler) GetScrubStatus(c echo.Context) error {
+	return c.JSON(http.StatusOK, h.ScrubService.Status())
+}
+
+// StartScrub 在后台开始一次全量完整性校验
+func (h *AdminHandler) StartScrub(c echo.Context) error {
+	if err := h.ScrubService.Start(); err != nil {
+		if errors.Is(err, service.ErrScrubRunning) {
+			return echo.NewHTTPError(http.StatusConflict, err.Error())
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+
+	return c.JSON(http.StatusAccepted, h.ScrubService.Status())
+}
+
+// GetDamagedFiles 获取校验发现损坏或丢失的文件
+func (h *AdminHandler) GetDamagedFiles(c echo.Context) error {
+	page, _ := strconv.Atoi(c.QueryParam("page"))
+	if page <= 0 {
+		page = 1
+	}
+
+	limit, _ := strconv.Atoi(c.QueryParam("limit"))
+	if limit <= 0 || limit > 100 {
+		limit = 10
+	}
+
+	files, total, err := h.ScrubService.GetDamagedFiles(page, limit)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	for i := range files {
+		files[i].Tier = h.TieringService.Tier(files[i].Backend)
+	}
+
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"files": files,
+		"total": total,
+		"page":  page,
+		"limit": limit,
+	})
+}
+
+// GetQuarantinedFiles 获取发现威胁或无法扫描、需要检查的文件
+func (h *AdminHandler) GetQuarantinedFiles(c echo.Context) error {
+	page, _ := strconv.Atoi(c.QueryParam("page"))
+	if page <= 0 {
+		page = 1
+	}
+
+	limit, _ := strconv.Atoi(c.QueryParam("limit"))
+	if limit <= 0 || limit > 100 {
+		limit = 10
+	}
+
+	files, total, err := h.ScanService.GetQuarantinedFiles(page, limit)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"files": files,
+		"total": total,
+		"page":  page,
+		"limit": limit,
+	})
+}
+
+// ReleaseQuarantinedFile 检查后放行文件，内容相同的文件一并放行
+func (h *AdminHandler) ReleaseQuarantinedFile(c echo.Context) error {
+	released, err := h.ScanService.Release(c.Param("id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
 	return c.JSON(http.StatusOK, map[string]interface{}{
-		"user_count":  userCount,
-		"file_count":  fileCount,
-		"share_count": shareCount,
+		"released": released,
+	})
+}
+
+// PurgeQuarantinedFile 删除隔离的文件，内容相同的文件一并删除
+func (h *AdminHandler) PurgeQuarantinedFile(c echo.Context) error {
+	purged, err := h.ScanService.Purge(c.Param("id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"purged": purged,
 	})
 }
 
@@ -35,6 +199,14 @@ func (h *AdminHandler) RegisterRoutes(e *echo.Echo, jwtMiddleware, adminMiddlewa
 	adminGroup := e.Group("/api/admin")
 	adminGroup.Use(jwtMiddleware)
 	adminGroup.Use(adminMiddleware)
-	
+
 	adminGroup.GET("/stats", h.GetStats)
-} 
\ No newline at end of file
+	adminGroup.GET("/scrub", h.GetScrubStatus)
+	adminGroup.POST("/scrub", h.StartScrub)
+	adminGroup.GET("/files", h.GetFiles)
+	adminGroup.GET("/files/damaged", h.GetDamagedFiles)
+	adminGroup.GET("/tiering", h.GetTieringStatus)
+	adminGroup.GET("/quarantine", h.GetQuarantinedFiles)
+	adminGroup.POST("/quarantine/:id/release", h.ReleaseQuarantinedFile)
+	adminGroup.DELETE("/quarantine/:id", h.PurgeQuarantinedFile)
+}
@@ -1,18 +1,32 @@
 package api
 
 import (
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
 	"net/http"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/google/uuid"
 	"github.com/labstack/echo/v4"
+	"github.com/zaunist/filebox/backend/filestore"
+	"github.com/zaunist/filebox/backend/model"
 	"github.com/zaunist/filebox/backend/service"
 )
 
+// maxFormFieldSize 普通表单字段的最大长度
+const maxFormFieldSize = 4096
+
 // FileHandler 文件处理程序
 type FileHandler struct {
-	FileService  *service.FileService
-	ShareService *service.ShareService
+	FileService   *service.FileService
+	ShareService  *service.ShareService
+	FetchService  *service.FetchService
+	FolderService *service.FolderService
 }
 
 // UploadFile 上传文件
@@ -23,39 +37,179 @@ func (h *FileHandler) UploadFile(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusBadRequest, "无效的用户ID")
 	}
 
-	// 获取文件
-	file, err := c.FormFile("file")
+	// 流式读取并上传文件
+	var fileInfo *service.FileUploadResponse
+	fields, err := readUploadForm(c, 1, func(part *multipart.Part, fields map[string]string) error {
+		var err error
+		fileInfo, err = h.FileService.UploadFile(part, partFileMeta(part, fields), &userID)
+		return err
+	})
 	if err != nil {
-		return echo.NewHTTPError(http.StatusBadRequest, "无效的文件")
+		// 文件之后的表单内容无效时删除已保存的文件
+		if fileInfo != nil {
+			_ = h.FileService.DeleteFile(fileInfo.ID, &userID)
+		}
+		return err
+	}
+
+	// 放入指定的文件夹
+	if folderID := fields["folder_id"]; folderID != "" {
+		if _, err := h.FolderService.MoveFile(fileInfo.ID, folderID, userID); err != nil {
+			_ = h.FileService.DeleteFile(fileInfo.ID, &userID)
+			return folderError(err)
+		}
+		fileInfo.FolderID = folderID
 	}
 
-	// 上传文件
-	fileInfo, err := h.FileService.UploadFile(file, &userID)
+	return c.JSON(http.StatusCreated, fileInfo)
+}
+
+// CheckInstantUpload 秒传预检，内容已存在时返回持有证明挑战
+func (h *FileHandler) CheckInstantUpload(c echo.Context) error {
+	userID, err := uuid.Parse(c.Get("user_id").(string))
 	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+		return echo.NewHTTPError(http.StatusBadRequest, "无效的用户ID")
+	}
+
+	var req service.InstantCheckRequest
+	if err := c.Bind(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "无效的请求数据")
+	}
+
+	resp, err := h.FileService.CheckInstantUpload(req, userID)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	return c.JSON(http.StatusOK, resp)
+}
+
+// InstantUpload 提交持有证明完成秒传
+func (h *FileHandler) InstantUpload(c echo.Context) error {
+	userID, err := uuid.Parse(c.Get("user_id").(string))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "无效的用户ID")
+	}
+
+	var req service.InstantUploadRequest
+	if err := c.Bind(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "无效的请求数据")
+	}
+
+	fileInfo, err := h.FileService.InstantUpload(req, userID)
+	if err != nil {
+		if errors.Is(err, service.ErrContentQuarantined) {
+			return echo.NewHTTPError(http.StatusForbidden, err.Error())
+		}
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
 	}
 
 	return c.JSON(http.StatusCreated, fileInfo)
 }
 
-// UploadAnonymousFile 匿名上传文件并直接分享
-func (h *FileHandler) UploadAnonymousFile(c echo.Context) error {
-	// 获取文件
-	file, err := c.FormFile("file")
+// FetchFile 从URL获取文件，服务端在后台下载，返回任务供查询进度
+func (h *FileHandler) FetchFile(c echo.Context) error {
+	userID, err := uuid.Parse(c.Get("user_id").(string))
 	if err != nil {
-		return echo.NewHTTPError(http.StatusBadRequest, "无效的文件")
+		return echo.NewHTTPError(http.StatusBadRequest, "无效的用户ID")
 	}
 
-	// 匿名上传文件（不关联用户ID）
-	fileInfo, err := h.FileService.UploadFile(file, nil)
+	var req service.FetchRequest
+	if err := c.Bind(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "无效的请求数据")
+	}
+
+	job, err := h.FetchService.CreateJob(req, userID)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	return c.JSON(http.StatusAccepted, job)
+}
+
+// GetFetchJobs 获取从URL获取文件的任务列表
+func (h *FileHandler) GetFetchJobs(c echo.Context) error {
+	userID, err := uuid.Parse(c.Get("user_id").(string))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "无效的用户ID")
+	}
+
+	page, _ := strconv.Atoi(c.QueryParam("page"))
+	if page <= 0 {
+		page = 1
+	}
+
+	limit, _ := strconv.Atoi(c.QueryParam("limit"))
+	if limit <= 0 || limit > 100 {
+		limit = 10
+	}
+
+	jobs, total, err := h.FetchService.GetJobs(userID, page, limit)
 	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
 	}
 
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"jobs":  jobs,
+		"total": total,
+		"page":  page,
+		"limit": limit,
+	})
+}
+
+// GetFetchJob 获取任务状态和下载进度
+func (h *FileHandler) GetFetchJob(c echo.Context) error {
+	userID, err := uuid.Parse(c.Get("user_id").(string))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "无效的用户ID")
+	}
+
+	job, err := h.FetchService.GetJob(c.Param("id"), userID)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusNotFound, err.Error())
+	}
+
+	return c.JSON(http.StatusOK, job)
+}
+
+// CancelFetchJob 取消正在进行的任务
+func (h *FileHandler) CancelFetchJob(c echo.Context) error {
+	userID, err := uuid.Parse(c.Get("user_id").(string))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "无效的用户ID")
+	}
+
+	if err := h.FetchService.CancelJob(c.Param("id"), userID); err != nil {
+		if errors.Is(err, service.ErrFetchNotFound) {
+			return echo.NewHTTPError(http.StatusNotFound, err.Error())
+		}
+		return echo.NewHTTPError(http.StatusConflict, err.Error())
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+// UploadAnonymousFile 匿名上传文件并直接分享
+func (h *FileHandler) UploadAnonymousFile(c echo.Context) error {
+	// 匿名上传文件（不关联用户ID）
+	var fileInfo *service.FileUploadResponse
+	fields, err := readUploadForm(c, 1, func(part *multipart.Part, fields map[string]string) error {
+		var err error
+		fileInfo, err = h.FileService.UploadFile(part, partFileMeta(part, fields), nil)
+		return err
+	})
+	if err != nil {
+		// 文件之后的表单内容无效时删除已保存的文件
+		if fileInfo != nil {
+			_ = h.FileService.DeleteFile(fileInfo.ID, nil)
+		}
+		return err
+	}
+
 	// 获取分享参数
-	code := c.FormValue("code")
-	expiresIn, _ := strconv.Atoi(c.FormValue("expires_in"))
-	downloadLimit, _ := strconv.Atoi(c.FormValue("download_limit"))
+	code := fields["code"]
+	expiresIn, _ := strconv.Atoi(fields["expires_in"])
+	downloadLimit, _ := strconv.Atoi(fields["download_limit"])
 
 	// 创建分享请求
 	createReq := service.CreateShareRequest{
@@ -74,6 +228,122 @@ func (h *FileHandler) UploadAnonymousFile(c echo.Context) error {
 	return c.JSON(http.StatusCreated, share)
 }
 
+// UploadBundle 一次上传多个文件并创建分享包，通过一个取件码分享全部文件。
+// 携带认证信息时文件归属于当前用户，否则为匿名上传
+func (h *FileHandler) UploadBundle(c echo.Context) error {
+	userID, err := optionalUserID(c)
+	if err != nil {
+		return err
+	}
+
+	// 依次流式上传表单中的每个文件
+	var fileIDs []string
+	fields, err := readUploadForm(c, service.MaxBundleFiles, func(part *multipart.Part, fields map[string]string) error {
+		fileInfo, err := h.FileService.UploadFile(part, partFileMeta(part, fields), userID)
+		if err != nil {
+			return err
+		}
+		fileIDs = append(fileIDs, fileInfo.ID)
+		return nil
+	})
+	// 任一文件失败时删除已保存的文件
+	cleanup := func() {
+		for _, id := range fileIDs {
+			_ = h.FileService.DeleteFile(id, userID)
+		}
+	}
+	if err != nil {
+		cleanup()
+		return err
+	}
+
+	// 获取分享参数
+	expiresIn, _ := strconv.Atoi(fields["expires_in"])
+	downloadLimit, _ := strconv.Atoi(fields["download_limit"])
+
+	share, err := h.ShareService.CreateShare(service.CreateShareRequest{
+		FileIDs:       fileIDs,
+		Code:          fields["code"],
+		ExpiresIn:     expiresIn,
+		DownloadLimit: downloadLimit,
+	}, userID)
+	if err != nil {
+		cleanup()
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	return c.JSON(http.StatusCreated, share)
+}
+
+// PutFile 以请求体作为文件内容上传并直接分享，供 curl -T 等命令行工具使用。
+// 分享选项通过Max-Downloads、Max-Hours请求头指定，除非Accept要求JSON，否则以纯文本返回分享链接和删除链接
+func (h *FileHandler) PutFile(c echo.Context) error {
+	userID, err := optionalUserID(c)
+	if err != nil {
+		return err
+	}
+
+	req := c.Request()
+	downloadLimit, err := shareOption(req, "Max-Downloads")
+	if err != nil {
+		return err
+	}
+	expiresIn, err := shareOption(req, "Max-Hours")
+	if err != nil {
+		return err
+	}
+
+	// curl --data-binary 默认声明为表单类型，不是文件的真实类型
+	contentType := req.Header.Get(echo.HeaderContentType)
+	if contentType == echo.MIMEApplicationForm {
+		contentType = ""
+	}
+
+	// 请求体直接写入存储，未声明长度（分块传输）时大小为-1
+	fileInfo, err := h.FileService.UploadFile(req.Body, filestore.FileMeta{
+		Name:        c.Param("filename"),
+		ContentType: contentType,
+		Size:        req.ContentLength,
+	}, userID)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	share, err := h.ShareService.CreateShare(service.CreateShareRequest{
+		FileID:        fileInfo.ID,
+		ExpiresIn:     expiresIn,
+		DownloadLimit: downloadLimit,
+	}, userID)
+	if err != nil {
+		_ = h.FileService.DeleteFile(fileInfo.ID, userID)
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	base := publicURL(c, h.FileService.AppConfig.PublicURL)
+	shareURL := base + "/s/" + share.Code
+	deleteURL := base + "/api/files/" + fileInfo.ID + "/" + h.FileService.DeleteToken(fileInfo.ID)
+	c.Response().Header().Set("X-Url-Delete", deleteURL)
+
+	if strings.Contains(req.Header.Get(echo.HeaderAccept), echo.MIMEApplicationJSON) {
+		return c.JSON(http.StatusCreated, map[string]interface{}{
+			"share":      share,
+			"url":        shareURL,
+			"delete_url": deleteURL,
+		})
+	}
+	// 第一行为分享链接，便于在脚本中使用
+	return c.String(http.StatusCreated, shareURL+"\n"+deleteURL+"\n")
+}
+
+// DeleteFileWithToken 使用上传时返回的删除链接删除文件，不需要登录
+func (h *FileHandler) DeleteFileWithToken(c echo.Context) error {
+	if err := h.FileService.DeleteFileWithToken(c.Param("id"), c.Param("token")); err != nil {
+		return echo.NewHTTPError(http.StatusNotFound, err.Error())
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
+
 // GetFiles 获取用户文件列表
 func (h *FileHandler) GetFiles(c echo.Context) error {
 	userID := c.Get("user_id").(string)
@@ -89,9 +359,18 @@ func (h *FileHandler) GetFiles(c echo.Context) error {
 		limit = 10
 	}
 
-	// 获取文件列表
-	files, total, err := h.FileService.GetUserFiles(userID, page, limit)
+	// 获取文件列表，folder_id为root时只列出根目录下的文件，tags为逗号分隔的标签，文件需包含全部标签
+	filter := service.FileFilter{Folder: c.QueryParam("folder_id")}
+	for _, tag := range strings.Split(c.QueryParam("tags"), ",") {
+		if tag = strings.TrimSpace(tag); tag != "" {
+			filter.Tags = append(filter.Tags, tag)
+		}
+	}
+	files, total, err := h.FileService.GetUserFiles(userID, filter, page, limit)
 	if err != nil {
+		if errors.Is(err, service.ErrFolderNotFound) {
+			return echo.NewHTTPError(http.StatusNotFound, err.Error())
+		}
 		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
 	}
 
@@ -103,6 +382,19 @@ func (h *FileHandler) GetFiles(c echo.Context) error {
 	})
 }
 
+// checkFileOwner 检查文件是否属于当前用户。匿名上传的文件不属于任何用户，只能通过分享下载，
+// 这样下载次数限制和恶意软件扫描状态的检查不会被绕过
+func checkFileOwner(file *model.File, userID string) error {
+	userUUID, err := uuid.Parse(userID)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "无效的用户ID")
+	}
+	if file.UserID == nil || *file.UserID != userUUID {
+		return echo.NewHTTPError(http.StatusForbidden, "无权访问此文件")
+	}
+	return nil
+}
+
 // GetFile 获取文件信息
 func (h *FileHandler) GetFile(c echo.Context) error {
 	userID := c.Get("user_id").(string)
@@ -115,21 +407,64 @@ func (h *FileHandler) GetFile(c echo.Context) error {
 	}
 
 	// 检查权限
-	if file.UserID != nil {
-		userUUID, err := uuid.Parse(userID)
-		if err != nil {
-			return echo.NewHTTPError(http.StatusBadRequest, "无效的用户ID")
-		}
+	if err := checkFileOwner(file, userID); err != nil {
+		return err
+	}
+
+	files := []model.File{*file}
+	if err := h.FileService.WithTags(files); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+
+	return c.JSON(http.StatusOK, files[0])
+}
 
-		if *file.UserID != userUUID {
-			return echo.NewHTTPError(http.StatusForbidden, "无权访问此文件")
+// UpdateFile 修改文件名、描述和标签，只修改请求中出现的字段
+func (h *FileHandler) UpdateFile(c echo.Context) error {
+	userID, err := uuid.Parse(c.Get("user_id").(string))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "无效的用户ID")
+	}
+
+	var req service.UpdateFileRequest
+	if err := c.Bind(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "无效的请求数据")
+	}
+
+	file, err := h.FileService.UpdateFile(c.Param("id"), req, userID)
+	if err != nil {
+		if errors.Is(err, service.ErrFileNotFound) {
+			return echo.NewHTTPError(http.StatusNotFound, err.Error())
 		}
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
 	}
 
 	return c.JSON(http.StatusOK, file)
 }
 
-// DownloadFile 下载文件
+// GetTags 获取当前用户使用过的标签，用于输入时补全
+func (h *FileHandler) GetTags(c echo.Context) error {
+	userID, err := uuid.Parse(c.Get("user_id").(string))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "无效的用户ID")
+	}
+
+	limit, _ := strconv.Atoi(c.QueryParam("limit"))
+	if limit <= 0 || limit > 100 {
+		limit = 10
+	}
+
+	tags, err := h.FileService.GetUserTags(userID, c.QueryParam("prefix"), limit)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"tags": tags,
+	})
+}
+
+// DownloadFile 下载文件，支持Range断点续传
 func (h *FileHandler) DownloadFile(c echo.Context) error {
 	userID := c.Get("user_id").(string)
 	fileID := c.Param("id")
@@ -141,15 +476,13 @@ func (h *FileHandler) DownloadFile(c echo.Context) error {
 	}
 
 	// 检查权限
-	if file.UserID != nil {
-		userUUID, err := uuid.Parse(userID)
-		if err != nil {
-			return echo.NewHTTPError(http.StatusBadRequest, "无效的用户ID")
-		}
+	if err := checkFileOwner(file, userID); err != nil {
+		return err
+	}
 
-		if *file.UserID != userUUID {
-			return echo.NewHTTPError(http.StatusForbidden, "无权访问此文件")
-		}
+	// 发现威胁的文件已被隔离，上传者也不能下载
+	if file.ScanStatus == model.ScanStatusInfected {
+		return echo.NewHTTPError(http.StatusForbidden, service.ErrScanBlocked.Error())
 	}
 
 	// 获取文件内容
@@ -159,13 +492,53 @@ func (h *FileHandler) DownloadFile(c echo.Context) error {
 	}
 	defer fileData.Close()
 
-	// 设置响应头
-	c.Response().Header().Set(echo.HeaderContentDisposition, "attachment; filename="+file.Name)
-	c.Response().Header().Set(echo.HeaderContentType, file.ContentType)
-	c.Response().Header().Set(echo.HeaderContentLength, strconv.FormatInt(file.Size, 10))
-
 	// 发送文件
-	return c.Stream(http.StatusOK, file.ContentType, fileData)
+	return serveFileContent(c, file, fileData)
+}
+
+// DownloadArchive 将多个文件打包为ZIP流式下载。请求体中的file_ids为要下载的文件，
+// 也可以用code指定分享包，下载其中的全部文件，文件必须属于当前用户
+func (h *FileHandler) DownloadArchive(c echo.Context) error {
+	userID, err := uuid.Parse(c.Get("user_id").(string))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "无效的用户ID")
+	}
+
+	var req struct {
+		FileIDs []string `json:"file_ids"`
+		Code    string   `json:"code"`
+	}
+	if err := c.Bind(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "无效的请求数据")
+	}
+
+	name := "filebox-" + time.Now().Format("20060102-150405") + ".zip"
+	fileIDs := req.FileIDs
+	if req.Code != "" {
+		share, _, err := h.ShareService.GetShareByCode(req.Code)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusNotFound, err.Error())
+		}
+		files, err := h.ShareService.GetShareFiles(share)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+		}
+		fileIDs = make([]string, len(files))
+		for i, file := range files {
+			fileIDs[i] = file.ID.String()
+		}
+		name = "filebox-" + share.Code + ".zip"
+	}
+
+	files, err := h.FileService.GetArchiveFiles(fileIDs, userID)
+	if err != nil {
+		if errors.Is(err, service.ErrScanBlocked) {
+			return echo.NewHTTPError(http.StatusForbidden, err.Error())
+		}
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	return streamArchive(c, h.FileService, name, files)
 }
 
 // DeleteFile 删除文件
@@ -187,17 +560,150 @@ func (h *FileHandler) DeleteFile(c echo.Context) error {
 	return c.NoContent(http.StatusNoContent)
 }
 
-// RegisterRoutes 注册路由
-func (h *FileHandler) RegisterRoutes(e *echo.Echo, jwtMiddleware echo.MiddlewareFunc) {
+// RegisterRoutes 注册路由，optionalJWTMiddleware应允许匿名访问
+func (h *FileHandler) RegisterRoutes(e *echo.Echo, jwtMiddleware, optionalJWTMiddleware echo.MiddlewareFunc) {
 	// 公开路由 - 匿名上传
 	e.POST("/api/files/anonymous", h.UploadAnonymousFile)
+	e.POST("/api/files/bundle", h.UploadBundle, optionalJWTMiddleware)
+	e.PUT("/:filename", h.PutFile, optionalJWTMiddleware)
+	e.DELETE("/api/files/:id/:token", h.DeleteFileWithToken)
 
 	// 需要认证的路由
 	fileGroup := e.Group("/api/files")
 	fileGroup.Use(jwtMiddleware)
 	fileGroup.POST("", h.UploadFile)
+	fileGroup.POST("/instant/check", h.CheckInstantUpload)
+	fileGroup.POST("/instant", h.InstantUpload)
+	fileGroup.POST("/fetch", h.FetchFile)
+	fileGroup.GET("/fetch", h.GetFetchJobs)
+	fileGroup.GET("/fetch/:id", h.GetFetchJob)
+	fileGroup.DELETE("/fetch/:id", h.CancelFetchJob)
 	fileGroup.GET("", h.GetFiles)
+	fileGroup.POST("/archive", h.DownloadArchive)
+	fileGroup.GET("/tags", h.GetTags)
 	fileGroup.GET("/:id", h.GetFile)
+	fileGroup.PATCH("/:id", h.UpdateFile)
 	fileGroup.GET("/:id/download", h.DownloadFile)
 	fileGroup.DELETE("/:id", h.DeleteFile)
 }
+
+// readUploadForm 流式读取multipart表单，每遇到一个file字段就调用upload直接写入存储，
+// 不会先把整个文件缓存到临时文件。upload只能看到file之前的普通字段，返回全部普通表单字段。
+// encrypted_meta字段只作用于紧随其后的文件，超过maxFiles个文件时返回错误
+func readUploadForm(c echo.Context, maxFiles int, upload func(part *multipart.Part, fields map[string]string) error) (map[string]string, error) {
+	reader, err := c.Request().MultipartReader()
+	if err != nil {
+		return nil, echo.NewHTTPError(http.StatusBadRequest, "无效的文件")
+	}
+
+	fields := make(map[string]string)
+	uploaded := 0
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, echo.NewHTTPError(http.StatusBadRequest, "无效的请求数据")
+		}
+
+		switch {
+		case part.FormName() == "file" && part.FileName() != "":
+			if uploaded == maxFiles {
+				return nil, echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("最多上传%d个文件", maxFiles))
+			}
+			if err := upload(part, fields); err != nil {
+				if errors.Is(err, service.ErrContentQuarantined) {
+					return nil, echo.NewHTTPError(http.StatusForbidden, err.Error())
+				}
+				return nil, echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+			}
+			delete(fields, "encrypted_meta")
+			uploaded++
+		case part.FileName() == "":
+			value, err := io.ReadAll(io.LimitReader(part, maxFormFieldSize))
+			if err != nil {
+				return nil, echo.NewHTTPError(http.StatusBadRequest, "无效的请求数据")
+			}
+			fields[part.FormName()] = string(value)
+		}
+		part.Close()
+	}
+
+	if uploaded == 0 {
+		return nil, echo.NewHTTPError(http.StatusBadRequest, "无效的文件")
+	}
+	if _, ok := fields["encrypted_meta"]; ok {
+		// 加密元数据决定如何保存文件，必须在文件之前提交
+		return nil, echo.NewHTTPError(http.StatusBadRequest, "encrypted_meta字段必须位于file字段之前")
+	}
+
+	return fields, nil
+}
+
+// shareOption 读取正整数形式的分享选项请求头，未设置时返回0，使用默认值
+func shareOption(req *http.Request, name string) (int, error) {
+	value := req.Header.Get(name)
+	if value == "" {
+		return 0, nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n <= 0 {
+		return 0, echo.NewHTTPError(http.StatusBadRequest, "无效的"+name)
+	}
+	return n, nil
+}
+
+// publicURL 返回服务对外访问的地址，未配置时根据请求的协议和Host推断
+func publicURL(c echo.Context, configured string) string {
+	if configured != "" {
+		return strings.TrimRight(configured, "/")
+	}
+	return c.Scheme() + "://" + c.Request().Host
+}
+
+// partFileMeta 根据multipart字段生成文件元数据，流式上传时大小未知。
+// 文件之前的encrypted_meta字段表示内容已由客户端端到端加密
+func partFileMeta(part *multipart.Part, fields map[string]string) filestore.FileMeta {
+	return filestore.FileMeta{
+		Name:          part.FileName(),
+		ContentType:   part.Header.Get(echo.HeaderContentType),
+		Size:          -1,
+		EncryptedMeta: fields["encrypted_meta"],
+	}
+}
+
+// streamArchive 将文件打包为ZIP流式发送，压缩包大小事先未知，使用分块传输。
+// 发送过程中出错时响应头已经发出，只能中断连接，客户端会得到不完整的压缩包
+func streamArchive(c echo.Context, fileService *service.FileService, name string, files []model.File) error {
+	header := c.Response().Header()
+	header.Set(echo.HeaderContentType, "application/zip")
+	header.Set(echo.HeaderContentDisposition, mime.FormatMediaType("attachment", map[string]string{"filename": name}))
+	header.Set("X-Content-Type-Options", "nosniff")
+	c.Response().WriteHeader(http.StatusOK)
+
+	if err := fileService.WriteArchive(c.Response(), files); err != nil {
+		c.Logger().Errorf("打包下载失败: %v", err)
+		panic(http.ErrAbortHandler)
+	}
+	return nil
+}
+
+// serveFileContent 发送文件内容，支持Range、If-Range等条件请求并在需要时返回206。
+// 使用上传时检测到的类型，并禁止浏览器再根据内容猜测类型
+func serveFileContent(c echo.Context, file *model.File, content io.ReadSeeker) error {
+	contentType := file.ContentType
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+
+	header := c.Response().Header()
+	header.Set(echo.HeaderContentDisposition, mime.FormatMediaType("attachment", map[string]string{"filename": file.Name}))
+	header.Set(echo.HeaderContentType, contentType)
+	header.Set("X-Content-Type-Options", "nosniff")
+	// 文件内容不会变化，使用内容哈希作为ETag，供If-Range校验
+	header.Set("ETag", `"`+file.Hash+`"`)
+
+	http.ServeContent(c.Response(), c.Request(), file.Name, file.CreatedAt, content)
+	return nil
+}
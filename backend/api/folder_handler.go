@@ -0,0 +1,208 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/google/uuid"
+	"github.com/labstack/echo/v4"
+	"github.com/zaunist/filebox/backend/service"
+)
+
+// FolderHandler 文件夹处理程序
+type FolderHandler struct {
+	FolderService *service.FolderService
+}
+
+// CreateFolder 创建文件夹
+func (h *FolderHandler) CreateFolder(c echo.Context) error {
+	userID, err := uuid.Parse(c.Get("user_id").(string))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "无效的用户ID")
+	}
+
+	var req struct {
+		Name     string `json:"name"`
+		ParentID string `json:"parent_id"`
+	}
+	if err := c.Bind(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "无效的请求数据")
+	}
+
+	folder, err := h.FolderService.CreateFolder(req.Name, req.ParentID, userID)
+	if err != nil {
+		return folderError(err)
+	}
+
+	return c.JSON(http.StatusCreated, folder)
+}
+
+// GetFolders 获取文件夹下的子文件夹，未指定parent_id时获取根目录下的文件夹
+func (h *FolderHandler) GetFolders(c echo.Context) error {
+	userID, err := uuid.Parse(c.Get("user_id").(string))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "无效的用户ID")
+	}
+
+	folders, err := h.FolderService.GetFolders(c.QueryParam("parent_id"), userID)
+	if err != nil {
+		return folderError(err)
+	}
+
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"folders": folders,
+	})
+}
+
+// GetFolder 获取文件夹信息和完整路径
+func (h *FolderHandler) GetFolder(c echo.Context) error {
+	userID, err := uuid.Parse(c.Get("user_id").(string))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "无效的用户ID")
+	}
+
+	folder, err := h.FolderService.GetFolder(c.Param("id"), userID)
+	if err != nil {
+		return folderError(err)
+	}
+	path, err := h.FolderService.GetPath(folder)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"folder": folder,
+		"path":   path,
+	})
+}
+
+// LookupPath 根据路径查找文件夹或文件，如 /文档/2024/报告.pdf
+func (h *FolderHandler) LookupPath(c echo.Context) error {
+	userID, err := uuid.Parse(c.Get("user_id").(string))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "无效的用户ID")
+	}
+
+	folder, file, err := h.FolderService.ResolvePath(c.QueryParam("path"), userID)
+	if err != nil {
+		return folderError(err)
+	}
+
+	if file != nil {
+		return c.JSON(http.StatusOK, map[string]interface{}{
+			"type": "file",
+			"file": file,
+		})
+	}
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"type":   "folder",
+		"folder": folder,
+	})
+}
+
+// RenameFolder 重命名文件夹
+func (h *FolderHandler) RenameFolder(c echo.Context) error {
+	userID, err := uuid.Parse(c.Get("user_id").(string))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "无效的用户ID")
+	}
+
+	var req struct {
+		Name string `json:"name"`
+	}
+	if err := c.Bind(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "无效的请求数据")
+	}
+
+	folder, err := h.FolderService.RenameFolder(c.Param("id"), req.Name, userID)
+	if err != nil {
+		return folderError(err)
+	}
+
+	return c.JSON(http.StatusOK, folder)
+}
+
+// MoveFolder 移动文件夹，parent_id为空时移动到根目录
+func (h *FolderHandler) MoveFolder(c echo.Context) error {
+	userID, err := uuid.Parse(c.Get("user_id").(string))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "无效的用户ID")
+	}
+
+	var req struct {
+		ParentID string `json:"parent_id"`
+	}
+	if err := c.Bind(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "无效的请求数据")
+	}
+
+	folder, err := h.FolderService.MoveFolder(c.Param("id"), req.ParentID, userID)
+	if err != nil {
+		return folderError(err)
+	}
+
+	return c.JSON(http.StatusOK, folder)
+}
+
+// DeleteFolder 删除文件夹，recursive=true时删除其中的全部子文件夹和文件
+func (h *FolderHandler) DeleteFolder(c echo.Context) error {
+	userID, err := uuid.Parse(c.Get("user_id").(string))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "无效的用户ID")
+	}
+
+	recursive := c.QueryParam("recursive") == "true"
+	if err := h.FolderService.DeleteFolder(c.Param("id"), userID, recursive); err != nil {
+		return folderError(err)
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+// MoveFile 将文件移动到文件夹，folder_id为空时移动到根目录
+func (h *FolderHandler) MoveFile(c echo.Context) error {
+	userID, err := uuid.Parse(c.Get("user_id").(string))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "无效的用户ID")
+	}
+
+	var req struct {
+		FolderID string `json:"folder_id"`
+	}
+	if err := c.Bind(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "无效的请求数据")
+	}
+
+	file, err := h.FolderService.MoveFile(c.Param("id"), req.FolderID, userID)
+	if err != nil {
+		return folderError(err)
+	}
+
+	return c.JSON(http.StatusOK, file)
+}
+
+// RegisterRoutes 注册路由
+func (h *FolderHandler) RegisterRoutes(e *echo.Echo, jwtMiddleware echo.MiddlewareFunc) {
+	folderGroup := e.Group("/api/folders")
+	folderGroup.Use(jwtMiddleware)
+	folderGroup.POST("", h.CreateFolder)
+	folderGroup.GET("", h.GetFolders)
+	folderGroup.GET("/lookup", h.LookupPath)
+	folderGroup.GET("/:id", h.GetFolder)
+	folderGroup.POST("/:id/rename", h.RenameFolder)
+	folderGroup.POST("/:id/move", h.MoveFolder)
+	folderGroup.DELETE("/:id", h.DeleteFolder)
+
+	e.POST("/api/files/:id/move", h.MoveFile, jwtMiddleware)
+}
+
+// folderError 将文件夹服务的错误转换为对应的HTTP状态码
+func folderError(err error) error {
+	switch {
+	case errors.Is(err, service.ErrFolderNotFound), errors.Is(err, service.ErrPathNotFound):
+		return echo.NewHTTPError(http.StatusNotFound, err.Error())
+	case errors.Is(err, service.ErrFolderExists), errors.Is(err, service.ErrFolderNotEmpty):
+		return echo.NewHTTPError(http.StatusConflict, err.Error())
+	}
+	return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+}
@@ -1,11 +1,14 @@
 package api
 
 import (
+	"errors"
 	"net/http"
 	"strconv"
+	"strings"
 
 	"github.com/google/uuid"
 	"github.com/labstack/echo/v4"
+	"github.com/zaunist/filebox/backend/model"
 	"github.com/zaunist/filebox/backend/service"
 )
 
@@ -81,7 +84,32 @@ func (h *ShareHandler) GetShares(c echo.Context) error {
 	})
 }
 
-// GetShareByCode 通过分享码获取分享信息
+// CreateBundle 创建分享包，通过一个取件码分享多个已上传的文件
+func (h *ShareHandler) CreateBundle(c echo.Context) error {
+	userID, err := uuid.Parse(c.Get("user_id").(string))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "无效的用户ID")
+	}
+
+	var req service.CreateShareRequest
+	if err := c.Bind(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "无效的请求数据")
+	}
+	if len(req.FileIDs) == 0 {
+		return echo.NewHTTPError(http.StatusBadRequest, "请选择要分享的文件")
+	}
+
+	share, err := h.ShareService.CreateShare(req, &userID)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	return c.JSON(http.StatusCreated, share)
+}
+
+// GetShareByCode 通过分享码获取分享信息。端到端加密的文件只返回加密的元数据，
+// 客户端用分享链接片段（#之后的部分，不会发送到服务端）中的密钥解密文件名、类型和内容。
+// 分享包的file为排在最前的文件，files为全部文件
 func (h *ShareHandler) GetShareByCode(c echo.Context) error {
 	code := c.Param("code")
 
@@ -91,48 +119,210 @@ func (h *ShareHandler) GetShareByCode(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusNotFound, err.Error())
 	}
 
-	return c.JSON(http.StatusOK, map[string]interface{}{
-		"share": share,
+	// 不返回分享和文件的ID，普通分享只能通过取件码下载；分享包的files包含逐个下载所需的文件ID
+	resp := map[string]interface{}{
+		"share": service.PublicShareOf(share),
 		"file": map[string]interface{}{
-			"id":           file.ID.String(),
-			"name":         file.Name,
-			"size":         file.Size,
-			"content_type": file.ContentType,
-			"created_at":   file.CreatedAt,
+			"name":           file.Name,
+			"size":           file.Size,
+			"content_type":   file.ContentType,
+			"encrypted":      file.Encrypted,
+			"encrypted_meta": file.EncryptedMeta,
+			"scan_status":    file.ScanStatus,
+			"created_at":     file.CreatedAt,
 		},
-	})
+	}
+	if share.Bundle {
+		files, err := h.ShareService.GetShareFiles(share)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+		}
+		list := make([]service.SharedFile, len(files))
+		for i := range files {
+			list[i] = service.SharedFileOf(&files[i])
+		}
+		resp["files"] = list
+	}
+
+	return c.JSON(http.StatusOK, resp)
 }
 
-// DownloadSharedFile 下载分享的文件
+// downloadTicketCookie 下载凭证Cookie名称
+const downloadTicketCookie = "filebox_download"
+
+// DownloadSharedFile 下载分享的文件，支持Range断点续传。
+// 每次下载计一次下载次数并下发新的下载凭证，有效期内携带凭证、不从头开始的Range请求视为同一次下载的续传，不再计数。
+// 分享包下载全部文件，打包为ZIP
 func (h *ShareHandler) DownloadSharedFile(c echo.Context) error {
-	code := c.Param("code")
+	share, counted, err := h.pickUp(c, "")
+	if err != nil {
+		return err
+	}
 
-	// 获取分享信息
-	share, file, err := h.ShareService.GetShareByCode(code)
+	if share.Bundle {
+		return h.downloadBundle(c, share, counted)
+	}
+	return h.sendSharedFile(c, share, &share.File, "", counted)
+}
+
+// DownloadBundleFile 下载分享包中的单个文件，支持Range断点续传
+func (h *ShareHandler) DownloadBundleFile(c echo.Context) error {
+	fileID := c.Param("file_id")
+	share, counted, err := h.pickUp(c, fileID)
+	if err != nil {
+		return err
+	}
+
+	file, err := h.ShareService.GetSharedFile(share, fileID)
 	if err != nil {
 		return echo.NewHTTPError(http.StatusNotFound, err.Error())
 	}
 
-	// 获取文件内容
-	fileData, err := h.FileService.GetFileContent(file)
+	return h.sendSharedFile(c, share, file, fileID, counted)
+}
+
+// pickUp 获取要下载的分享，并判断是否属于已计数的同一次取件。
+// 携带有效下载凭证时，本次取件中已开始下载的文件不从头开始的Range续传请求不再计数；
+// 分享包中本次取件尚未下载过的文件可以各下载一次，重复下载和下载ZIP都按新的取件计数。
+// fileID为分享包中的文件，为空表示下载分享的文件或分享包的ZIP
+func (h *ShareHandler) pickUp(c echo.Context, fileID string) (*model.Share, bool, error) {
+	code := c.Param("code")
+
+	if cookie, err := c.Cookie(downloadTicketCookie); err == nil {
+		share, _, err := h.ShareService.GetShareForResume(code, cookie.Value)
+		if err == nil {
+			resume := isResumeRange(c.Request().Header.Get("Range"))
+			continued, err := h.ShareService.ContinuePickup(share, cookie.Value, fileID, resume)
+			if err != nil {
+				// 无法确认时按新的取件计数
+				c.Logger().Error(err)
+			}
+			if continued {
+				return share, true, nil
+			}
+		}
+	}
+
+	// 获取分享信息
+	share, _, err := h.ShareService.GetShareByCode(code)
 	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+		return nil, false, echo.NewHTTPError(http.StatusNotFound, err.Error())
 	}
-	defer fileData.Close()
+	return share, false, nil
+}
 
+// isResumeRange 判断Range请求是否为续传，即每个区间都从文件开头之后开始。
+// 从0开始的区间和后缀区间（bytes=-N）可以取得完整文件，按新的下载计数
+func isResumeRange(header string) bool {
+	spec, ok := strings.CutPrefix(header, "bytes=")
+	if !ok {
+		return false
+	}
+	for _, r := range strings.Split(spec, ",") {
+		start, _, ok := strings.Cut(strings.TrimSpace(r), "-")
+		if !ok {
+			return false
+		}
+		offset, err := strconv.ParseInt(start, 10, 64)
+		if err != nil || offset <= 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// countDownload 增加下载次数并下发新的下载凭证，供本次下载的续传和分享包中其他文件的下载使用。
+// fileID为本次下载的分享包文件，下载ZIP或普通分享时为空
+func (h *ShareHandler) countDownload(c echo.Context, share *model.Share, fileID string) {
 	// 增加下载次数
 	if err := h.ShareService.IncrementDownloadCount(share.ID); err != nil {
 		// 只记录错误，不影响下载
 		c.Logger().Error(err)
 	}
 
-	// 设置响应头
-	c.Response().Header().Set(echo.HeaderContentDisposition, "attachment; filename="+file.Name)
-	c.Response().Header().Set(echo.HeaderContentType, file.ContentType)
-	c.Response().Header().Set(echo.HeaderContentLength, strconv.FormatInt(file.Size, 10))
+	ticket, expiresAt, err := h.ShareService.IssueDownloadTicket(share, fileID)
+	if err != nil {
+		// 没有凭证时续传会重新计数，不影响本次下载
+		c.Logger().Error(err)
+		return
+	}
+	c.SetCookie(&http.Cookie{
+		Name:     downloadTicketCookie,
+		Value:    ticket,
+		Path:     "/api/shares/" + share.Code,
+		Expires:  expiresAt,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// sendSharedFile 发送分享中的文件，counted为false时计入下载次数
+func (h *ShareHandler) sendSharedFile(c echo.Context, share *model.Share, file *model.File, fileID string, counted bool) error {
+	// 未完成或未通过恶意软件扫描的文件不能下载，也不计入下载次数
+	if err := service.CheckScanStatus(file); err != nil {
+		return scanStatusError(c, err)
+	}
+
+	// 获取文件内容
+	fileData, err := h.FileService.GetFileContent(file)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	defer fileData.Close()
+
+	if !counted {
+		h.countDownload(c, share, fileID)
+	}
 
 	// 发送文件
-	return c.Stream(http.StatusOK, file.ContentType, fileData)
+	return serveFileContent(c, file, fileData)
+}
+
+// downloadBundle 将分享包中的全部文件打包为ZIP流式发送，不在服务端生成临时文件。
+// 未通过扫描的文件不打包；仍在扫描的文件需要等待扫描完成
+func (h *ShareHandler) downloadBundle(c echo.Context, share *model.Share, counted bool) error {
+	files, err := h.ShareService.GetShareFiles(share)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+
+	var entries []model.File
+	var blocked error
+	for _, file := range files {
+		// 端到端加密的文件需要客户端用链接中的密钥逐个解密，打包没有意义
+		if file.Encrypted {
+			return echo.NewHTTPError(http.StatusBadRequest, "分享包中包含端到端加密的文件，请逐个下载")
+		}
+		if err := service.CheckScanStatus(&file); err != nil {
+			if errors.Is(err, service.ErrScanPending) {
+				return scanStatusError(c, err)
+			}
+			blocked = err
+			continue
+		}
+		entries = append(entries, file)
+	}
+	if len(entries) == 0 {
+		if blocked != nil {
+			return scanStatusError(c, blocked)
+		}
+		return echo.NewHTTPError(http.StatusNotFound, "分享包中没有文件")
+	}
+
+	if !counted {
+		h.countDownload(c, share, "")
+	}
+
+	return streamArchive(c, h.FileService, "filebox-"+share.Code+".zip", entries)
+}
+
+// scanStatusError 将扫描状态检查的错误转换为HTTP错误，扫描中的文件提示客户端稍后重试
+func scanStatusError(c echo.Context, err error) error {
+	if errors.Is(err, service.ErrScanPending) {
+		c.Response().Header().Set("Retry-After", "30")
+		return echo.NewHTTPError(http.StatusConflict, err.Error())
+	}
+	return echo.NewHTTPError(http.StatusForbidden, err.Error())
 }
 
 // DeleteShare 删除分享
@@ -159,6 +349,7 @@ func (h *ShareHandler) RegisterRoutes(e *echo.Echo, jwtMiddleware echo.Middlewar
 	// 公开路由
 	e.GET("/api/shares/:code", h.GetShareByCode)
 	e.GET("/api/shares/:code/download", h.DownloadSharedFile)
+	e.GET("/api/shares/:code/files/:file_id/download", h.DownloadBundleFile)
 
 	// 需要认证的路由
 	shareGroup := e.Group("/api/files/:id/share")
@@ -167,6 +358,7 @@ func (h *ShareHandler) RegisterRoutes(e *echo.Echo, jwtMiddleware echo.Middlewar
 
 	userShareGroup := e.Group("/api/shares")
 	userShareGroup.Use(jwtMiddleware)
+	userShareGroup.POST("", h.CreateBundle)
 	userShareGroup.GET("", h.GetShares)
 	userShareGroup.DELETE("/:id", h.DeleteShare)
 }
@@ -0,0 +1,208 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/labstack/echo/v4"
+	"github.com/zaunist/filebox/backend/model"
+	"github.com/zaunist/filebox/backend/service"
+)
+
+// tusVersion 支持的tus协议版本
+const tusVersion = "1.0.0"
+
+// tusExposedHeaders 浏览器中的tus客户端需要读取的响应头
+const tusExposedHeaders = "Location, Tus-Resumable, Tus-Version, Tus-Extension, Tus-Max-Size, Upload-Offset, Upload-Length, Upload-Metadata, Upload-Expires"
+
+// UploadHandler 断点续传上传处理程序，实现tus 1.0协议的creation、termination和expiration扩展
+type UploadHandler struct {
+	UploadService *service.UploadService
+}
+
+// Options 返回服务端支持的协议版本和扩展
+func (h *UploadHandler) Options(c echo.Context) error {
+	header := c.Response().Header()
+	header.Set("Tus-Version", tusVersion)
+	header.Set("Tus-Extension", "creation,termination,expiration")
+	header.Set("Tus-Max-Size", strconv.FormatInt(h.UploadService.AppConfig.MaxFileSize, 10))
+	return c.NoContent(http.StatusNoContent)
+}
+
+// CreateUpload 创建上传，返回上传地址
+func (h *UploadHandler) CreateUpload(c echo.Context) error {
+	userID, err := optionalUserID(c)
+	if err != nil {
+		return err
+	}
+
+	req := c.Request()
+	if req.Header.Get("Upload-Defer-Length") != "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "不支持延迟声明上传长度")
+	}
+	length, err := strconv.ParseInt(req.Header.Get("Upload-Length"), 10, 64)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "无效的Upload-Length")
+	}
+
+	upload, err := h.UploadService.CreateUpload(length, req.Header.Get("Upload-Metadata"), userID)
+	if err != nil {
+		// tus协议要求Upload-Length超过Tus-Max-Size时返回413
+		if errors.Is(err, service.ErrUploadLengthExceeded) {
+			return echo.NewHTTPError(http.StatusRequestEntityTooLarge, err.Error())
+		}
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	header := c.Response().Header()
+	header.Set(echo.HeaderLocation, "/api/uploads/"+upload.ID.String())
+	setUploadHeaders(c, upload)
+	return c.NoContent(http.StatusCreated)
+}
+
+// HeadUpload 查询已接收的偏移量，客户端据此从断点继续上传
+func (h *UploadHandler) HeadUpload(c echo.Context) error {
+	userID, err := optionalUserID(c)
+	if err != nil {
+		return err
+	}
+
+	upload, err := h.UploadService.GetUpload(c.Param("id"), userID)
+	if err != nil {
+		return uploadError(err)
+	}
+
+	header := c.Response().Header()
+	header.Set("Upload-Length", strconv.FormatInt(upload.Length, 10))
+	if upload.Metadata != "" {
+		header.Set("Upload-Metadata", upload.Metadata)
+	}
+	header.Set(echo.HeaderCacheControl, "no-store")
+	setUploadHeaders(c, upload)
+	return c.NoContent(http.StatusOK)
+}
+
+// GetUpload 获取上传状态，上传完成后可从中获取文件ID，匿名上传还会返回取件码
+func (h *UploadHandler) GetUpload(c echo.Context) error {
+	userID, err := optionalUserID(c)
+	if err != nil {
+		return err
+	}
+
+	upload, err := h.UploadService.GetUpload(c.Param("id"), userID)
+	if err != nil {
+		return uploadError(err)
+	}
+
+	return c.JSON(http.StatusOK, upload)
+}
+
+// PatchUpload 从Upload-Offset处继续写入上传内容
+func (h *UploadHandler) PatchUpload(c echo.Context) error {
+	userID, err := optionalUserID(c)
+	if err != nil {
+		return err
+	}
+
+	req := c.Request()
+	if req.Header.Get(echo.HeaderContentType) != "application/offset+octet-stream" {
+		return echo.NewHTTPError(http.StatusUnsupportedMediaType, "Content-Type必须为application/offset+octet-stream")
+	}
+	offset, err := strconv.ParseInt(req.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil || offset < 0 {
+		return echo.NewHTTPError(http.StatusBadRequest, "无效的Upload-Offset")
+	}
+
+	upload, err := h.UploadService.WriteChunk(c.Param("id"), offset, req.Body, userID)
+	if err != nil {
+		return uploadError(err)
+	}
+
+	setUploadHeaders(c, upload)
+	return c.NoContent(http.StatusNoContent)
+}
+
+// DeleteUpload 终止上传并删除已接收的内容
+func (h *UploadHandler) DeleteUpload(c echo.Context) error {
+	userID, err := optionalUserID(c)
+	if err != nil {
+		return err
+	}
+
+	if err := h.UploadService.DeleteUpload(c.Param("id"), userID); err != nil {
+		return uploadError(err)
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+// RegisterRoutes 注册路由，authMiddleware应允许匿名访问
+func (h *UploadHandler) RegisterRoutes(e *echo.Echo, authMiddleware echo.MiddlewareFunc) {
+	uploadGroup := e.Group("/api/uploads")
+	uploadGroup.Use(tusMiddleware, authMiddleware)
+	uploadGroup.OPTIONS("", h.Options)
+	uploadGroup.POST("", h.CreateUpload)
+	uploadGroup.HEAD("/:id", h.HeadUpload)
+	uploadGroup.GET("/:id", h.GetUpload)
+	uploadGroup.PATCH("/:id", h.PatchUpload)
+	uploadGroup.DELETE("/:id", h.DeleteUpload)
+}
+
+// tusMiddleware 为所有响应添加协议版本头，并拒绝不兼容版本的客户端
+func tusMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		header := c.Response().Header()
+		header.Set("Tus-Resumable", tusVersion)
+		header.Set("Access-Control-Expose-Headers", tusExposedHeaders)
+
+		req := c.Request()
+		if req.Method != http.MethodOptions && req.Method != http.MethodGet &&
+			req.Header.Get("Tus-Resumable") != tusVersion {
+			header.Set("Tus-Version", tusVersion)
+			return echo.NewHTTPError(http.StatusPreconditionFailed, "不支持的tus协议版本")
+		}
+
+		return next(c)
+	}
+}
+
+// setUploadHeaders 设置上传偏移量和过期时间响应头
+func setUploadHeaders(c echo.Context, upload *model.Upload) {
+	header := c.Response().Header()
+	header.Set("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+	header.Set("Upload-Expires", upload.ExpiresAt.UTC().Format(http.TimeFormat))
+}
+
+// optionalUserID 获取当前登录用户ID，匿名请求返回nil
+func optionalUserID(c echo.Context) (*uuid.UUID, error) {
+	userIDStr, ok := c.Get("user_id").(string)
+	if !ok || strings.TrimSpace(userIDStr) == "" {
+		return nil, nil
+	}
+	userID, err := uuid.Parse(userIDStr)
+	if err != nil {
+		return nil, echo.NewHTTPError(http.StatusBadRequest, "无效的用户ID")
+	}
+	return &userID, nil
+}
+
+// uploadError 将上传服务的错误转换为对应的HTTP状态码
+func uploadError(err error) error {
+	switch {
+	case errors.Is(err, service.ErrUploadNotFound):
+		return echo.NewHTTPError(http.StatusNotFound, err.Error())
+	case errors.Is(err, service.ErrUploadOffsetMismatch):
+		return echo.NewHTTPError(http.StatusConflict, err.Error())
+	case errors.Is(err, service.ErrUploadLocked):
+		return echo.NewHTTPError(http.StatusLocked, err.Error())
+	case errors.Is(err, service.ErrUploadTooLarge):
+		return echo.NewHTTPError(http.StatusRequestEntityTooLarge, err.Error())
+	case errors.Is(err, service.ErrContentQuarantined):
+		return echo.NewHTTPError(http.StatusForbidden, err.Error())
+	default:
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/zaunist/filebox/backend/filestore"
+	"github.com/zaunist/filebox/backend/service"
+)
+
+// runCommand 执行命令行子命令，例如 ./filebox-server migrate-encryption -dry-run
+func runCommand(name string, args []string, storageService *service.StorageService, tieringService *service.TieringService) error {
+	flags := flag.NewFlagSet(name, flag.ExitOnError)
+	dryRun := flags.Bool("dry-run", false, "只统计需要处理的文件，不实际执行")
+
+	switch name {
+	case "migrate-encryption":
+		// 将旧版AES-CFB格式的文件重新加密为AES-GCM分块格式
+		flags.Parse(args)
+		report, err := storageService.MigrateLegacyEncryption(*dryRun)
+		return printReport("加密格式迁移", report, err)
+	case "rotate-keys":
+		// 用当前主密钥重新包装所有文件的数据密钥
+		flags.Parse(args)
+		report, err := storageService.RotateKeys(*dryRun)
+		return printReport("主密钥轮换", report, err)
+	case "dedupe-storage":
+		// 为历史文件建立内容索引并合并重复内容
+		flags.Parse(args)
+		report, err := storageService.DeduplicateBlobs(*dryRun)
+		return printReport("重复内容合并", report, err)
+	case "reconcile-storage":
+		// 核对存储对象与数据库记录，处理没有记录的孤立对象
+		action := flags.String("action", service.OrphanActionQuarantine, "孤立对象的处理方式: quarantine 或 delete")
+		minAge := flags.Duration("min-age", time.Hour, "只处理早于该时长之前写入的对象")
+		flags.Parse(args)
+		report, err := storageService.Reconcile(service.ReconcileOptions{
+			DryRun: *dryRun,
+			Action: *action,
+			MinAge: *minAge,
+		})
+		if err != nil {
+			return err
+		}
+		log.Printf("存储核对完成: 共%d个对象，孤立对象%d个（%d字节），隔离%d个，删除%d个，失败%d个，跳过近期写入%d个；内容丢失的文件%d个，Blob%d个",
+			report.Objects, report.OrphanObjects, report.OrphanBytes, report.Quarantined, report.Deleted,
+			report.Failed, report.Recent, report.MissingFiles, report.MissingBlobs)
+		if report.Failed > 0 {
+			return fmt.Errorf("%d个孤立对象处理失败", report.Failed)
+		}
+		return nil
+	case "migrate-storage":
+		// 将文件复制到另一个存储后端并切换文件记录
+		from := flags.String("from", "", "只迁移该存储后端中的文件，默认迁移所有不在目标后端中的文件")
+		to := flags.String("to", "", "目标存储后端ID，默认为STORAGE_ID")
+		deleteSource := flags.Bool("delete-source", false, "迁移后删除源后端中的对象")
+		flags.Parse(args)
+		report, err := storageService.MigrateStorage(service.StorageMigrationOptions{
+			DryRun:       *dryRun,
+			From:         *from,
+			To:           *to,
+			DeleteSource: *deleteSource,
+		})
+		return printReport("存储迁移", report, err)
+	case "repair-storage":
+		// 补齐镜像存储中缺失的副本
+		flags.Parse(args)
+		report, err := storageService.RepairReplicas(filestore.RepairOptions{DryRun: *dryRun})
+		if err != nil {
+			return err
+		}
+		log.Printf("副本修复完成: 共%d个对象，补齐%d个副本，删除%d个，失败%d个，丢失%d个，不可用的副本: %v",
+			report.Objects, report.Copied, report.Deleted, report.Failed, report.Lost, report.Unavailable)
+		if report.Failed > 0 || report.Lost > 0 || len(report.Unavailable) > 0 {
+			return fmt.Errorf("%d个副本修复失败，%d个对象丢失，%d个副本不可用", report.Failed, report.Lost, len(report.Unavailable))
+		}
+		return nil
+	case "detect-types":
+		// 检测历史文件的类型，记录客户端声明的类型并标记不一致的文件
+		flags.Parse(args)
+		report, err := storageService.DetectContentTypes(*dryRun)
+		return printReport("文件类型检测", report, err)
+	case "tier-storage":
+		// 按冷热分层策略将文件移动到冷存储
+		flags.Parse(args)
+		report, err := tieringService.Run(*dryRun)
+		if err != nil {
+			return err
+		}
+		log.Printf("冷热分层完成: 满足条件的对象%d个，移动%d个（%d字节），失败%d个",
+			report.Candidates, report.Moved, report.MovedBytes, report.Failed)
+		if report.Failed > 0 {
+			return fmt.Errorf("%d个对象移动失败", report.Failed)
+		}
+		return nil
+	case "verify-storage":
+		// 校验所有文件的内容哈希，结果记录在文件记录中
+		flags.Parse(args)
+		scrubService := &service.ScrubService{DB: storageService.DB, Storage: storageService.Storage}
+		report, err := scrubService.Run(time.Now())
+		if err != nil {
+			return err
+		}
+		log.Printf("完整性校验完成: 共%d个文件，正常%d个，损坏%d个，丢失%d个，出错%d个",
+			report.Total, report.OK, report.Corrupted, report.Missing, report.Errors)
+		if report.Corrupted > 0 || report.Missing > 0 {
+			return fmt.Errorf("%d个文件损坏，%d个文件丢失", report.Corrupted, report.Missing)
+		}
+		return nil
+	default:
+		return fmt.Errorf("未知命令: %s", name)
+	}
+}
+
+// printReport 输出维护任务的执行结果
+func printReport(title string, report *service.MigrationReport, err error) error {
+	if err != nil {
+		return err
+	}
+	log.Printf("%s完成: 共%d个文件，处理%d个，跳过%d个，失败%d个",
+		title, report.Total, report.Migrated, report.Skipped, report.Failed)
+	if report.Failed > 0 {
+		return fmt.Errorf("%d个文件处理失败", report.Failed)
+	}
+	return nil
+}
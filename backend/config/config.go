@@ -9,11 +9,47 @@ import (
 // AppConfig 应用配置
 type AppConfig struct {
 	Port                 int
+	PublicURL            string
 	JWTSecret            string
 	JWTExpirationHours   int
+	StorageType          string
+	StorageID            string
+	StorageBackends      string
 	StoragePath          string
+	StorageEncKey        string
+	StorageMasterKeys    string
+	StorageMasterKeyID   string
+	StorageKeyProviders  string
+	VaultAddr            string
+	VaultToken           string
+	VaultTokenFile       string
+	StorageCompression   string
+	StorageMirrorPaths   string
+	MirrorRepairMinutes  int
+	MirrorWriteTimeout   int
+	S3Endpoint           string
+	S3Region             string
+	S3Bucket             string
+	S3AccessKey          string
+	S3SecretKey          string
+	S3Prefix             string
+	S3UseSSL             bool
+	S3PartSize           int64
 	MaxFileSize          int64
 	MaxAnonymousFileSize int64
+	TypeMismatchPolicy   string
+	Scanner              string
+	ClamdAddress         string
+	ScanTimeoutSeconds   int
+	FetchAllowedNetworks string
+	FetchTimeoutMinutes  int
+	UploadPath           string // 断点续传暂存目录，只在本实例可见，多实例部署时同一上传的请求需要路由到同一实例
+	UploadExpireHours    int
+	ScrubIntervalHours   int
+	TierColdBackend      string
+	TierAfterDays        int
+	TierIdleDays         int
+	TierIntervalHours    int
 	DefaultExpireHours   int
 	DefaultDownloadLimit int
 	AdminEmail           string
@@ -25,11 +61,47 @@ type AppConfig struct {
 func NewAppConfig() *AppConfig {
 	return &AppConfig{
 		Port:                 getEnvAsInt("PORT", 8080),
+		PublicURL:            getEnv("PUBLIC_URL", ""),
 		JWTSecret:            getEnv("JWT_SECRET", "your-secret-key-change-in-production"),
 		JWTExpirationHours:   getEnvAsInt("JWT_EXPIRATION_HOURS", 24),
+		StorageType:          getEnv("STORAGE_TYPE", "local"),
+		StorageID:            getEnv("STORAGE_ID", "default"),
+		StorageBackends:      getEnv("STORAGE_BACKENDS", ""),
 		StoragePath:          getEnv("STORAGE_PATH", "./storage"),
+		StorageEncKey:        getEnv("STORAGE_ENC_KEY", ""),
+		StorageMasterKeys:    getEnv("STORAGE_MASTER_KEYS", ""),
+		StorageMasterKeyID:   getEnv("STORAGE_MASTER_KEY_ID", ""),
+		StorageKeyProviders:  getEnv("STORAGE_KEY_PROVIDERS", ""),
+		VaultAddr:            getEnv("VAULT_ADDR", ""),
+		VaultToken:           getEnv("VAULT_TOKEN", ""),
+		VaultTokenFile:       getEnv("VAULT_TOKEN_FILE", ""),
+		StorageCompression:   getEnv("STORAGE_COMPRESSION", "none"),
+		StorageMirrorPaths:   getEnv("STORAGE_MIRROR_PATHS", ""),
+		MirrorRepairMinutes:  getEnvAsInt("MIRROR_REPAIR_INTERVAL_MINUTES", 60),
+		MirrorWriteTimeout:   getEnvAsInt("MIRROR_WRITE_TIMEOUT_SECONDS", 30),
+		S3Endpoint:           getEnv("S3_ENDPOINT", "localhost:9000"),
+		S3Region:             getEnv("S3_REGION", "us-east-1"),
+		S3Bucket:             getEnv("S3_BUCKET", "filebox"),
+		S3AccessKey:          getEnv("S3_ACCESS_KEY", ""),
+		S3SecretKey:          getEnv("S3_SECRET_KEY", ""),
+		S3Prefix:             getEnv("S3_PREFIX", ""),
+		S3UseSSL:             getEnvAsBool("S3_USE_SSL", false),
+		S3PartSize:           getEnvAsInt64("S3_PART_SIZE", 16*1024*1024),            // 16MB
 		MaxFileSize:          getEnvAsInt64("MAX_FILE_SIZE", 100*1024*1024),          // 100MB
 		MaxAnonymousFileSize: getEnvAsInt64("MAX_ANONYMOUS_FILE_SIZE", 50*1024*1024), // 50MB
+		TypeMismatchPolicy:   getEnv("TYPE_MISMATCH_POLICY", "flag"),
+		Scanner:              getEnv("SCANNER", ""),
+		ClamdAddress:         getEnv("CLAMD_ADDRESS", "tcp://127.0.0.1:3310"),
+		ScanTimeoutSeconds:   getEnvAsInt("SCAN_TIMEOUT_SECONDS", 60),
+		FetchAllowedNetworks: getEnv("FETCH_ALLOWED_NETWORKS", ""),
+		FetchTimeoutMinutes:  getEnvAsInt("FETCH_TIMEOUT_MINUTES", 30),
+		UploadPath:           getEnv("UPLOAD_PATH", "./uploads"),
+		UploadExpireHours:    getEnvAsInt("UPLOAD_EXPIRE_HOURS", 24),
+		ScrubIntervalHours:   getEnvAsInt("SCRUB_INTERVAL_HOURS", 24),
+		TierColdBackend:      getEnv("TIER_COLD_BACKEND", ""),
+		TierAfterDays:        getEnvAsInt("TIER_AFTER_DAYS", 0),
+		TierIdleDays:         getEnvAsInt("TIER_IDLE_DAYS", 0),
+		TierIntervalHours:    getEnvAsInt("TIER_INTERVAL_HOURS", 24),
 		DefaultExpireHours:   getEnvAsInt("DEFAULT_EXPIRE_HOURS", 1),
 		DefaultDownloadLimit: getEnvAsInt("DEFAULT_DOWNLOAD_LIMIT", 0),
 		AdminEmail:           getEnv("ADMIN_EMAIL", "box@zaunist.com"),
@@ -77,3 +149,16 @@ func getEnvAsInt64(key string, defaultValue int64) int64 {
 	}
 	return value
 }
+
+// 获取环境变量并转换为布尔值
+func getEnvAsBool(key string, defaultValue bool) bool {
+	valueStr := getEnv(key, "")
+	if valueStr == "" {
+		return defaultValue
+	}
+	value, err := strconv.ParseBool(valueStr)
+	if err != nil {
+		return defaultValue
+	}
+	return value
+}
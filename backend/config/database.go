@@ -66,11 +66,16 @@ func NewDatabase() *Database {
 	}
 
 	// 自动迁移数据库结构
-	err = db.AutoMigrate(&model.User{}, &model.File{}, &model.Share{})
+	err = db.AutoMigrate(&model.User{}, &model.Folder{}, &model.File{}, &model.FileTag{}, &model.Blob{}, &model.Share{}, &model.ShareFile{}, &model.DownloadTicket{}, &model.DownloadTicketFile{}, &model.Upload{}, &model.FetchJob{})
 	if err != nil {
 		log.Fatalf("数据库迁移失败: %v", err)
 	}
 
+	// 根目录下文件夹的parent_id为NULL，唯一索引idx_folder_name不比较NULL，根目录的文件夹名另建部分唯一索引
+	if err := db.Exec("CREATE UNIQUE INDEX IF NOT EXISTS idx_folder_root_name ON folders (user_id, name) WHERE parent_id IS NULL").Error; err != nil {
+		log.Fatalf("创建根目录文件夹名唯一索引失败，请先重命名根目录下的同名文件夹: %v", err)
+	}
+
 	return &Database{DB: db}
 }
 
@@ -0,0 +1,320 @@
+package filestore
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// 文件头中记录的压缩算法
+const (
+	compressionNone         = 0
+	compressionZstd         = 1 // 整个文件是一个zstd压缩流，旧版本写入
+	compressionZstdSeekable = 2 // 按compressFrameSize分为独立的zstd帧，末尾是跳转表
+)
+
+// zstd可定位格式，见zstd源码contrib/seekable_format/zstd_seekable_compression_format.md
+const (
+	compressFrameSize   = 1 << 20 // 每帧压缩的原始大小，定位时最多需要解压并丢弃一帧
+	seekTableMagic      = 0x184D2A5E
+	seekableMagic       = 0x8F92EAB1
+	seekTableHeaderSize = 8
+	seekTableEntrySize  = 8
+	seekTableFooterSize = 9
+)
+
+// 压缩配置
+const (
+	CompressionNone = "none"
+	CompressionZstd = "zstd"
+)
+
+// incompressibleTypes 本身已压缩的内容类型，再压缩只会浪费CPU
+var incompressibleTypes = map[string]bool{
+	"application/zip":              true,
+	"application/gzip":             true,
+	"application/x-gzip":           true,
+	"application/x-bzip2":          true,
+	"application/x-xz":             true,
+	"application/x-7z-compressed":  true,
+	"application/x-rar-compressed": true,
+	"application/vnd.rar":          true,
+	"application/zstd":             true,
+	"application/java-archive":     true,
+	"application/epub+zip":         true,
+	"application/pdf":              true,
+}
+
+// incompressibleExts 本身已压缩的文件扩展名，用于客户端未提供准确内容类型的情况
+var incompressibleExts = map[string]bool{
+	".zip": true, ".gz": true, ".tgz": true, ".bz2": true, ".xz": true, ".7z": true,
+	".rar": true, ".zst": true, ".jar": true, ".apk": true, ".epub": true, ".pdf": true,
+	".docx": true, ".xlsx": true, ".pptx": true,
+	".jpg": true, ".jpeg": true, ".png": true, ".gif": true, ".webp": true, ".heic": true, ".avif": true,
+	".mp3": true, ".aac": true, ".ogg": true, ".flac": true, ".m4a": true, ".opus": true,
+	".mp4": true, ".mkv": true, ".mov": true, ".avi": true, ".webm": true, ".m4v": true,
+}
+
+// shouldCompress 判断文件是否值得压缩，图片、音视频和压缩包等已压缩的内容直接加密
+func shouldCompress(meta FileMeta) bool {
+	// 客户端加密后的内容与随机数据无异
+	if meta.EncryptedMeta != "" {
+		return false
+	}
+	if incompressibleExts[strings.ToLower(path.Ext(meta.Name))] {
+		return false
+	}
+
+	contentType := strings.ToLower(strings.TrimSpace(meta.ContentType))
+	if i := strings.IndexByte(contentType, ';'); i >= 0 {
+		contentType = strings.TrimSpace(contentType[:i])
+	}
+	if incompressibleTypes[contentType] {
+		return false
+	}
+	if strings.HasPrefix(contentType, "application/vnd.openxmlformats-officedocument.") {
+		return false
+	}
+
+	// 未压缩的位图、音频和SVG仍然可以压缩
+	switch contentType {
+	case "image/svg+xml", "image/bmp", "image/x-ms-bmp", "image/tiff", "audio/wav", "audio/x-wav":
+		return true
+	}
+	for _, prefix := range []string{"image/", "audio/", "video/"} {
+		if strings.HasPrefix(contentType, prefix) {
+			return false
+		}
+	}
+	return true
+}
+
+// compressTo 将src按compressFrameSize分段压缩为互相独立的zstd帧写入dst，
+// 最后写入zstd可定位格式（seekable format）的跳转表，读取时可以直接定位到任意帧
+func compressTo(dst io.Writer, src io.Reader) error {
+	encoder, err := zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1))
+	if err != nil {
+		return fmt.Errorf("创建压缩器失败: %w", err)
+	}
+	defer encoder.Close()
+
+	buf := make([]byte, compressFrameSize)
+	var frame []byte
+	var table []byte
+	frames := 0
+	for {
+		n, err := io.ReadFull(src, buf)
+		if n > 0 {
+			frame = encoder.EncodeAll(buf[:n], frame[:0])
+			if _, err := dst.Write(frame); err != nil {
+				return fmt.Errorf("压缩文件失败: %w", err)
+			}
+			table = binary.LittleEndian.AppendUint32(table, uint32(len(frame)))
+			table = binary.LittleEndian.AppendUint32(table, uint32(n))
+			frames++
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("压缩文件失败: %w", err)
+		}
+	}
+
+	// 跳转表是一个可跳过帧，解压器会忽略它
+	footer := binary.LittleEndian.AppendUint32(nil, seekTableMagic)
+	footer = binary.LittleEndian.AppendUint32(footer, uint32(len(table)+seekTableFooterSize))
+	footer = append(footer, table...)
+	footer = binary.LittleEndian.AppendUint32(footer, uint32(frames))
+	footer = append(footer, 0)
+	footer = binary.LittleEndian.AppendUint32(footer, seekableMagic)
+	if _, err := dst.Write(footer); err != nil {
+		return fmt.Errorf("压缩文件失败: %w", err)
+	}
+	return nil
+}
+
+// zstdFrame 压缩数据中一段可以单独解压的内容
+type zstdFrame struct {
+	offset int64 // 在压缩数据中的偏移
+	size   int64 // 压缩后的大小
+	start  int64 // 解压后的起始偏移
+	end    int64 // 解压后的结束偏移
+}
+
+// readSeekTable 读取压缩数据末尾的跳转表，返回各帧的位置。
+// 压缩数据已经过认证解密，这里只需防止跳转表与实际大小不符
+func readSeekTable(src io.ReadSeeker, size int64) ([]zstdFrame, error) {
+	total, err := src.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, err
+	}
+	if total < seekTableHeaderSize+seekTableFooterSize {
+		return nil, ErrCorrupted
+	}
+	footer := make([]byte, seekTableFooterSize)
+	if _, err := src.Seek(-seekTableFooterSize, io.SeekEnd); err != nil {
+		return nil, err
+	}
+	if _, err := io.ReadFull(src, footer); err != nil {
+		return nil, err
+	}
+	count := int64(binary.LittleEndian.Uint32(footer))
+	if binary.LittleEndian.Uint32(footer[5:]) != seekableMagic || footer[4] != 0 {
+		return nil, ErrCorrupted
+	}
+	tableSize := count * seekTableEntrySize
+	if tableSize > total-seekTableHeaderSize-seekTableFooterSize {
+		return nil, ErrCorrupted
+	}
+
+	table := make([]byte, tableSize)
+	if _, err := src.Seek(-(seekTableFooterSize + tableSize), io.SeekEnd); err != nil {
+		return nil, err
+	}
+	if _, err := io.ReadFull(src, table); err != nil {
+		return nil, err
+	}
+
+	frames := make([]zstdFrame, count)
+	var offset, start int64
+	for i := range frames {
+		entry := table[i*seekTableEntrySize:]
+		frames[i] = zstdFrame{
+			offset: offset,
+			size:   int64(binary.LittleEndian.Uint32(entry)),
+			start:  start,
+			end:    start + int64(binary.LittleEndian.Uint32(entry[4:])),
+		}
+		offset += frames[i].size
+		start = frames[i].end
+	}
+	if offset+seekTableHeaderSize+tableSize+seekTableFooterSize != total || start != size {
+		return nil, ErrCorrupted
+	}
+	return frames, nil
+}
+
+// zstdReader 解压读取压缩后加密的文件。压缩数据由独立的帧组成，
+// Seek时定位到目标所在的帧重新解压，最多丢弃一帧内的内容。
+// 旧版文件整个是一个压缩流，只能视为一帧，向前Seek时需要从头重新解压
+type zstdReader struct {
+	src     io.ReadSeeker // 解密后的压缩数据
+	decoder *zstd.Decoder
+	frames  []zstdFrame
+	size    int64 // 原始大小
+	pos     int64 // 当前读取位置
+	frame   int   // 当前解压的帧，-1表示尚未开始
+	decoded int64 // 解压器已输出到的原始偏移
+}
+
+func newZstdReader(src io.ReadSeeker, size int64, compression byte) (*zstdReader, error) {
+	if size < 0 {
+		return nil, errors.New("压缩文件缺少原始大小")
+	}
+
+	var frames []zstdFrame
+	if compression == compressionZstdSeekable {
+		var err error
+		if frames, err = readSeekTable(src, size); err != nil {
+			if errors.Is(err, ErrCorrupted) {
+				return nil, err
+			}
+			return nil, fmt.Errorf("读取压缩文件失败: %w", err)
+		}
+	} else {
+		frames = []zstdFrame{{size: -1, end: size}}
+	}
+
+	decoder, err := zstd.NewReader(nil, zstd.WithDecoderConcurrency(1), zstd.WithDecoderLowmem(true))
+	if err != nil {
+		return nil, fmt.Errorf("创建解压器失败: %w", err)
+	}
+	return &zstdReader{src: src, decoder: decoder, frames: frames, size: size, frame: -1}, nil
+}
+
+func (r *zstdReader) Read(p []byte) (int, error) {
+	if r.pos >= r.size {
+		return 0, io.EOF
+	}
+
+	index := sort.Search(len(r.frames), func(i int) bool { return r.frames[i].end > r.pos })
+	if index == len(r.frames) {
+		return 0, ErrCorrupted
+	}
+	frame := r.frames[index]
+	if index != r.frame || r.pos < r.decoded {
+		if err := r.reset(index); err != nil {
+			return 0, err
+		}
+	}
+	if r.pos > r.decoded {
+		skipped, err := io.CopyN(io.Discard, r.decoder, r.pos-r.decoded)
+		r.decoded += skipped
+		if err != nil {
+			return 0, r.decodeError(err)
+		}
+	}
+
+	if remaining := frame.end - r.pos; int64(len(p)) > remaining {
+		p = p[:remaining]
+	}
+	n, err := r.decoder.Read(p)
+	r.pos += int64(n)
+	r.decoded += int64(n)
+	if err != nil && (err != io.EOF || r.pos < frame.end) {
+		return n, r.decodeError(err)
+	}
+	return n, nil
+}
+
+// reset 从第index帧的开头重新解压
+func (r *zstdReader) reset(index int) error {
+	frame := r.frames[index]
+	if _, err := r.src.Seek(frame.offset, io.SeekStart); err != nil {
+		return err
+	}
+	var src io.Reader = r.src
+	if frame.size >= 0 {
+		src = io.LimitReader(r.src, frame.size)
+	}
+	if err := r.decoder.Reset(src); err != nil {
+		return fmt.Errorf("解压文件失败: %w", err)
+	}
+	r.frame = index
+	r.decoded = frame.start
+	return nil
+}
+
+// decodeError 转换解压错误，解密层的错误原样返回
+func (r *zstdReader) decodeError(err error) error {
+	if errors.Is(err, ErrCorrupted) {
+		return err
+	}
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return fmt.Errorf("解压文件失败: %w", err)
+}
+
+// Seek 设置明文读取位置
+func (r *zstdReader) Seek(offset int64, whence int) (int64, error) {
+	pos, err := seekPosition(r.pos, r.size, offset, whence)
+	if err != nil {
+		return 0, err
+	}
+	r.pos = pos
+	return pos, nil
+}
+
+// Close 释放解压器
+func (r *zstdReader) Close() error {
+	r.decoder.Close()
+	return nil
+}
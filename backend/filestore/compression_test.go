@@ -0,0 +1,230 @@
+package filestore
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// compressibleData 返回容易压缩的size字节文本
+func compressibleData(size int) []byte {
+	line := []byte("2024-01-01T00:00:00Z INFO filebox request completed status=200\n")
+	return bytes.Repeat(line, size/len(line)+1)[:size]
+}
+
+// compressStream 按旧版格式将src压缩为一个zstd流写入dst
+func compressStream(dst io.Writer, src io.Reader) error {
+	encoder, err := zstd.NewWriter(dst, zstd.WithEncoderConcurrency(1))
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(encoder, src); err != nil {
+		encoder.Close()
+		return err
+	}
+	return encoder.Close()
+}
+
+// countingReadSeeker 记录从数据源读取的字节数
+type countingReadSeeker struct {
+	io.ReadSeeker
+	n int64
+}
+
+func (r *countingReadSeeker) Read(p []byte) (int, error) {
+	n, err := r.ReadSeeker.Read(p)
+	r.n += int64(n)
+	return n, err
+}
+
+func TestZstdRoundTrip(t *testing.T) {
+	key := testKey(t)
+	for _, size := range []int{0, 1, 1000, 5*defaultChunkSize + 7, compressFrameSize, 2*compressFrameSize + 3} {
+		plain := compressibleData(size)
+		data := encryptChunks(t, key, plain, compressionZstdSeekable)
+		if data[4] != formatVersion2 || data[6] != compressionZstdSeekable {
+			t.Fatalf("size %d: header % x is not version 2 zstd", size, data[:formatHeaderSize2])
+		}
+		if size > defaultChunkSize && len(data) >= size/10 {
+			t.Errorf("size %d: compressed to %d bytes", size, len(data))
+		}
+
+		got, err := decryptAll(key, data, int64(size))
+		if err != nil {
+			t.Fatalf("size %d: %v", size, err)
+		}
+		if !bytes.Equal(got, plain) {
+			t.Fatalf("size %d: plaintext mismatch", size)
+		}
+	}
+}
+
+func TestZstdSeek(t *testing.T) {
+	key := testKey(t)
+	// 随机数据与文本交替，压缩后跨越多个加密块
+	var plain []byte
+	for i := 0; i < 4; i++ {
+		plain = append(plain, testData(t, defaultChunkSize)...)
+		plain = append(plain, compressibleData(defaultChunkSize)...)
+	}
+	plain = bytes.Repeat(plain, 3)
+
+	chunk := int64(defaultChunkSize)
+	frame := int64(compressFrameSize)
+	// 依次向后、向前跳转，包括跨越帧边界的读取
+	offsets := []int64{0, 3*chunk - 4, 7 * chunk, chunk + 1, frame - 100, frame + 5*chunk, 5*chunk + 100, 2, frame, 24*chunk - 20}
+	for _, compression := range []byte{compressionZstd, compressionZstdSeekable} {
+		data := encryptChunks(t, key, plain, compression)
+		r, err := newDecryptReader(bytes.NewReader(data), key, int64(len(plain)), FormatChunked)
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkSeek(t, r, plain, offsets, 4096)
+	}
+}
+
+// 定位到文件末尾时只需要读取并解压最后一帧
+func TestZstdSeekReadsOneFrame(t *testing.T) {
+	key := testKey(t)
+	plain := testData(t, 6*compressFrameSize)
+	data := encryptChunks(t, key, plain, compressionZstdSeekable)
+	src := &countingReadSeeker{ReadSeeker: bytes.NewReader(data)}
+	r, err := newDecryptReader(src, key, int64(len(plain)), FormatChunked)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Seek(-100, io.SeekEnd); err != nil {
+		t.Fatal(err)
+	}
+	got, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, plain[len(plain)-100:]) {
+		t.Fatal("plaintext mismatch")
+	}
+	if src.n > 2*compressFrameSize {
+		t.Fatalf("read %d bytes to seek to the end", src.n)
+	}
+}
+
+// 跳转表与原始大小不符时拒绝读取
+func TestZstdSeekTableMismatch(t *testing.T) {
+	key := testKey(t)
+	plain := compressibleData(compressFrameSize + 10)
+	data := encryptChunks(t, key, plain, compressionZstdSeekable)
+	if _, err := newDecryptReader(bytes.NewReader(data), key, int64(len(plain))-1, FormatChunked); !errors.Is(err, ErrCorrupted) {
+		t.Fatalf("err = %v, want ErrCorrupted", err)
+	}
+	// 旧版单个压缩流没有跳转表
+	data = encryptChunks(t, key, plain, compressionZstd)
+	data[6] = compressionZstdSeekable
+	if _, err := newDecryptReader(bytes.NewReader(data), key, int64(len(plain)), FormatChunked); err == nil {
+		t.Fatal("file without seek table accepted")
+	}
+}
+
+func TestZstdRequiresSize(t *testing.T) {
+	key := testKey(t)
+	data := encryptChunks(t, key, compressibleData(100), compressionZstdSeekable)
+	if _, err := newDecryptReader(bytes.NewReader(data), key, -1, FormatChunked); err == nil {
+		t.Fatal("compressed file opened without original size")
+	}
+}
+
+func TestZstdTampered(t *testing.T) {
+	key := testKey(t)
+	plain := compressibleData(3 * defaultChunkSize)
+	data := encryptChunks(t, key, plain, compressionZstdSeekable)
+	data[formatHeaderSize2+10] ^= 0x01
+	if _, err := decryptAll(key, data, int64(len(plain))); err == nil {
+		t.Fatal("tampered compressed file accepted")
+	}
+}
+
+// 启用压缩前写入的版本1文件仍然可以读取，新文件写为版本2
+func TestCompressionKeepsV1Readable(t *testing.T) {
+	backend, err := NewLocalBackend(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys, err := NewKeyRing(hex.EncodeToString(testKey(t)), "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	storage := NewEncryptedStorage(backend, keys)
+
+	plain := compressibleData(2*defaultChunkSize + 99)
+	save := func() BlobRef {
+		t.Helper()
+		result, err := storage.Save(bytes.NewReader(plain), FileMeta{Name: "app.log", ContentType: "text/plain", Size: int64(len(plain))})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return result.Ref()
+	}
+	version := func(ref BlobRef) byte {
+		t.Helper()
+		f, err := backend.Open(ref.Path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		header := make([]byte, 5)
+		if _, err := io.ReadFull(f, header); err != nil {
+			t.Fatal(err)
+		}
+		return header[4]
+	}
+
+	v1 := save()
+	storage.Compression = CompressionZstd
+	v2 := save()
+	if version(v1) != formatVersion1 || version(v2) != formatVersion2 {
+		t.Fatalf("versions = %d, %d", version(v1), version(v2))
+	}
+
+	for _, ref := range []BlobRef{v1, v2} {
+		r, err := storage.Get(ref)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := r.Seek(defaultChunkSize+1, io.SeekStart); err != nil {
+			t.Fatal(err)
+		}
+		got, err := io.ReadAll(r)
+		r.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, plain[defaultChunkSize+1:]) {
+			t.Fatalf("version %d: plaintext mismatch", version(ref))
+		}
+	}
+}
+
+func TestShouldCompress(t *testing.T) {
+	tests := []struct {
+		meta FileMeta
+		want bool
+	}{
+		{FileMeta{Name: "notes.txt", ContentType: "text/plain; charset=utf-8"}, true},
+		{FileMeta{Name: "data.csv", ContentType: "application/octet-stream"}, true},
+		{FileMeta{Name: "icon.svg", ContentType: "image/svg+xml"}, true},
+		{FileMeta{Name: "photo.JPG", ContentType: "application/octet-stream"}, false},
+		{FileMeta{Name: "archive", ContentType: "application/zip"}, false},
+		{FileMeta{Name: "clip", ContentType: "video/mp4"}, false},
+		{FileMeta{Name: "report.docx", ContentType: "application/vnd.openxmlformats-officedocument.wordprocessingml.document"}, false},
+		{FileMeta{Name: "secret.txt", ContentType: "text/plain", EncryptedMeta: "abc"}, false},
+	}
+	for _, tt := range tests {
+		if got := shouldCompress(tt.meta); got != tt.want {
+			t.Errorf("shouldCompress(%s, %s) = %v, want %v", tt.meta.Name, strings.TrimSpace(tt.meta.ContentType), got, tt.want)
+		}
+	}
+}
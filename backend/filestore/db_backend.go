@@ -0,0 +1,224 @@
+package filestore
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// dbChunkSize 数据库存储后端每行保存的字节数
+const dbChunkSize = 1 << 20
+
+// dbObject 数据库中保存的对象
+type dbObject struct {
+	ID        string `gorm:"primaryKey;size:36"`
+	Path      string `gorm:"size:512;uniqueIndex;not null"`
+	Size      int64
+	ChunkSize int64
+	CreatedAt time.Time
+}
+
+func (dbObject) TableName() string { return "storage_objects" }
+
+// dbChunk 对象内容的一个数据块
+type dbChunk struct {
+	ObjectID  string `gorm:"primaryKey;size:36"`
+	Seq       int64  `gorm:"primaryKey;autoIncrement:false"`
+	Data      []byte
+	CreatedAt time.Time
+}
+
+func (dbChunk) TableName() string { return "storage_chunks" }
+
+// DBBackend 数据库存储后端，将对象分块保存在数据库中，适合不便单独挂载存储目录的小型部署
+type DBBackend struct {
+	DB *gorm.DB
+}
+
+// NewDBBackend 创建数据库存储后端
+func NewDBBackend(db *gorm.DB) (*DBBackend, error) {
+	// 数据块内容不写入SQL日志
+	db = db.Session(&gorm.Session{Logger: db.Logger.LogMode(logger.Warn)})
+
+	if err := db.AutoMigrate(&dbObject{}, &dbChunk{}); err != nil {
+		return nil, fmt.Errorf("创建存储表失败: %w", err)
+	}
+
+	// 清理写入中断后留下的数据块
+	if err := db.Where("created_at < ? AND object_id NOT IN (?)",
+		time.Now().Add(-24*time.Hour), db.Model(&dbObject{}).Select("id"),
+	).Delete(&dbChunk{}).Error; err != nil {
+		return nil, fmt.Errorf("清理存储数据块失败: %w", err)
+	}
+
+	return &DBBackend{DB: db}, nil
+}
+
+// Put 写入对象。数据块逐个写入，不在一个长事务中完成，避免上传期间阻塞其他写操作；
+// 全部写入后再创建对象记录，读取方不会看到写了一半的对象
+func (b *DBBackend) Put(path string, r io.Reader, size int64) error {
+	obj := dbObject{
+		ID:        uuid.New().String(),
+		Path:      path,
+		ChunkSize: dbChunkSize,
+	}
+
+	buf := make([]byte, dbChunkSize)
+	for seq := int64(0); ; seq++ {
+		n, err := io.ReadFull(r, buf)
+		if n > 0 {
+			if err := b.DB.Create(&dbChunk{ObjectID: obj.ID, Seq: seq, Data: buf[:n]}).Error; err != nil {
+				b.deleteChunks(obj.ID)
+				return fmt.Errorf("写入文件失败: %w", err)
+			}
+			obj.Size += int64(n)
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			b.deleteChunks(obj.ID)
+			return fmt.Errorf("写入文件失败: %w", err)
+		}
+	}
+
+	// 替换同一路径下已有的对象
+	err := b.DB.Transaction(func(tx *gorm.DB) error {
+		var old dbObject
+		err := tx.Where("path = ?", path).First(&old).Error
+		if err == nil {
+			if err := tx.Where("object_id = ?", old.ID).Delete(&dbChunk{}).Error; err != nil {
+				return err
+			}
+			if err := tx.Delete(&old).Error; err != nil {
+				return err
+			}
+		} else if !errors.Is(err, gorm.ErrRecordNotFound) {
+			return err
+		}
+		return tx.Create(&obj).Error
+	})
+	if err != nil {
+		b.deleteChunks(obj.ID)
+		return fmt.Errorf("保存文件失败: %w", err)
+	}
+
+	return nil
+}
+
+// deleteChunks 删除写入失败的对象已写入的数据块
+func (b *DBBackend) deleteChunks(objectID string) {
+	_ = b.DB.Where("object_id = ?", objectID).Delete(&dbChunk{}).Error
+}
+
+// Open 打开对象，读取时按需逐块加载
+func (b *DBBackend) Open(path string) (io.ReadSeekCloser, error) {
+	var obj dbObject
+	if err := b.DB.Where("path = ?", path).First(&obj).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, fmt.Errorf("%w: %s", ErrNotFound, path)
+		}
+		return nil, fmt.Errorf("打开文件失败: %w", err)
+	}
+	return &dbReader{db: b.DB, obj: obj, seq: -1}, nil
+}
+
+// Delete 删除对象及其数据块
+func (b *DBBackend) Delete(path string) error {
+	err := b.DB.Transaction(func(tx *gorm.DB) error {
+		var obj dbObject
+		if err := tx.Where("path = ?", path).First(&obj).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return fmt.Errorf("%w: %s", ErrNotFound, path)
+			}
+			return err
+		}
+		if err := tx.Where("object_id = ?", obj.ID).Delete(&dbChunk{}).Error; err != nil {
+			return err
+		}
+		return tx.Delete(&obj).Error
+	})
+	if err != nil {
+		return fmt.Errorf("删除文件失败: %w", err)
+	}
+	return nil
+}
+
+// List 遍历数据库中的所有对象
+func (b *DBBackend) List(fn func(ObjectInfo) error) error {
+	var objects []dbObject
+	var fnErr error
+	err := b.DB.Select("id", "path", "size", "created_at").
+		FindInBatches(&objects, 500, func(tx *gorm.DB, batch int) error {
+			for _, obj := range objects {
+				if fnErr = fn(ObjectInfo{Path: obj.Path, Size: obj.Size, ModTime: obj.CreatedAt}); fnErr != nil {
+					return fnErr
+				}
+			}
+			return nil
+		}).Error
+	if fnErr != nil {
+		return fnErr
+	}
+	if err != nil {
+		return fmt.Errorf("列出对象失败: %w", err)
+	}
+	return nil
+}
+
+// dbReader 逐块读取数据库中的对象，内存中只保留当前数据块
+type dbReader struct {
+	db   *gorm.DB
+	obj  dbObject
+	pos  int64
+	seq  int64 // 当前已加载的数据块序号，-1表示尚未加载
+	data []byte
+}
+
+func (r *dbReader) Read(p []byte) (int, error) {
+	if r.pos >= r.obj.Size {
+		return 0, io.EOF
+	}
+
+	seq := r.pos / r.obj.ChunkSize
+	if seq != r.seq {
+		var chunk dbChunk
+		if err := r.db.Select("data").Where("object_id = ? AND seq = ?", r.obj.ID, seq).First(&chunk).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return 0, fmt.Errorf("读取文件失败: %w", io.ErrUnexpectedEOF)
+			}
+			return 0, fmt.Errorf("读取文件失败: %w", err)
+		}
+		r.seq = seq
+		r.data = chunk.Data
+	}
+
+	offset := r.pos - seq*r.obj.ChunkSize
+	if offset >= int64(len(r.data)) {
+		return 0, fmt.Errorf("读取文件失败: %w", io.ErrUnexpectedEOF)
+	}
+	n := copy(p, r.data[offset:])
+	r.pos += int64(n)
+	return n, nil
+}
+
+// Seek 设置读取位置
+func (r *dbReader) Seek(offset int64, whence int) (int64, error) {
+	pos, err := seekPosition(r.pos, r.obj.Size, offset, whence)
+	if err != nil {
+		return 0, err
+	}
+	r.pos = pos
+	return pos, nil
+}
+
+// Close 释放当前数据块
+func (r *dbReader) Close() error {
+	r.data = nil
+	return nil
+}
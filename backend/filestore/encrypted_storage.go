@@ -0,0 +1,310 @@
+package filestore
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+	"time"
+)
+
+// EncryptedStorage 在Backend之上实现加密存储，所有后端共用同一套加密格式。
+// 每个文件使用独立的数据密钥加密，数据密钥由KeyRing中的主密钥包装。
+type EncryptedStorage struct {
+	Backend   Backend
+	BackendID string // Backend的ID，记录在文件记录中
+	// Backends 其他仍可读取的存储后端，按ID索引。存储迁移期间旧后端中的文件从这里读取
+	Backends map[string]Backend
+	Keys     *KeyRing
+	// Compression 加密前使用的压缩算法（CompressionNone或CompressionZstd），已压缩的内容类型不会再压缩
+	Compression string
+}
+
+// NewEncryptedStorage 创建加密存储
+func NewEncryptedStorage(backend Backend, keys *KeyRing) *EncryptedStorage {
+	return &EncryptedStorage{
+		Backend: backend,
+		Keys:    keys,
+	}
+}
+
+// Save 保存文件，边计算哈希边加密写入后端，只读取一次源数据
+func (s *EncryptedStorage) Save(r io.Reader, meta FileMeta) (*SaveResult, error) {
+	storagePath, err := newStoragePath(meta.Name)
+	if err != nil {
+		return nil, err
+	}
+
+	// 为文件生成独立的数据密钥
+	dataKey, keyID, wrappedKey, err := s.Keys.NewDataKey()
+	if err != nil {
+		return nil, err
+	}
+
+	// 读取源数据的同时计算哈希和大小
+	hash := sha256.New()
+	src := &countingReader{r: io.TeeReader(r, hash)}
+
+	var compression byte = compressionNone
+	if s.Compression == CompressionZstd && shouldCompress(meta) {
+		compression = compressionZstdSeekable
+	}
+
+	// 通过管道边加密边写入后端
+	pr, pw := io.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		done <- encryptTo(pw, src, dataKey, compression)
+	}()
+
+	// 压缩后的大小无法预知
+	size := int64(-1)
+	if meta.Size >= 0 && compression == compressionNone {
+		size = encryptedSize(meta.Size)
+	}
+	if err := s.Backend.Put(storagePath, pr, size); err != nil {
+		pr.CloseWithError(err)
+		<-done
+		return nil, err
+	}
+	if err := <-done; err != nil {
+		_ = s.Backend.Delete(storagePath)
+		return nil, err
+	}
+
+	return &SaveResult{
+		Path:    storagePath,
+		Backend: s.BackendID,
+		Hash:    hex.EncodeToString(hash.Sum(nil)),
+		Size:    src.n,
+		Format:  FormatChunked,
+
+		KeyID:   keyID,
+		DataKey: wrappedKey,
+	}, nil
+}
+
+// encryptTo 将src按块加密写入pw，需要时先压缩，完成后关闭pw
+func encryptTo(pw *io.PipeWriter, src io.Reader, key []byte, compression byte) error {
+	writer, err := newChunkWriter(pw, key, compression)
+	if err == nil {
+		if compression != compressionNone {
+			err = compressTo(writer, src)
+		} else if _, err = io.Copy(writer, src); err != nil {
+			err = fmt.Errorf("加密写入文件失败: %w", err)
+		}
+	}
+	if err == nil {
+		err = writer.Close()
+	}
+	if err != nil {
+		pw.CloseWithError(err)
+		return err
+	}
+
+	return pw.Close()
+}
+
+// newStoragePath 生成存储路径 (按年/月/日)，文件名前缀为随机ID避免重名
+func newStoragePath(name string) (string, error) {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return "", fmt.Errorf("生成文件ID失败: %w", err)
+	}
+
+	now := time.Now()
+	fileName := fmt.Sprintf("%s_%s", hex.EncodeToString(id), path.Base(name))
+	return path.Join(fmt.Sprintf("%d/%02d/%02d", now.Year(), now.Month(), now.Day()), fileName), nil
+}
+
+// Get 获取文件
+func (s *EncryptedStorage) Get(ref BlobRef) (io.ReadSeekCloser, error) {
+	dataKey, err := s.Keys.DataKey(ref.KeyID, ref.DataKey)
+	if err != nil {
+		return nil, err
+	}
+
+	backend, err := s.backend(ref.Backend)
+	if err != nil {
+		return nil, err
+	}
+	file, err := backend.Open(ref.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	reader, err := newDecryptReader(file, dataKey, ref.Size, ref.Format)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	// 返回一个ReadSeekCloser，关闭时会关闭底层对象
+	return &decryptReadCloser{ReadSeeker: reader, file: file}, nil
+}
+
+// NeedsUpgrade 判断文件是否仍为旧版AES-CFB格式，需要重新加密
+func (s *EncryptedStorage) NeedsUpgrade(ref BlobRef) (bool, error) {
+	format := ref.Format
+	if format == FormatUnknown {
+		var err error
+		if format, err = s.DetectFormat(ref); err != nil {
+			return false, err
+		}
+	}
+	return format == FormatLegacy, nil
+}
+
+// DetectFormat 根据文件头识别存储格式，只用于尚未记录格式的历史文件
+func (s *EncryptedStorage) DetectFormat(ref BlobRef) (int, error) {
+	backend, err := s.backend(ref.Backend)
+	if err != nil {
+		return FormatUnknown, err
+	}
+	file, err := backend.Open(ref.Path)
+	if err != nil {
+		return FormatUnknown, err
+	}
+	defer file.Close()
+
+	legacy, err := isLegacyFormat(file)
+	if err != nil {
+		return FormatUnknown, err
+	}
+	if legacy {
+		return FormatLegacy, nil
+	}
+	return FormatChunked, nil
+}
+
+// PrimaryBackend 返回新文件写入的存储后端ID
+func (s *EncryptedStorage) PrimaryBackend() string {
+	return s.BackendID
+}
+
+// backend 按ID查找存储后端，ID为空表示当前写入的后端
+func (s *EncryptedStorage) backend(id string) (Backend, error) {
+	if id == "" || id == s.BackendID {
+		return s.Backend, nil
+	}
+	if backend, ok := s.Backends[id]; ok {
+		return backend, nil
+	}
+	return nil, fmt.Errorf("未配置存储后端: %s", id)
+}
+
+// Copy 将对象原样复制到指定后端的相同路径，数据密钥不变
+func (s *EncryptedStorage) Copy(ref BlobRef, backend string) error {
+	from, err := s.backend(ref.Backend)
+	if err != nil {
+		return err
+	}
+	to, err := s.backend(backend)
+	if err != nil {
+		return err
+	}
+	if from == to {
+		return errors.New("源和目标是同一个存储后端")
+	}
+
+	src, err := from.Open(ref.Path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	size, err := src.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	if _, err := src.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	return to.Put(ref.Path, src, size)
+}
+
+// List 遍历底层存储中的所有对象，跳过已隔离的对象
+func (s *EncryptedStorage) List(fn func(ObjectInfo) error) error {
+	return s.Backend.List(func(obj ObjectInfo) error {
+		if strings.HasPrefix(obj.Path, QuarantinePrefix+"/") {
+			return nil
+		}
+		return fn(obj)
+	})
+}
+
+// Quarantine 将对象原样（仍为密文）复制到隔离区后删除原对象
+func (s *EncryptedStorage) Quarantine(p string) (string, error) {
+	dst := path.Join(QuarantinePrefix, time.Now().Format("20060102"), p)
+	return dst, s.move(p, dst)
+}
+
+// Restore 将隔离区中的对象移回原路径，隔离区路径为 quarantine/日期/原路径
+func (s *EncryptedStorage) Restore(p string) (string, error) {
+	parts := strings.SplitN(p, "/", 3)
+	if len(parts) != 3 || parts[0] != QuarantinePrefix {
+		return "", fmt.Errorf("不是隔离区中的对象: %s", p)
+	}
+	dst := parts[2]
+	return dst, s.move(p, dst)
+}
+
+// move 在当前写入的后端中将对象原样复制到新路径后删除原对象
+func (s *EncryptedStorage) move(from, to string) error {
+	src, err := s.Backend.Open(from)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	size, err := src.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	if _, err := src.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	if err := s.Backend.Put(to, src, size); err != nil {
+		return err
+	}
+	return s.Backend.Delete(from)
+}
+
+// Delete 删除文件
+func (s *EncryptedStorage) Delete(ref BlobRef) error {
+	backend, err := s.backend(ref.Backend)
+	if err != nil {
+		return err
+	}
+	return backend.Delete(ref.Path)
+}
+
+// decryptReadCloser 实现io.ReadSeekCloser接口
+type decryptReadCloser struct {
+	io.ReadSeeker
+	file io.Closer
+}
+
+func (d *decryptReadCloser) Close() error {
+	if closer, ok := d.ReadSeeker.(io.Closer); ok {
+		closer.Close()
+	}
+	return d.file.Close()
+}
+
+// countingReader 统计读取的字节数
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
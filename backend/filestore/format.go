@@ -0,0 +1,516 @@
+package filestore
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// 加密文件格式
+//
+// 文件头(版本1): magic(4) | version(1) | algorithm(1) | chunkSize(4, 大端) | noncePrefix(7)
+// 文件头(版本2): magic(4) | version(1) | algorithm(1) | compression(1) | chunkSize(4, 大端) | noncePrefix(7)
+// 之后是若干加密块，每块为 chunkSize 字节明文经AES-GCM加密后的密文和16字节认证标签，
+// 最后一块可能不足chunkSize。每块的nonce为 noncePrefix(7) | 块序号(4, 大端) | 结束标志(1)，
+// 文件头作为附加认证数据，因此篡改文件头、调换块顺序或截断文件都会在读取时被发现。
+// 版本2的明文是经compression指定算法压缩后的数据；未压缩的文件仍写为版本1，旧版本程序可以读取。
+// 新写入的压缩数据按固定原始大小分为独立的zstd帧并附带跳转表，读取时可以直接定位。
+//
+// 旧版文件没有文件头，直接以16字节IV开头，后面是AES-CFB密文。
+const (
+	formatMagic       = "FBOX"
+	formatVersion1    = 1
+	formatVersion2    = 2
+	algAES256GCM      = 1
+	defaultChunkSize  = 64 * 1024
+	noncePrefixSize   = 7
+	formatHeaderSize  = len(formatMagic) + 1 + 1 + 4 + noncePrefixSize
+	formatHeaderSize2 = formatHeaderSize + 1
+	gcmTagSize        = 16
+	maxChunkSize      = 16 * 1024 * 1024
+	lastChunkFlag     = 1
+	notLastChunkFlag  = 0
+	legacyIVSize      = aes.BlockSize
+	chunkCounterLimit = 1<<32 - 1
+)
+
+// ErrCorrupted 文件内容校验失败（被篡改或损坏）
+var ErrCorrupted = errors.New("文件校验失败，内容可能已损坏或被篡改")
+
+// encryptedSize 计算明文大小为size时加密后的文件大小
+func encryptedSize(size int64) int64 {
+	chunks := (size + defaultChunkSize - 1) / defaultChunkSize
+	if chunks == 0 {
+		chunks = 1
+	}
+	return int64(formatHeaderSize) + size + chunks*gcmTagSize
+}
+
+// chunkNonce 生成第counter块的nonce
+func chunkNonce(prefix []byte, counter uint32, last bool) []byte {
+	nonce := make([]byte, noncePrefixSize+5)
+	copy(nonce, prefix)
+	binary.BigEndian.PutUint32(nonce[noncePrefixSize:], counter)
+	if last {
+		nonce[len(nonce)-1] = lastChunkFlag
+	} else {
+		nonce[len(nonce)-1] = notLastChunkFlag
+	}
+	return nonce
+}
+
+// newGCM 创建AES-256-GCM实例
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("创建加密器失败: %w", err)
+	}
+	return cipher.NewGCM(block)
+}
+
+// chunkWriter 按块加密写入
+type chunkWriter struct {
+	dst       io.Writer
+	aead      cipher.AEAD
+	header    []byte
+	prefix    []byte
+	chunkSize int
+	counter   uint32
+	buf       []byte
+	out       []byte
+}
+
+// newChunkWriter 写入文件头并返回加密写入器，调用方必须Close以写入最后一块。
+// compression为写入内容已使用的压缩算法，记录在文件头中
+func newChunkWriter(dst io.Writer, key []byte, compression byte) (*chunkWriter, error) {
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	prefix := make([]byte, noncePrefixSize)
+	if _, err := rand.Read(prefix); err != nil {
+		return nil, fmt.Errorf("生成nonce失败: %w", err)
+	}
+
+	header := make([]byte, 0, formatHeaderSize2)
+	header = append(header, formatMagic...)
+	if compression == compressionNone {
+		header = append(header, formatVersion1, algAES256GCM)
+	} else {
+		header = append(header, formatVersion2, algAES256GCM, compression)
+	}
+	header = binary.BigEndian.AppendUint32(header, defaultChunkSize)
+	header = append(header, prefix...)
+
+	if _, err := dst.Write(header); err != nil {
+		return nil, fmt.Errorf("写入文件头失败: %w", err)
+	}
+
+	return &chunkWriter{
+		dst:       dst,
+		aead:      aead,
+		header:    header,
+		prefix:    prefix,
+		chunkSize: defaultChunkSize,
+		buf:       make([]byte, 0, defaultChunkSize*2),
+		out:       make([]byte, 0, defaultChunkSize+gcmTagSize),
+	}, nil
+}
+
+func (w *chunkWriter) Write(p []byte) (int, error) {
+	w.buf = append(w.buf, p...)
+	// 保留最后一块直到Close，这样才能知道哪一块是结尾
+	for len(w.buf) > w.chunkSize {
+		if err := w.seal(w.buf[:w.chunkSize], false); err != nil {
+			return 0, err
+		}
+		w.buf = append(w.buf[:0], w.buf[w.chunkSize:]...)
+	}
+	return len(p), nil
+}
+
+// Close 写入最后一块
+func (w *chunkWriter) Close() error {
+	return w.seal(w.buf, true)
+}
+
+func (w *chunkWriter) seal(plain []byte, last bool) error {
+	if w.counter == chunkCounterLimit {
+		return errors.New("文件过大，超出加密块数量上限")
+	}
+	w.out = w.aead.Seal(w.out[:0], chunkNonce(w.prefix, w.counter, last), plain, w.header)
+	w.counter++
+	if _, err := w.dst.Write(w.out); err != nil {
+		return fmt.Errorf("写入加密数据失败: %w", err)
+	}
+	return nil
+}
+
+// chunkReader 按块解密读取，每块都会校验认证标签。
+// 每块密文长度固定，因此可以直接定位到任意明文偏移所在的块，支持Seek。
+type chunkReader struct {
+	src       io.ReadSeeker
+	aead      cipher.AEAD
+	header    []byte
+	prefix    []byte
+	chunkSize int64
+	chunks    int64 // 总块数
+	size      int64 // 明文总大小
+	pos       int64 // 当前明文偏移
+	loaded    int64 // 当前已解密的块序号，-1表示尚未加载
+	in        []byte
+	plain     []byte
+}
+
+func (r *chunkReader) Read(p []byte) (int, error) {
+	if r.pos >= r.size {
+		// 空文件也要校验唯一的一块，否则截断到只剩文件头的文件无法被发现
+		if r.size == 0 && r.loaded != 0 {
+			if err := r.load(0); err != nil {
+				return 0, err
+			}
+		}
+		return 0, io.EOF
+	}
+
+	index := r.pos / r.chunkSize
+	if index != r.loaded {
+		if err := r.load(index); err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(p, r.plain[r.pos-index*r.chunkSize:])
+	r.pos += int64(n)
+	return n, nil
+}
+
+// Seek 设置明文读取位置
+func (r *chunkReader) Seek(offset int64, whence int) (int64, error) {
+	pos, err := seekPosition(r.pos, r.size, offset, whence)
+	if err != nil {
+		return 0, err
+	}
+	r.pos = pos
+	return pos, nil
+}
+
+// load 读取并解密第index块
+func (r *chunkReader) load(index int64) error {
+	sealedSize := r.chunkSize + gcmTagSize
+	if _, err := r.src.Seek(int64(len(r.header))+index*sealedSize, io.SeekStart); err != nil {
+		return fmt.Errorf("读取文件失败: %w", err)
+	}
+
+	last := index == r.chunks-1
+	n := sealedSize
+	if last {
+		n = r.size - index*r.chunkSize + gcmTagSize
+	}
+	if _, err := io.ReadFull(r.src, r.in[:n]); err != nil {
+		return fmt.Errorf("读取文件失败: %w", err)
+	}
+
+	plain, err := r.aead.Open(r.plain[:0], chunkNonce(r.prefix, uint32(index), last), r.in[:n], r.header)
+	if err != nil {
+		r.loaded = -1
+		// 镜像存储中的对象可以改用其他副本重新读取
+		if r.failover() {
+			return r.load(index)
+		}
+		return ErrCorrupted
+	}
+	r.plain = plain
+	r.loaded = index
+	return nil
+}
+
+// failoverSource 有多个副本的数据源，当前副本内容校验失败时可以改用下一个副本
+type failoverSource interface {
+	Failover() error
+}
+
+// failover 改用下一个副本并重新读取文件头和长度，副本的文件头或长度损坏时同样可以恢复。
+// 没有其他副本时返回false
+func (r *chunkReader) failover() bool {
+	src, ok := r.src.(failoverSource)
+	if !ok || src.Failover() != nil {
+		return false
+	}
+
+	total, err := r.src.Seek(0, io.SeekEnd)
+	if err != nil {
+		return r.failover()
+	}
+	header := make([]byte, len(r.header))
+	if _, err := r.src.Seek(0, io.SeekStart); err != nil {
+		return r.failover()
+	}
+	if _, err := io.ReadFull(r.src, header); err != nil {
+		return r.failover()
+	}
+	chunks, size, err := chunkLayout(total-int64(len(header)), r.chunkSize)
+	if err != nil {
+		return r.failover()
+	}
+
+	r.header = header
+	r.prefix = header[len(header)-noncePrefixSize:]
+	r.chunks = chunks
+	r.size = size
+	return true
+}
+
+// chunkLayout 根据密文长度计算块数和明文大小，最后一块可能不足chunkSize
+func chunkLayout(body, chunkSize int64) (int64, int64, error) {
+	sealedSize := chunkSize + gcmTagSize
+	chunks := body / sealedSize
+	size := chunks * chunkSize
+	if rem := body % sealedSize; rem > 0 {
+		if rem < gcmTagSize {
+			return 0, 0, ErrCorrupted
+		}
+		chunks++
+		size += rem - gcmTagSize
+	}
+	if chunks == 0 || chunks > chunkCounterLimit {
+		return 0, 0, ErrCorrupted
+	}
+	return chunks, size, nil
+}
+
+// newDecryptReader 按存储格式返回可Seek的明文读取器，兼容旧版AES-CFB格式。
+// plainSize为原始明文大小，压缩文件无法从密文长度推算原始大小，需要由调用方提供；
+// format为数据库中记录的存储格式，只有FormatLegacy的文件按旧版格式解密
+func newDecryptReader(src io.ReadSeeker, key []byte, plainSize int64, format int) (io.ReadSeeker, error) {
+	reader, err := openDecryptReader(src, key, plainSize, format)
+	// 镜像存储中文件头或长度已损坏的副本改用其他副本
+	for errors.Is(err, ErrCorrupted) {
+		source, ok := src.(failoverSource)
+		if !ok || source.Failover() != nil {
+			break
+		}
+		reader, err = openDecryptReader(src, key, plainSize, format)
+	}
+	return reader, err
+}
+
+// openDecryptReader 从当前数据源读取文件头并创建明文读取器
+func openDecryptReader(src io.ReadSeeker, key []byte, plainSize int64, format int) (io.ReadSeeker, error) {
+	total, err := src.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, fmt.Errorf("读取文件失败: %w", err)
+	}
+	if _, err := src.Seek(0, io.SeekStart); err != nil {
+		return nil, fmt.Errorf("读取文件失败: %w", err)
+	}
+
+	if format == FormatLegacy {
+		return newLegacyReader(src, total, key)
+	}
+	legacy, err := isLegacyFormat(src)
+	if err != nil {
+		return nil, err
+	}
+	if legacy {
+		// 尚未记录格式的历史文件仍按文件头识别，记录为分块格式的文件缺少文件头说明已被篡改或损坏
+		if format != FormatUnknown {
+			return nil, ErrCorrupted
+		}
+		return newLegacyReader(src, total, key)
+	}
+
+	if _, err := src.Seek(0, io.SeekStart); err != nil {
+		return nil, fmt.Errorf("读取文件失败: %w", err)
+	}
+	header := make([]byte, formatHeaderSize2)
+	if _, err := io.ReadFull(src, header[:len(formatMagic)+1]); err != nil {
+		return nil, fmt.Errorf("读取文件头失败: %w", err)
+	}
+
+	version := header[4]
+	compression := byte(compressionNone)
+	switch version {
+	case formatVersion1:
+		header = header[:formatHeaderSize]
+	case formatVersion2:
+	default:
+		return nil, fmt.Errorf("不支持的文件格式版本: %d", version)
+	}
+	if _, err := io.ReadFull(src, header[len(formatMagic)+1:]); err != nil {
+		return nil, fmt.Errorf("读取文件头失败: %w", err)
+	}
+
+	// 版本2在算法之后多一个字节记录压缩算法
+	fields := header[5:]
+	alg := fields[0]
+	if version == formatVersion2 {
+		compression = fields[1]
+		fields = fields[1:]
+	}
+	chunkSize := int64(binary.BigEndian.Uint32(fields[1:5]))
+	prefix := fields[5:]
+	if alg != algAES256GCM {
+		return nil, fmt.Errorf("不支持的加密算法: %d", alg)
+	}
+	if compression != compressionNone && compression != compressionZstd && compression != compressionZstdSeekable {
+		return nil, fmt.Errorf("不支持的压缩算法: %d", compression)
+	}
+	if chunkSize <= 0 || chunkSize > maxChunkSize {
+		return nil, ErrCorrupted
+	}
+
+	chunks, size, err := chunkLayout(total-int64(len(header)), chunkSize)
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	reader := &chunkReader{
+		src:       src,
+		aead:      aead,
+		header:    header,
+		prefix:    prefix,
+		chunkSize: chunkSize,
+		chunks:    chunks,
+		size:      size,
+		loaded:    -1,
+		in:        make([]byte, chunkSize+gcmTagSize),
+		plain:     make([]byte, 0, chunkSize),
+	}
+	if compression != compressionNone {
+		return newZstdReader(reader, plainSize, compression)
+	}
+	return reader, nil
+}
+
+// legacyReader 读取旧版 IV + AES-CFB 格式的文件。
+// CFB模式下每个分组的解密只依赖前一个密文分组，因此同样可以Seek。
+type legacyReader struct {
+	src    io.ReadSeeker
+	block  cipher.Block
+	iv     []byte
+	size   int64
+	pos    int64
+	stream *cipher.StreamReader // 为nil表示需要按pos重新定位
+}
+
+func newLegacyReader(src io.ReadSeeker, total int64, key []byte) (*legacyReader, error) {
+	if _, err := src.Seek(0, io.SeekStart); err != nil {
+		return nil, fmt.Errorf("读取文件失败: %w", err)
+	}
+	iv := make([]byte, legacyIVSize)
+	if _, err := io.ReadFull(src, iv); err != nil {
+		return nil, fmt.Errorf("读取IV失败: %w", err)
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("创建解密器失败: %w", err)
+	}
+
+	return &legacyReader{
+		src:   src,
+		block: block,
+		iv:    iv,
+		size:  total - legacyIVSize,
+	}, nil
+}
+
+func (r *legacyReader) Read(p []byte) (int, error) {
+	if r.pos >= r.size {
+		return 0, io.EOF
+	}
+	if r.stream == nil {
+		if err := r.reposition(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := r.stream.Read(p)
+	r.pos += int64(n)
+	return n, err
+}
+
+// Seek 设置明文读取位置
+func (r *legacyReader) Seek(offset int64, whence int) (int64, error) {
+	pos, err := seekPosition(r.pos, r.size, offset, whence)
+	if err != nil {
+		return 0, err
+	}
+	if pos != r.pos {
+		r.pos = pos
+		r.stream = nil
+	}
+	return pos, nil
+}
+
+// reposition 以pos所在分组的前一个密文分组作为IV重建解密流
+func (r *legacyReader) reposition() error {
+	blockIndex := r.pos / aes.BlockSize
+	iv := r.iv
+	if blockIndex > 0 {
+		iv = make([]byte, aes.BlockSize)
+		if _, err := r.src.Seek(legacyIVSize+(blockIndex-1)*aes.BlockSize, io.SeekStart); err != nil {
+			return fmt.Errorf("读取文件失败: %w", err)
+		}
+		if _, err := io.ReadFull(r.src, iv); err != nil {
+			return fmt.Errorf("读取文件失败: %w", err)
+		}
+	}
+	if _, err := r.src.Seek(legacyIVSize+blockIndex*aes.BlockSize, io.SeekStart); err != nil {
+		return fmt.Errorf("读取文件失败: %w", err)
+	}
+
+	r.stream = &cipher.StreamReader{S: cipher.NewCFBDecrypter(r.block, iv), R: r.src}
+
+	// 跳过分组内pos之前的字节
+	skip := r.pos % aes.BlockSize
+	if skip > 0 {
+		if _, err := io.CopyN(io.Discard, r.stream, skip); err != nil {
+			return fmt.Errorf("读取文件失败: %w", err)
+		}
+	}
+	return nil
+}
+
+// seekPosition 计算Seek后的位置
+func seekPosition(current, size, offset int64, whence int) (int64, error) {
+	var pos int64
+	switch whence {
+	case io.SeekStart:
+		pos = offset
+	case io.SeekCurrent:
+		pos = current + offset
+	case io.SeekEnd:
+		pos = size + offset
+	default:
+		return 0, errors.New("无效的whence参数")
+	}
+	if pos < 0 {
+		return 0, errors.New("无效的偏移量")
+	}
+	return pos, nil
+}
+
+// isLegacyFormat 判断文件是否为旧版AES-CFB格式
+func isLegacyFormat(src io.Reader) (bool, error) {
+	magic := make([]byte, len(formatMagic))
+	if _, err := io.ReadFull(src, magic); err != nil {
+		if err == io.ErrUnexpectedEOF || err == io.EOF {
+			// 比文件头还短的只能是旧版文件
+			return true, nil
+		}
+		return false, fmt.Errorf("读取文件头失败: %w", err)
+	}
+	return !bytes.Equal(magic, []byte(formatMagic)), nil
+}
@@ -0,0 +1,365 @@
+package filestore
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// testKey 返回随机的AES-256密钥
+func testKey(t *testing.T) []byte {
+	t.Helper()
+	key := make([]byte, dataKeySize)
+	if _, err := rand.Read(key); err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+// testData 返回size字节的随机数据
+func testData(t *testing.T, size int) []byte {
+	t.Helper()
+	data := make([]byte, size)
+	if _, err := rand.Read(data); err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// encryptChunks 用分块格式加密plain
+func encryptChunks(t *testing.T, key, plain []byte, compression byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	w, err := newChunkWriter(&buf, key, compression)
+	if err != nil {
+		t.Fatal(err)
+	}
+	switch compression {
+	case compressionZstd:
+		err = compressStream(w, bytes.NewReader(plain))
+	case compressionZstdSeekable:
+		err = compressTo(w, bytes.NewReader(plain))
+	default:
+		_, err = w.Write(plain)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// decryptAll 按分块格式解密并读取全部内容
+func decryptAll(key, data []byte, size int64) ([]byte, error) {
+	return decryptFormat(key, data, size, FormatChunked)
+}
+
+// decryptFormat 按指定的存储格式解密并读取全部内容
+func decryptFormat(key, data []byte, size int64, format int) ([]byte, error) {
+	r, err := newDecryptReader(bytes.NewReader(data), key, size, format)
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(r)
+}
+
+func TestChunkRoundTrip(t *testing.T) {
+	key := testKey(t)
+	for _, size := range []int{0, 1, defaultChunkSize - 1, defaultChunkSize, defaultChunkSize + 1, 3*defaultChunkSize + 17} {
+		plain := testData(t, size)
+		data := encryptChunks(t, key, plain, compressionNone)
+		if got := int64(len(data)); got != encryptedSize(int64(size)) {
+			t.Errorf("size %d: encrypted size %d, want %d", size, got, encryptedSize(int64(size)))
+		}
+
+		got, err := decryptAll(key, data, int64(size))
+		if err != nil {
+			t.Fatalf("size %d: %v", size, err)
+		}
+		if !bytes.Equal(got, plain) {
+			t.Fatalf("size %d: plaintext mismatch", size)
+		}
+	}
+}
+
+func TestChunkWrongKey(t *testing.T) {
+	plain := testData(t, 100)
+	data := encryptChunks(t, testKey(t), plain, compressionNone)
+	if _, err := decryptAll(testKey(t), data, int64(len(plain))); !errors.Is(err, ErrCorrupted) {
+		t.Fatalf("err = %v, want ErrCorrupted", err)
+	}
+}
+
+func TestChunkTampering(t *testing.T) {
+	key := testKey(t)
+	size := 2*defaultChunkSize + 10
+	plain := testData(t, size)
+	sealed := defaultChunkSize + gcmTagSize
+
+	tests := []struct {
+		name   string
+		tamper func(data []byte) []byte
+	}{
+		{"flipped ciphertext bit", func(data []byte) []byte {
+			data[formatHeaderSize+sealed+100] ^= 0x01
+			return data
+		}},
+		{"flipped tag bit", func(data []byte) []byte {
+			data[len(data)-1] ^= 0x80
+			return data
+		}},
+		{"truncated final chunk", func(data []byte) []byte {
+			return data[:len(data)-1]
+		}},
+		{"final chunk removed", func(data []byte) []byte {
+			return data[:formatHeaderSize+2*sealed]
+		}},
+		{"only header left", func(data []byte) []byte {
+			return data[:formatHeaderSize+gcmTagSize]
+		}},
+		{"swapped chunks", func(data []byte) []byte {
+			first := formatHeaderSize
+			second := formatHeaderSize + sealed
+			swapped := append([]byte(nil), data...)
+			copy(swapped[first:second], data[second:second+sealed])
+			copy(swapped[second:second+sealed], data[first:second])
+			return swapped
+		}},
+		{"chunk repeated", func(data []byte) []byte {
+			copy(data[formatHeaderSize+sealed:], data[formatHeaderSize:formatHeaderSize+sealed])
+			return data
+		}},
+		{"nonce prefix changed", func(data []byte) []byte {
+			data[formatHeaderSize-1] ^= 0x01
+			return data
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := encryptChunks(t, key, plain, compressionNone)
+			data = tt.tamper(data)
+			if _, err := decryptAll(key, data, int64(size)); !errors.Is(err, ErrCorrupted) {
+				t.Fatalf("err = %v, want ErrCorrupted", err)
+			}
+		})
+	}
+}
+
+// 文件头作为附加认证数据，只修改不影响nonce的字段也必须被发现
+func TestChunkHeaderAuthenticated(t *testing.T) {
+	key := testKey(t)
+	plain := bytes.Repeat([]byte("filebox "), 1000)
+	data := encryptChunks(t, key, plain, compressionZstd)
+	if data[4] != formatVersion2 || data[6] != compressionZstd {
+		t.Fatalf("unexpected header % x", data[:formatHeaderSize2])
+	}
+
+	data[6] = compressionNone
+	if _, err := decryptAll(key, data, int64(len(plain))); !errors.Is(err, ErrCorrupted) {
+		t.Fatalf("err = %v, want ErrCorrupted", err)
+	}
+}
+
+func TestChunkEmptyFileTruncated(t *testing.T) {
+	key := testKey(t)
+	data := encryptChunks(t, key, nil, compressionNone)
+	if _, err := decryptAll(key, data[:formatHeaderSize], 0); !errors.Is(err, ErrCorrupted) {
+		t.Fatalf("err = %v, want ErrCorrupted", err)
+	}
+}
+
+func TestChunkUnsupportedHeader(t *testing.T) {
+	key := testKey(t)
+	data := encryptChunks(t, key, testData(t, 10), compressionNone)
+
+	version := append([]byte(nil), data...)
+	version[4] = 9
+	if _, err := decryptAll(key, version, 10); err == nil {
+		t.Error("unknown version accepted")
+	}
+
+	alg := append([]byte(nil), data...)
+	alg[5] = 9
+	if _, err := decryptAll(key, alg, 10); err == nil {
+		t.Error("unknown algorithm accepted")
+	}
+}
+
+// checkSeek 在r上按offsets依次Seek并读取n字节，与plain中的内容比较
+func checkSeek(t *testing.T, r io.ReadSeeker, plain []byte, offsets []int64, n int) {
+	t.Helper()
+	for _, offset := range offsets {
+		pos, err := r.Seek(offset, io.SeekStart)
+		if err != nil || pos != offset {
+			t.Fatalf("Seek(%d) = %d, %v", offset, pos, err)
+		}
+		buf := make([]byte, n)
+		got, err := io.ReadFull(r, buf)
+		want := plain[offset:min(offset+int64(n), int64(len(plain)))]
+		if err != nil && !(errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, io.EOF)) {
+			t.Fatalf("read at %d: %v", offset, err)
+		}
+		if !bytes.Equal(buf[:got], want) {
+			t.Fatalf("read at %d: content mismatch", offset)
+		}
+	}
+
+	end, err := r.Seek(-5, io.SeekEnd)
+	if err != nil || end != int64(len(plain))-5 {
+		t.Fatalf("Seek(-5, SeekEnd) = %d, %v", end, err)
+	}
+	rest, err := io.ReadAll(r)
+	if err != nil || !bytes.Equal(rest, plain[len(plain)-5:]) {
+		t.Fatalf("read after SeekEnd: %v", err)
+	}
+
+	if _, err := r.Seek(int64(len(plain))+10, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := r.Read(make([]byte, 1)); n != 0 || err != io.EOF {
+		t.Fatalf("read past end = %d, %v", n, err)
+	}
+	if _, err := r.Seek(-1, io.SeekStart); err == nil {
+		t.Fatal("negative offset accepted")
+	}
+}
+
+func TestChunkSeek(t *testing.T) {
+	key := testKey(t)
+	plain := testData(t, 3*defaultChunkSize+100)
+	r, err := newDecryptReader(bytes.NewReader(encryptChunks(t, key, plain, compressionNone)), key, int64(len(plain)), FormatChunked)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	chunk := int64(defaultChunkSize)
+	offsets := []int64{0, chunk - 3, chunk, 3*chunk + 50, 1, 2*chunk - 1, chunk + 1}
+	checkSeek(t, r, plain, offsets, 10)
+}
+
+// encryptLegacy 用旧版 IV + AES-CFB 格式加密plain
+func encryptLegacy(t *testing.T, key, plain []byte) []byte {
+	t.Helper()
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	iv := testData(t, legacyIVSize)
+	data := make([]byte, legacyIVSize+len(plain))
+	copy(data, iv)
+	cipher.NewCFBEncrypter(block, iv).XORKeyStream(data[legacyIVSize:], plain)
+	return data
+}
+
+func TestLegacyRead(t *testing.T) {
+	key := testKey(t)
+	plain := testData(t, 1000)
+	data := encryptLegacy(t, key, plain)
+
+	legacy, err := isLegacyFormat(bytes.NewReader(data))
+	if err != nil || !legacy {
+		t.Fatalf("isLegacyFormat = %v, %v", legacy, err)
+	}
+	// 尚未记录格式的历史文件按文件头识别
+	for _, format := range []int{FormatLegacy, FormatUnknown} {
+		got, err := decryptFormat(key, data, int64(len(plain)), format)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, plain) {
+			t.Fatalf("format %d: plaintext mismatch", format)
+		}
+	}
+
+	r, err := newDecryptReader(bytes.NewReader(data), key, int64(len(plain)), FormatLegacy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkSeek(t, r, plain, []int64{500, 15, 16, 17, 0, 999, 31}, 20)
+}
+
+func TestLegacyShortFile(t *testing.T) {
+	key := testKey(t)
+	got, err := decryptFormat(key, encryptLegacy(t, key, []byte("ab")), 2, FormatLegacy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "ab" {
+		t.Fatalf("got %q", got)
+	}
+
+	legacy, err := isLegacyFormat(bytes.NewReader(encryptChunks(t, key, nil, compressionNone)))
+	if err != nil || legacy {
+		t.Fatalf("new format detected as legacy: %v, %v", legacy, err)
+	}
+}
+
+// 记录为分块格式的文件被改写文件头后不能按旧版格式解密
+func TestChunkedHeaderOverwritten(t *testing.T) {
+	key := testKey(t)
+	plain := testData(t, 2*defaultChunkSize)
+	data := encryptChunks(t, key, plain, compressionNone)
+	copy(data, "XXXX")
+
+	if _, err := decryptAll(key, data, int64(len(plain))); !errors.Is(err, ErrCorrupted) {
+		t.Fatalf("err = %v, want ErrCorrupted", err)
+	}
+	// 旧版格式的文件始终按旧版格式读取，不会被识别为分块格式
+	legacy := encryptLegacy(t, key, plain)
+	copy(legacy, formatMagic)
+	if _, err := decryptFormat(key, legacy, int64(len(plain)), FormatLegacy); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// 存储按记录的格式读取，改写文件头不能让分块格式的文件被当作旧版格式
+func TestStorageUsesRecordedFormat(t *testing.T) {
+	dir := t.TempDir()
+	backend, err := NewLocalBackend(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys, err := NewKeyRing(hex.EncodeToString(testKey(t)), "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	storage := NewEncryptedStorage(backend, keys)
+
+	plain := testData(t, 1000)
+	result, err := storage.Save(bytes.NewReader(plain), FileMeta{Name: "a.bin", Size: int64(len(plain))})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ref := result.Ref()
+	if ref.Format != FormatChunked {
+		t.Fatalf("format = %d", ref.Format)
+	}
+
+	f, err := os.OpenFile(filepath.Join(dir, filepath.FromSlash(ref.Path)), os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteAt([]byte("XXXX"), 0); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	if _, err := storage.Get(ref); !errors.Is(err, ErrCorrupted) {
+		t.Fatalf("Get err = %v, want ErrCorrupted", err)
+	}
+	if legacy, err := storage.NeedsUpgrade(ref); err != nil || legacy {
+		t.Fatalf("NeedsUpgrade = %v, %v", legacy, err)
+	}
+	if format, err := storage.DetectFormat(ref); err != nil || format != FormatLegacy {
+		t.Fatalf("DetectFormat = %d, %v", format, err)
+	}
+}
@@ -0,0 +1,107 @@
+package filestore
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// KeyProvider 主密钥提供者，负责用主密钥包装和解包数据密钥。
+// 主密钥可以在本地内存中，也可以只保存在外部密钥服务中
+type KeyProvider interface {
+	// Wrap 包装数据密钥，keyID为主密钥ID，应与包装结果绑定
+	Wrap(keyID string, dataKey []byte) (string, error)
+	// Unwrap 解包由Wrap包装的数据密钥
+	Unwrap(keyID, wrapped string) ([]byte, error)
+}
+
+// LocalKey 保存在本地内存中的主密钥，用AES-GCM包装数据密钥。
+// 可来自 STORAGE_MASTER_KEYS、密钥文件或口令派生
+type LocalKey []byte
+
+// ParseLocalKey 解析64位十六进制字符串形式的主密钥
+func ParseLocalKey(value string) (LocalKey, error) {
+	key, err := hex.DecodeString(strings.TrimSpace(value))
+	if err != nil || len(key) != dataKeySize {
+		return nil, errors.New("必须是64位十六进制字符串")
+	}
+	return LocalKey(key), nil
+}
+
+// Wrap 用主密钥包装数据密钥，主密钥ID作为附加认证数据
+func (k LocalKey) Wrap(keyID string, dataKey []byte) (string, error) {
+	aead, err := newGCM(k)
+	if err != nil {
+		return "", err
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", fmt.Errorf("生成nonce失败: %w", err)
+	}
+
+	sealed := aead.Seal(nonce, nonce, dataKey, []byte(keyID))
+	return base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// Unwrap 解包数据密钥
+func (k LocalKey) Unwrap(keyID, wrapped string) ([]byte, error) {
+	sealed, err := base64.StdEncoding.DecodeString(wrapped)
+	if err != nil {
+		return nil, fmt.Errorf("无效的数据密钥: %w", err)
+	}
+
+	aead, err := newGCM(k)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < aead.NonceSize() {
+		return nil, errors.New("无效的数据密钥")
+	}
+
+	nonce, ciphertext := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+	dataKey, err := aead.Open(nil, nonce, ciphertext, []byte(keyID))
+	if err != nil {
+		return nil, errors.New("解包数据密钥失败")
+	}
+	return dataKey, nil
+}
+
+// ReadSecretFile 读取密钥、口令或令牌文件，去掉首尾空白。
+// 文件不能允许所有者以外的用户访问，避免密钥被同一主机上的其他用户读取
+func ReadSecretFile(path string) (string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", fmt.Errorf("读取密钥文件失败: %w", err)
+	}
+	if perm := info.Mode().Perm(); perm&0o077 != 0 {
+		return "", fmt.Errorf("密钥文件 %s 的权限为 %04o，只能允许所有者访问（chmod 600）", path, perm)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("读取密钥文件失败: %w", err)
+	}
+	secret := strings.TrimSpace(string(data))
+	if secret == "" {
+		return "", fmt.Errorf("密钥文件 %s 为空", path)
+	}
+	return secret, nil
+}
+
+// LoadKeyFile 从密钥文件加载主密钥，文件内容为64位十六进制字符串
+func LoadKeyFile(path string) (LocalKey, error) {
+	value, err := ReadSecretFile(path)
+	if err != nil {
+		return nil, err
+	}
+	key, err := ParseLocalKey(value)
+	if err != nil {
+		return nil, fmt.Errorf("无效的密钥文件 %s: %w", path, err)
+	}
+	return key, nil
+}
@@ -0,0 +1,161 @@
+package filestore
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// LegacyKeyID STORAGE_ENC_KEY对应的主密钥ID。旧版本直接用该密钥加密文件内容，
+// 这些文件没有数据密钥，读取时直接使用该主密钥。
+const LegacyKeyID = "default"
+
+// dataKeySize 数据密钥长度（AES-256）
+const dataKeySize = 32
+
+var keyIDPattern = regexp.MustCompile(`^[a-zA-Z0-9_-]{1,64}$`)
+
+// KeyRing 主密钥集合。每个文件使用独立的随机数据密钥加密，数据密钥再由主密钥包装后保存在数据库中，
+// 轮换主密钥时只需重新包装数据密钥，不需要重写文件内容。
+type KeyRing struct {
+	keys      map[string]KeyProvider
+	primaryID string
+}
+
+// ExternalKey 由密钥提供者加载的主密钥，例如密钥文件、Vault或口令派生的密钥
+type ExternalKey struct {
+	ID       string
+	Provider KeyProvider
+}
+
+// NewKeyRing 根据配置创建主密钥集合。
+// encKey 为旧版 STORAGE_ENC_KEY（十六进制），作为ID为default的主密钥；
+// masterKeys 为 STORAGE_MASTER_KEYS，格式为 "id1:十六进制密钥,id2:十六进制密钥"；
+// primaryID 为新文件使用的主密钥ID，为空时使用最后加入的密钥（external在masterKeys之后加入）。
+// 没有配置任何密钥时返回错误，避免使用重启后即丢失的临时密钥。
+func NewKeyRing(encKey, masterKeys, primaryID string, external ...ExternalKey) (*KeyRing, error) {
+	ring := &KeyRing{keys: make(map[string]KeyProvider)}
+
+	if encKey != "" {
+		key, err := hex.DecodeString(encKey)
+		if err != nil || len(key) != dataKeySize {
+			return nil, errors.New("无效的加密密钥: STORAGE_ENC_KEY 必须是64位十六进制字符串")
+		}
+		ring.keys[LegacyKeyID] = LocalKey(key)
+		ring.primaryID = LegacyKeyID
+	}
+
+	for _, item := range strings.Split(masterKeys, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		id, value, ok := strings.Cut(item, ":")
+		if !ok {
+			return nil, fmt.Errorf("无效的主密钥配置: %s", id)
+		}
+		key, err := ParseLocalKey(value)
+		if err != nil {
+			return nil, fmt.Errorf("无效的主密钥 %s: %w", id, err)
+		}
+		if err := ring.add(id, key); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, key := range external {
+		if err := ring.add(key.ID, key.Provider); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(ring.keys) == 0 {
+		return nil, errors.New("未配置加密密钥，请设置 STORAGE_KEY_PROVIDERS、STORAGE_MASTER_KEYS 或 STORAGE_ENC_KEY")
+	}
+
+	if primaryID != "" {
+		if _, ok := ring.keys[primaryID]; !ok {
+			return nil, fmt.Errorf("主密钥 %s 不存在", primaryID)
+		}
+		ring.primaryID = primaryID
+	}
+
+	return ring, nil
+}
+
+// add 加入主密钥并设为新文件使用的主密钥
+func (k *KeyRing) add(id string, provider KeyProvider) error {
+	if !keyIDPattern.MatchString(id) {
+		return fmt.Errorf("无效的主密钥配置: %s", id)
+	}
+	if _, exists := k.keys[id]; exists {
+		return fmt.Errorf("主密钥ID重复: %s", id)
+	}
+	k.keys[id] = provider
+	k.primaryID = id
+	return nil
+}
+
+// PrimaryID 返回新文件使用的主密钥ID
+func (k *KeyRing) PrimaryID() string {
+	return k.primaryID
+}
+
+// HasKey 判断主密钥是否存在
+func (k *KeyRing) HasKey(keyID string) bool {
+	_, ok := k.keys[keyID]
+	return ok
+}
+
+// NewDataKey 生成新的数据密钥，返回明文密钥和由当前主密钥包装后的密钥
+func (k *KeyRing) NewDataKey() ([]byte, string, string, error) {
+	dataKey := make([]byte, dataKeySize)
+	if _, err := rand.Read(dataKey); err != nil {
+		return nil, "", "", fmt.Errorf("生成数据密钥失败: %w", err)
+	}
+
+	wrapped, err := k.keys[k.primaryID].Wrap(k.primaryID, dataKey)
+	if err != nil {
+		return nil, "", "", err
+	}
+	return dataKey, k.primaryID, wrapped, nil
+}
+
+// DataKey 解包数据密钥。wrapped为空表示旧版文件，直接使用主密钥加密内容。
+func (k *KeyRing) DataKey(keyID, wrapped string) ([]byte, error) {
+	if keyID == "" {
+		keyID = LegacyKeyID
+	}
+	provider, ok := k.keys[keyID]
+	if !ok {
+		return nil, fmt.Errorf("主密钥 %s 不存在，可能已被移除", keyID)
+	}
+
+	if wrapped == "" {
+		master, ok := provider.(LocalKey)
+		if !ok {
+			return nil, fmt.Errorf("主密钥 %s 不能直接用于解密文件内容", keyID)
+		}
+		return master, nil
+	}
+
+	return provider.Unwrap(keyID, wrapped)
+}
+
+// Rewrap 用当前主密钥重新包装数据密钥，返回新的主密钥ID和包装后的密钥。
+// 旧版文件没有数据密钥，此时把旧主密钥本身作为数据密钥包装，之后即可移除旧主密钥。
+func (k *KeyRing) Rewrap(keyID, wrapped string) (string, string, error) {
+	dataKey, err := k.DataKey(keyID, wrapped)
+	if err != nil {
+		return "", "", err
+	}
+
+	newWrapped, err := k.keys[k.primaryID].Wrap(k.primaryID, dataKey)
+	if err != nil {
+		return "", "", err
+	}
+	return k.primaryID, newWrapped, nil
+}
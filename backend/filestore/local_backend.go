@@ -0,0 +1,119 @@
+package filestore
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// LocalBackend 本地磁盘存储后端
+type LocalBackend struct {
+	BasePath string
+	// MustExist 为true时存储目录必须已经存在，写入时不会自动创建。用于单独挂载的磁盘，
+	// 磁盘未挂载时写入失败，而不是把文件写到根文件系统上的空目录中
+	MustExist bool
+}
+
+// NewLocalBackend 创建本地磁盘存储后端
+func NewLocalBackend(basePath string) (*LocalBackend, error) {
+	// 确保存储目录存在
+	if err := os.MkdirAll(basePath, 0755); err != nil {
+		return nil, fmt.Errorf("创建存储目录失败: %w", err)
+	}
+
+	return &LocalBackend{BasePath: basePath}, nil
+}
+
+// Put 写入对象
+func (b *LocalBackend) Put(path string, r io.Reader, size int64) error {
+	if b.MustExist {
+		info, err := os.Stat(b.BasePath)
+		if err != nil {
+			return fmt.Errorf("存储目录不可用: %w", err)
+		}
+		if !info.IsDir() {
+			return fmt.Errorf("存储目录不是目录: %s", b.BasePath)
+		}
+	}
+
+	filePath := filepath.Join(b.BasePath, filepath.FromSlash(path))
+	if err := os.MkdirAll(filepath.Dir(filePath), 0755); err != nil {
+		return fmt.Errorf("创建存储目录失败: %w", err)
+	}
+
+	// 先写入临时文件，完成后再重命名，避免留下写了一半的文件
+	tmpPath := filePath + ".tmp"
+	dst, err := os.Create(tmpPath)
+	if err != nil {
+		return fmt.Errorf("创建目标文件失败: %w", err)
+	}
+
+	if _, err := io.Copy(dst, r); err != nil {
+		dst.Close()
+		os.Remove(tmpPath)
+		return fmt.Errorf("写入文件失败: %w", err)
+	}
+
+	if err := dst.Close(); err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("写入文件失败: %w", err)
+	}
+
+	if err := os.Rename(tmpPath, filePath); err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("保存文件失败: %w", err)
+	}
+
+	return nil
+}
+
+// Open 打开对象
+func (b *LocalBackend) Open(path string) (io.ReadSeekCloser, error) {
+	file, err := os.Open(filepath.Join(b.BasePath, filepath.FromSlash(path)))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("%w: %s", ErrNotFound, path)
+		}
+		return nil, fmt.Errorf("打开文件失败: %w", err)
+	}
+	return file, nil
+}
+
+// Delete 删除对象
+func (b *LocalBackend) Delete(path string) error {
+	if err := os.Remove(filepath.Join(b.BasePath, filepath.FromSlash(path))); err != nil {
+		return fmt.Errorf("删除文件失败: %w", err)
+	}
+	return nil
+}
+
+// List 遍历存储目录中的所有文件
+func (b *LocalBackend) List(fn func(ObjectInfo) error) error {
+	return filepath.WalkDir(b.BasePath, func(filePath string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		if filePath == b.BasePath {
+			return fmt.Errorf("存储目录不是目录: %s", b.BasePath)
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(b.BasePath, filePath)
+		if err != nil {
+			return err
+		}
+		return fn(ObjectInfo{
+			Path:    filepath.ToSlash(rel),
+			Size:    info.Size(),
+			ModTime: info.ModTime(),
+		})
+	})
+}
@@ -0,0 +1,563 @@
+package filestore
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// 副本状态
+const (
+	ReplicaStatusOK        = "ok"        // 副本完整
+	ReplicaStatusMissing   = "missing"   // 副本写入失败或已丢失，等待修复
+	ReplicaStatusDeleting  = "deleting"  // 删除时副本不可用，等待修复时删除
+	ReplicaStatusCorrupted = "corrupted" // 读取时内容校验失败，等待修复时用其他副本覆盖
+)
+
+// Replica 镜像存储中的一个副本
+type Replica struct {
+	Name    string // 副本名称，用于记录副本状态，应保持稳定
+	Backend Backend
+}
+
+// replicaState 对象在某个副本上的状态
+type replicaState struct {
+	Path      string `gorm:"primaryKey;size:512"`
+	Replica   string `gorm:"primaryKey;size:255"`
+	Status    string `gorm:"size:16;index"`
+	Error     string `gorm:"size:255"`
+	UpdatedAt time.Time
+}
+
+func (replicaState) TableName() string { return "storage_replicas" }
+
+// MirrorBackend 镜像存储后端，每个对象同时写入所有副本，任意一个副本可用即可读取。
+// 写入失败或读取时发现丢失的副本记录在数据库中，由Repair重新复制
+type MirrorBackend struct {
+	Replicas     []Replica
+	DB           *gorm.DB
+	WriteTimeout time.Duration // 副本多长时间不接收数据视为停滞，为0时使用默认的30秒
+}
+
+// RepairOptions 副本修复选项
+type RepairOptions struct {
+	DryRun bool
+}
+
+// RepairReport 副本修复结果
+type RepairReport struct {
+	Objects     int      `json:"objects"`
+	Copied      int      `json:"copied"`
+	Deleted     int      `json:"deleted"`
+	Failed      int      `json:"failed"`
+	Lost        int      `json:"lost"`
+	Unavailable []string `json:"unavailable"`
+}
+
+// NewMirrorBackend 创建镜像存储后端
+func NewMirrorBackend(db *gorm.DB, replicas []Replica) (*MirrorBackend, error) {
+	if len(replicas) < 2 {
+		return nil, errors.New("镜像存储至少需要两个副本")
+	}
+	names := make(map[string]bool, len(replicas))
+	for _, replica := range replicas {
+		if names[replica.Name] {
+			return nil, fmt.Errorf("副本名称重复: %s", replica.Name)
+		}
+		names[replica.Name] = true
+	}
+
+	if err := db.AutoMigrate(&replicaState{}); err != nil {
+		return nil, fmt.Errorf("创建副本状态表失败: %w", err)
+	}
+
+	return &MirrorBackend{Replicas: replicas, DB: db}, nil
+}
+
+// defaultMirrorWriteTimeout 副本多长时间不接收数据视为停滞
+const defaultMirrorWriteTimeout = 30 * time.Second
+
+// mirrorBufferChunks 每个副本最多缓冲的数据块数，较慢的副本可以暂时落后而不拖慢其他副本
+const mirrorBufferChunks = 16
+
+// errReplicaStalled 副本长时间不接收数据，停止写入该副本
+var errReplicaStalled = errors.New("副本写入停滞，已停止写入")
+
+// replicaWriter 向一个副本写入数据，数据块经过缓冲通道交给单独的协程写入副本
+type replicaWriter struct {
+	chunks   chan []byte
+	pw       *io.PipeWriter
+	closeErr error // 关闭chunks前设置，写入完成后以此关闭管道
+	done     chan error
+	stalled  bool
+}
+
+// Put 并发写入所有副本，至少一个副本写入成功即视为成功，失败的副本等待修复。
+// 副本超过WriteTimeout不接收数据或不能完成写入时不再等待，记为缺失，不会阻塞上传
+func (b *MirrorBackend) Put(path string, r io.Reader, size int64) error {
+	timeout := b.WriteTimeout
+	if timeout <= 0 {
+		timeout = defaultMirrorWriteTimeout
+	}
+
+	writers := make([]*replicaWriter, len(b.Replicas))
+	for i, replica := range b.Replicas {
+		pr, pw := io.Pipe()
+		w := &replicaWriter{
+			chunks: make(chan []byte, mirrorBufferChunks),
+			pw:     pw,
+			done:   make(chan error, 1),
+		}
+		writers[i] = w
+		go func(backend Backend) {
+			err := backend.Put(path, pr, size)
+			// 后端返回后让写入方立即失败，而不是阻塞在管道上
+			pr.CloseWithError(err)
+			w.done <- err
+		}(replica.Backend)
+		go func() {
+			var err error
+			for chunk := range w.chunks {
+				// 写入失败后继续取出数据块，发送方不会因此阻塞
+				if err == nil {
+					_, err = pw.Write(chunk)
+				}
+			}
+			pw.CloseWithError(w.closeErr)
+		}()
+	}
+
+	var readErr error
+	for {
+		// 数据块由各副本共享，每次读取使用新的缓冲区
+		buf := make([]byte, 256*1024)
+		n, err := r.Read(buf)
+		if n > 0 {
+			for _, w := range writers {
+				if !w.stalled && !w.send(buf[:n], timeout) {
+					w.stalled = true
+					// 中断后端的读取，后端返回时以该错误失败
+					w.pw.CloseWithError(errReplicaStalled)
+				}
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			readErr = err
+			break
+		}
+	}
+
+	for _, w := range writers {
+		w.closeErr = readErr
+		close(w.chunks)
+	}
+
+	// 各副本同时完成写入，共用一个等待期限
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	errs := make([]error, len(writers))
+	for i, w := range writers {
+		if w.stalled {
+			errs[i] = errReplicaStalled
+			continue
+		}
+		select {
+		case errs[i] = <-w.done:
+		case <-deadline.C:
+			errs[i] = errReplicaStalled
+			// 期限已过，其余未完成的副本不再等待
+			deadline.Reset(0)
+		}
+	}
+	if readErr != nil {
+		for i, replica := range b.Replicas {
+			if errs[i] == nil {
+				_ = replica.Backend.Delete(path)
+			}
+		}
+		return fmt.Errorf("读取文件失败: %w", readErr)
+	}
+
+	var firstErr error
+	written := 0
+	for i, replica := range b.Replicas {
+		if errs[i] != nil {
+			log.Printf("写入副本失败 %s %s: %v", replica.Name, path, errs[i])
+			if firstErr == nil {
+				firstErr = errs[i]
+			}
+			continue
+		}
+		written++
+	}
+	if written == 0 {
+		return firstErr
+	}
+
+	for i, replica := range b.Replicas {
+		b.setState(path, replica.Name, errs[i])
+	}
+	return nil
+}
+
+// send 把数据块交给副本，副本的缓冲区在timeout内一直是满的时返回false
+func (w *replicaWriter) send(chunk []byte, timeout time.Duration) bool {
+	select {
+	case w.chunks <- chunk:
+		return true
+	default:
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case w.chunks <- chunk:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
+
+// Open 依次尝试各个副本，返回第一个可用的副本。读取时发现内容校验失败，
+// 可以通过返回的读取器的Failover改用下一个副本
+func (b *MirrorBackend) Open(path string) (io.ReadSeekCloser, error) {
+	reader := &mirrorReader{backend: b, path: path, states: b.states(path)}
+	if err := reader.open(); err != nil {
+		return nil, err
+	}
+	return reader, nil
+}
+
+// mirrorReader 从镜像存储的某个副本读取对象
+type mirrorReader struct {
+	io.ReadSeekCloser
+	backend *MirrorBackend
+	path    string
+	states  map[string]string
+	next    int // 下一个要尝试的副本
+	current int // 当前读取的副本
+}
+
+// open 从下一个副本开始依次尝试，打开第一个可用的副本
+func (r *mirrorReader) open() error {
+	b := r.backend
+	var lastErr error
+	for ; r.next < len(b.Replicas); r.next++ {
+		replica := b.Replicas[r.next]
+		if status, ok := r.states[replica.Name]; ok && status != ReplicaStatusOK {
+			continue
+		}
+
+		file, err := replica.Backend.Open(r.path)
+		if err == nil {
+			r.ReadSeekCloser = file
+			r.current = r.next
+			r.next++
+			return nil
+		}
+		if errors.Is(err, ErrNotFound) {
+			// 有状态记录的对象才标记为丢失，由修复任务从其他副本补齐
+			if _, ok := r.states[replica.Name]; ok {
+				b.setState(r.path, replica.Name, err)
+			}
+		} else {
+			log.Printf("读取副本失败 %s %s: %v", replica.Name, r.path, err)
+		}
+		if lastErr == nil || !errors.Is(err, ErrNotFound) {
+			lastErr = err
+		}
+	}
+	if lastErr == nil {
+		lastErr = fmt.Errorf("%w: %s", ErrNotFound, r.path)
+	}
+	return lastErr
+}
+
+// Failover 将当前副本标记为已损坏并改用下一个可用的副本，读取位置需要调用方重新Seek。
+// 没有其他可用副本时返回ErrCorrupted
+func (r *mirrorReader) Failover() error {
+	replica := r.backend.Replicas[r.current]
+	log.Printf("副本内容校验失败 %s %s，改用其他副本", replica.Name, r.path)
+	if err := r.backend.saveState(r.path, replica.Name, ReplicaStatusCorrupted, ErrCorrupted.Error()); err != nil {
+		log.Printf("记录副本状态失败 %s %s: %v", replica.Name, r.path, err)
+	}
+	r.ReadSeekCloser.Close()
+
+	if err := r.open(); err != nil {
+		// 保持可以关闭的状态
+		r.ReadSeekCloser = closedReader{}
+		return ErrCorrupted
+	}
+	return nil
+}
+
+// closedReader 所有副本都不可用后的占位读取器
+type closedReader struct{}
+
+func (closedReader) Read([]byte) (int, error)       { return 0, ErrCorrupted }
+func (closedReader) Seek(int64, int) (int64, error) { return 0, ErrCorrupted }
+func (closedReader) Close() error                   { return nil }
+
+// Delete 从所有副本删除对象，不可用的副本记录下来，由修复任务稍后删除
+func (b *MirrorBackend) Delete(path string) error {
+	pending := false
+	for _, replica := range b.Replicas {
+		if err := replica.Backend.Delete(path); err != nil && !isNotExist(err) {
+			log.Printf("删除副本失败 %s %s: %v", replica.Name, path, err)
+			if err := b.saveState(path, replica.Name, ReplicaStatusDeleting, err.Error()); err != nil {
+				return fmt.Errorf("删除文件失败: %w", err)
+			}
+			pending = true
+		}
+	}
+	if pending {
+		return b.DB.Where("path = ? AND status <> ?", path, ReplicaStatusDeleting).Delete(&replicaState{}).Error
+	}
+	return b.DB.Where("path = ?", path).Delete(&replicaState{}).Error
+}
+
+// List 遍历所有副本中的对象，任一副本不可用时返回错误，避免把只存在于该副本的对象误判为丢失
+func (b *MirrorBackend) List(fn func(ObjectInfo) error) error {
+	seen := make(map[string]bool)
+	for _, replica := range b.Replicas {
+		err := replica.Backend.List(func(obj ObjectInfo) error {
+			if seen[obj.Path] {
+				return nil
+			}
+			seen[obj.Path] = true
+			return fn(obj)
+		})
+		if err != nil {
+			return fmt.Errorf("列出副本%s失败: %w", replica.Name, err)
+		}
+	}
+	return nil
+}
+
+// Repair 补齐缺失的副本并完成未完成的删除。无法列出对象的副本视为不可用，本次跳过
+func (b *MirrorBackend) Repair(opts RepairOptions) (*RepairReport, error) {
+	report := &RepairReport{}
+
+	listings := make([]map[string]ObjectInfo, len(b.Replicas))
+	for i, replica := range b.Replicas {
+		objects := make(map[string]ObjectInfo)
+		if err := replica.Backend.List(func(obj ObjectInfo) error {
+			objects[obj.Path] = obj
+			return nil
+		}); err != nil {
+			log.Printf("副本不可用 %s: %v", replica.Name, err)
+			report.Unavailable = append(report.Unavailable, replica.Name)
+			continue
+		}
+		listings[i] = objects
+	}
+	if len(report.Unavailable) == len(b.Replicas) {
+		return report, errors.New("所有副本均不可用")
+	}
+	var available []string
+	for i, replica := range b.Replicas {
+		if listings[i] != nil {
+			available = append(available, replica.Name)
+		}
+	}
+
+	// 先完成未完成的删除，这些对象不能再被复制回来
+	var pending []replicaState
+	if err := b.DB.Where("status = ?", ReplicaStatusDeleting).Find(&pending).Error; err != nil {
+		return report, err
+	}
+	deleting := make(map[string]bool)
+	for _, state := range pending {
+		deleting[state.Path] = true
+		i := b.replicaIndex(state.Replica)
+		if i < 0 {
+			// 副本已从配置中移除
+			if !opts.DryRun {
+				b.DB.Delete(&state)
+			}
+			continue
+		}
+		if listings[i] == nil {
+			continue
+		}
+		if opts.DryRun {
+			report.Deleted++
+			continue
+		}
+		if err := b.Replicas[i].Backend.Delete(state.Path); err != nil && !isNotExist(err) {
+			log.Printf("删除副本失败 %s %s: %v", state.Replica, state.Path, err)
+			report.Failed++
+			continue
+		}
+		if err := b.DB.Delete(&state).Error; err != nil {
+			return report, err
+		}
+		report.Deleted++
+	}
+
+	// 只补齐有状态记录的对象。没有记录的对象可能是副本不可用期间已被删除的文件，
+	// 不能复制回来，由存储核对作为孤立对象处理
+	var paths []string
+	if err := b.DB.Model(&replicaState{}).Where("status <> ?", ReplicaStatusDeleting).Distinct("path").Pluck("path", &paths).Error; err != nil {
+		return report, err
+	}
+	var missingPaths []string
+	if err := b.DB.Model(&replicaState{}).Where("status = ?", ReplicaStatusMissing).Distinct("path").Pluck("path", &missingPaths).Error; err != nil {
+		return report, err
+	}
+	missing := make(map[string]bool, len(missingPaths))
+	for _, p := range missingPaths {
+		missing[p] = true
+	}
+	// 内容已损坏的副本虽然存在，也需要用其他副本覆盖，且不能作为复制的来源
+	var corruptedStates []replicaState
+	if err := b.DB.Where("status = ?", ReplicaStatusCorrupted).Find(&corruptedStates).Error; err != nil {
+		return report, err
+	}
+	corrupted := make(map[[2]string]bool, len(corruptedStates))
+	for _, state := range corruptedStates {
+		corrupted[[2]string{state.Path, state.Replica}] = true
+	}
+
+	for _, p := range paths {
+		if deleting[p] {
+			continue
+		}
+		report.Objects++
+
+		source := -1
+		var targets []int
+		for i, objects := range listings {
+			if objects == nil {
+				continue
+			}
+			if _, ok := objects[p]; ok && !corrupted[[2]string{p, b.Replicas[i].Name}] {
+				if source < 0 {
+					source = i
+				}
+			} else {
+				targets = append(targets, i)
+			}
+		}
+		if source < 0 {
+			// 所有可用副本中都不存在或都已损坏，可能只存在于不可用的副本中
+			if len(report.Unavailable) == 0 {
+				log.Printf("对象在所有副本中都已丢失或损坏: %s", p)
+				report.Lost++
+			}
+			continue
+		}
+		if len(targets) == 0 {
+			if missing[p] && !opts.DryRun {
+				b.markOK(p, available)
+			}
+			continue
+		}
+
+		for _, i := range targets {
+			if opts.DryRun {
+				log.Printf("缺失副本: %s %s", b.Replicas[i].Name, p)
+				report.Copied++
+				continue
+			}
+			if err := b.copyObject(p, b.Replicas[source], b.Replicas[i]); err != nil {
+				log.Printf("复制副本失败 %s -> %s %s: %v", b.Replicas[source].Name, b.Replicas[i].Name, p, err)
+				b.setState(p, b.Replicas[i].Name, err)
+				report.Failed++
+				continue
+			}
+			b.setState(p, b.Replicas[i].Name, nil)
+			report.Copied++
+		}
+	}
+
+	return report, nil
+}
+
+// copyObject 将对象从一个副本原样复制到另一个副本
+func (b *MirrorBackend) copyObject(p string, from, to Replica) error {
+	src, err := from.Backend.Open(p)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	size, err := src.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	if _, err := src.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	return to.Backend.Put(p, src, size)
+}
+
+// replicaIndex 返回副本在配置中的位置，不存在时返回-1
+func (b *MirrorBackend) replicaIndex(name string) int {
+	for i, replica := range b.Replicas {
+		if replica.Name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// states 读取对象在各副本上的状态
+func (b *MirrorBackend) states(path string) map[string]string {
+	var rows []replicaState
+	if err := b.DB.Where("path = ?", path).Find(&rows).Error; err != nil {
+		log.Printf("读取副本状态失败 %s: %v", path, err)
+	}
+	states := make(map[string]string, len(rows))
+	for _, row := range rows {
+		states[row.Replica] = row.Status
+	}
+	return states
+}
+
+// setState 根据写入结果记录副本状态，记录失败只影响修复的及时性，不影响读写
+func (b *MirrorBackend) setState(path, replica string, err error) {
+	status, detail := ReplicaStatusOK, ""
+	if err != nil {
+		status, detail = ReplicaStatusMissing, err.Error()
+	}
+	if err := b.saveState(path, replica, status, detail); err != nil {
+		log.Printf("记录副本状态失败 %s %s: %v", replica, path, err)
+	}
+}
+
+// saveState 保存副本状态
+func (b *MirrorBackend) saveState(path, replica, status, detail string) error {
+	if len(detail) > 255 {
+		detail = detail[:255]
+	}
+	return b.DB.Clauses(clause.OnConflict{UpdateAll: true}).Create(&replicaState{
+		Path:    path,
+		Replica: replica,
+		Status:  status,
+		Error:   detail,
+	}).Error
+}
+
+// markOK 将对象在指定副本上的状态标记为完整
+func (b *MirrorBackend) markOK(path string, replicas []string) {
+	if err := b.DB.Model(&replicaState{}).Where("path = ? AND replica IN ?", path, replicas).Updates(map[string]interface{}{
+		"status": ReplicaStatusOK,
+		"error":  "",
+	}).Error; err != nil {
+		log.Printf("记录副本状态失败 %s: %v", path, err)
+	}
+}
+
+// isNotExist 判断删除失败是否因为对象本来就不存在
+func isNotExist(err error) bool {
+	return errors.Is(err, ErrNotFound) || errors.Is(err, fs.ErrNotExist)
+}
@@ -0,0 +1,225 @@
+package filestore
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// newTestMirror 创建两个本地目录副本组成的镜像加密存储
+func newTestMirror(t *testing.T) (*EncryptedStorage, *MirrorBackend, []string) {
+	t.Helper()
+	db, err := gorm.Open(sqlite.Open(filepath.Join(t.TempDir(), "test.db")), &gorm.Config{Logger: logger.Discard})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dirs := []string{t.TempDir(), t.TempDir()}
+	var replicas []Replica
+	for _, dir := range dirs {
+		replicas = append(replicas, Replica{Name: dir, Backend: &LocalBackend{BasePath: dir, MustExist: true}})
+	}
+	mirror, err := NewMirrorBackend(db, replicas)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys, err := NewKeyRing(hex.EncodeToString(testKey(t)), "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewEncryptedStorage(mirror, keys), mirror, dirs
+}
+
+// replicaStatus 返回对象在副本上记录的状态
+func replicaStatus(t *testing.T, mirror *MirrorBackend, path, replica string) string {
+	t.Helper()
+	return mirror.states(path)[replica]
+}
+
+func TestMirrorFailoverOnCorruption(t *testing.T) {
+	storage, mirror, dirs := newTestMirror(t)
+	plain := testData(t, 3*defaultChunkSize+5)
+	result, err := storage.Save(bytes.NewReader(plain), FileMeta{Name: "data.bin", Size: int64(len(plain))})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 损坏第一个副本中间的一块
+	first := filepath.Join(dirs[0], filepath.FromSlash(result.Path))
+	raw, err := os.ReadFile(first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw[formatHeaderSize+defaultChunkSize+gcmTagSize+7] ^= 0x01
+	if err := os.WriteFile(first, raw, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := storage.Get(result.Ref())
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := io.ReadAll(r)
+	r.Close()
+	if err != nil {
+		t.Fatalf("read with one corrupted replica: %v", err)
+	}
+	if !bytes.Equal(got, plain) {
+		t.Fatal("plaintext mismatch")
+	}
+	if status := replicaStatus(t, mirror, result.Path, dirs[0]); status != ReplicaStatusCorrupted {
+		t.Fatalf("corrupted replica status = %q", status)
+	}
+
+	// 修复后损坏的副本被完整的副本覆盖
+	report, err := mirror.Repair(RepairOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Copied != 1 {
+		t.Fatalf("repair copied %d objects", report.Copied)
+	}
+	repaired, err := os.ReadFile(first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	original, err := os.ReadFile(filepath.Join(dirs[1], filepath.FromSlash(result.Path)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(repaired, original) {
+		t.Fatal("corrupted replica not repaired")
+	}
+	if status := replicaStatus(t, mirror, result.Path, dirs[0]); status != ReplicaStatusOK {
+		t.Fatalf("repaired replica status = %q", status)
+	}
+}
+
+func TestMirrorAllReplicasCorrupted(t *testing.T) {
+	storage, _, dirs := newTestMirror(t)
+	plain := testData(t, 1000)
+	result, err := storage.Save(bytes.NewReader(plain), FileMeta{Name: "data.bin", Size: int64(len(plain))})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, dir := range dirs {
+		path := filepath.Join(dir, filepath.FromSlash(result.Path))
+		raw, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		raw[len(raw)-1] ^= 0x01
+		if err := os.WriteFile(path, raw, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	r, err := storage.Get(result.Ref())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	if _, err := io.ReadAll(r); err != ErrCorrupted {
+		t.Fatalf("err = %v, want ErrCorrupted", err)
+	}
+}
+
+// 副本目录不存在（磁盘未挂载）时不会被自动创建，写入记录为缺失
+func TestMirrorMissingReplicaRoot(t *testing.T) {
+	storage, mirror, dirs := newTestMirror(t)
+	unmounted := filepath.Join(dirs[1], "disk")
+	mirror.Replicas[1] = Replica{Name: dirs[1], Backend: &LocalBackend{BasePath: unmounted, MustExist: true}}
+
+	result, err := storage.Save(bytes.NewReader([]byte("hello")), FileMeta{Name: "a.txt", Size: 5})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(unmounted); !os.IsNotExist(err) {
+		t.Fatalf("replica root created: %v", err)
+	}
+	if status := replicaStatus(t, mirror, result.Path, dirs[1]); status != ReplicaStatusMissing {
+		t.Fatalf("replica status = %q, want missing", status)
+	}
+
+	// 磁盘恢复后由修复任务补齐
+	if err := os.Mkdir(unmounted, 0755); err != nil {
+		t.Fatal(err)
+	}
+	report, err := mirror.Repair(RepairOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Copied != 1 {
+		t.Fatalf("repair copied %d objects", report.Copied)
+	}
+	if _, err := os.Stat(filepath.Join(unmounted, filepath.FromSlash(result.Path))); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// stallBackend 模拟停滞的副本：读取readLimit字节后不再读取也不返回，直到release关闭
+type stallBackend struct {
+	*LocalBackend
+	readLimit int64
+	release   chan struct{}
+}
+
+func (b *stallBackend) Put(path string, r io.Reader, size int64) error {
+	if _, err := io.CopyN(io.Discard, r, b.readLimit); err != nil {
+		return err
+	}
+	<-b.release
+	return errors.New("released")
+}
+
+// 副本停滞时不阻塞写入，停滞的副本记为缺失
+func TestMirrorStalledReplica(t *testing.T) {
+	tests := []struct {
+		name      string
+		readLimit int64
+	}{
+		{"stalls while reading", 1024},
+		{"stalls before finishing", 1 << 30},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, mirror, dirs := newTestMirror(t)
+			stalled := &stallBackend{LocalBackend: &LocalBackend{BasePath: dirs[1]}, readLimit: tt.readLimit, release: make(chan struct{})}
+			defer close(stalled.release)
+			mirror.Replicas[1] = Replica{Name: dirs[1], Backend: stalled}
+			mirror.WriteTimeout = 200 * time.Millisecond
+
+			plain := testData(t, 8<<20)
+			if tt.readLimit > int64(len(plain)) {
+				stalled.readLimit = int64(len(plain)) + 1
+			}
+			start := time.Now()
+			if err := mirror.Put("a/b", bytes.NewReader(plain), int64(len(plain))); err != nil {
+				t.Fatal(err)
+			}
+			if elapsed := time.Since(start); elapsed > 5*time.Second {
+				t.Fatalf("Put took %v", elapsed)
+			}
+
+			got, err := os.ReadFile(filepath.Join(dirs[0], "a", "b"))
+			if err != nil || !bytes.Equal(got, plain) {
+				t.Fatalf("healthy replica: %v", err)
+			}
+			if status := replicaStatus(t, mirror, "a/b", dirs[0]); status != ReplicaStatusOK {
+				t.Fatalf("healthy replica status = %q", status)
+			}
+			if status := replicaStatus(t, mirror, "a/b", dirs[1]); status != ReplicaStatusMissing {
+				t.Fatalf("stalled replica status = %q, want missing", status)
+			}
+		})
+	}
+}
@@ -0,0 +1,88 @@
+package filestore
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"time"
+	"unicode/utf8"
+
+	"golang.org/x/crypto/argon2"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// minPassphraseLength 派生主密钥的口令的最小长度（字符数）
+const minPassphraseLength = 12
+
+// passphraseKey 口令派生主密钥的参数。盐值和校验值保存在数据库中，
+// 重启时输入错误的口令会被拒绝，而不是用错误的密钥加密新文件
+type passphraseKey struct {
+	KeyID     string `gorm:"primaryKey;size:64"`
+	Salt      []byte
+	Time      uint32
+	Memory    uint32 // KiB
+	Threads   uint8
+	Verifier  []byte // 派生密钥对主密钥ID的HMAC，用于检查口令是否正确
+	CreatedAt time.Time
+}
+
+func (passphraseKey) TableName() string { return "storage_passphrase_keys" }
+
+// DerivePassphraseKey 用Argon2id从口令派生主密钥。
+// 首次使用某个主密钥ID时生成随机盐值并记录校验值，之后必须使用相同的口令
+func DerivePassphraseKey(db *gorm.DB, keyID, passphrase string) (LocalKey, error) {
+	if utf8.RuneCountInString(passphrase) < minPassphraseLength {
+		return nil, fmt.Errorf("口令至少需要%d个字符", minPassphraseLength)
+	}
+	if err := db.AutoMigrate(&passphraseKey{}); err != nil {
+		return nil, fmt.Errorf("创建口令密钥表失败: %w", err)
+	}
+
+	// 多个实例同时首次启动时以先写入的参数为准
+	for attempt := 0; attempt < 2; attempt++ {
+		var params passphraseKey
+		err := db.Where("key_id = ?", keyID).First(&params).Error
+		if err == nil {
+			key := params.derive(passphrase)
+			if !hmac.Equal(passphraseVerifier(key, keyID), params.Verifier) {
+				return nil, fmt.Errorf("主密钥 %s 的口令错误", keyID)
+			}
+			return key, nil
+		}
+		if !errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, fmt.Errorf("读取口令密钥参数失败: %w", err)
+		}
+
+		params = passphraseKey{KeyID: keyID, Salt: make([]byte, 16), Time: 3, Memory: 64 * 1024, Threads: 4}
+		if _, err := rand.Read(params.Salt); err != nil {
+			return nil, fmt.Errorf("生成盐值失败: %w", err)
+		}
+		key := params.derive(passphrase)
+		params.Verifier = passphraseVerifier(key, keyID)
+
+		result := db.Clauses(clause.OnConflict{DoNothing: true}).Create(&params)
+		if result.Error != nil {
+			return nil, fmt.Errorf("保存口令密钥参数失败: %w", result.Error)
+		}
+		if result.RowsAffected == 1 {
+			return key, nil
+		}
+	}
+
+	return nil, errors.New("保存口令密钥参数失败，请稍后再试")
+}
+
+// derive 按保存的参数派生主密钥
+func (p *passphraseKey) derive(passphrase string) LocalKey {
+	return LocalKey(argon2.IDKey([]byte(passphrase), p.Salt, p.Time, p.Memory, p.Threads, dataKeySize))
+}
+
+// passphraseVerifier 计算派生密钥的校验值，校验值不能用于还原密钥
+func passphraseVerifier(key LocalKey, keyID string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte("filebox passphrase check:" + keyID))
+	return mac.Sum(nil)
+}
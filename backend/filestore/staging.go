@@ -0,0 +1,201 @@
+package filestore
+
+import (
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+)
+
+// 断点续传暂存文件格式
+//
+// 暂存文件由若干记录组成，每条记录为 nonce(12) | 最多stagingRecordSize字节明文经AES-GCM加密后的密文和16字节认证标签，
+// 只有最后一条记录可能不足stagingRecordSize。记录序号(8, 大端)作为附加认证数据，调换或替换记录都会被发现。
+// 追加写入时最后一条不完整的记录会解密后连同新内容用新的随机nonce重新加密，同一nonce不会用于不同的明文。
+const (
+	stagingRecordSize = 64 * 1024
+	stagingNonceSize  = 12
+	stagingSealedSize = stagingNonceSize + stagingRecordSize + gcmTagSize
+)
+
+// stagingSize 计算明文大小为size时暂存文件的大小
+func stagingSize(size int64) int64 {
+	n := size / stagingRecordSize * stagingSealedSize
+	if rem := size % stagingRecordSize; rem > 0 {
+		n += stagingNonceSize + rem + gcmTagSize
+	}
+	return n
+}
+
+// stagingAAD 返回第index条记录的附加认证数据
+func stagingAAD(index int64) []byte {
+	return binary.BigEndian.AppendUint64(nil, uint64(index))
+}
+
+// CreateStaging 创建空的暂存文件，仅允许服务进程读写
+func CreateStaging(path string) error {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("创建暂存文件失败: %w", err)
+	}
+	return f.Close()
+}
+
+// AppendStaging 从明文偏移offset处加密写入src的全部内容，offset之后原有的内容被丢弃。
+// 返回写入的明文字节数，读取src出错时已读到的内容同样会写入
+func AppendStaging(path string, key []byte, offset int64, src io.Reader) (int64, error) {
+	aead, err := newGCM(key)
+	if err != nil {
+		return 0, err
+	}
+	f, err := os.OpenFile(path, os.O_RDWR, 0600)
+	if err != nil {
+		return 0, fmt.Errorf("打开暂存文件失败: %w", err)
+	}
+	defer f.Close()
+
+	index := offset / stagingRecordSize
+	plain := make([]byte, stagingRecordSize)
+	sealed := make([]byte, stagingSealedSize)
+
+	// 取出offset所在记录中offset之前的内容，与新内容一起重新加密。
+	// 上次写入中断时该记录可能包含offset之后的内容，按记录的实际长度读取
+	filled := int(offset % stagingRecordSize)
+	if filled > 0 {
+		info, err := f.Stat()
+		if err != nil {
+			return 0, fmt.Errorf("读取暂存文件失败: %w", err)
+		}
+		n := min(info.Size()-index*stagingSealedSize, stagingSealedSize)
+		if n < int64(stagingNonceSize+filled+gcmTagSize) {
+			return 0, ErrCorrupted
+		}
+		record := sealed[:n]
+		if _, err := f.ReadAt(record, index*stagingSealedSize); err != nil {
+			return 0, fmt.Errorf("读取暂存文件失败: %w", err)
+		}
+		if _, err := aead.Open(plain[:0], record[:stagingNonceSize], record[stagingNonceSize:], stagingAAD(index)); err != nil {
+			return 0, ErrCorrupted
+		}
+	}
+
+	var written int64
+	pos := index * stagingSealedSize
+	seal := func() error {
+		nonce := sealed[:stagingNonceSize]
+		if _, err := rand.Read(nonce); err != nil {
+			return fmt.Errorf("生成nonce失败: %w", err)
+		}
+		record := aead.Seal(nonce, nonce, plain[:filled], stagingAAD(index))
+		if _, err := f.WriteAt(record, pos); err != nil {
+			return fmt.Errorf("写入暂存文件失败: %w", err)
+		}
+		return nil
+	}
+
+	var readErr error
+	for {
+		n, err := io.ReadFull(src, plain[filled:])
+		filled += n
+		written += int64(n)
+		if filled == stagingRecordSize {
+			if err := seal(); err != nil {
+				return written, err
+			}
+			pos += stagingSealedSize
+			index++
+			filled = 0
+		}
+		if err != nil {
+			// 不完整的记录只在最后写入一次
+			if filled > 0 {
+				if err := seal(); err != nil {
+					return written, err
+				}
+			}
+			if err != io.EOF && err != io.ErrUnexpectedEOF {
+				readErr = err
+			}
+			break
+		}
+	}
+
+	// 丢弃之前写入中断时残留在末尾的内容
+	if err := f.Truncate(stagingSize(offset + written)); err != nil {
+		return written, fmt.Errorf("写入暂存文件失败: %w", err)
+	}
+	if err := f.Sync(); err != nil {
+		return written, fmt.Errorf("写入暂存文件失败: %w", err)
+	}
+	return written, readErr
+}
+
+// OpenStaging 打开暂存文件并返回解密后的明文，size为已写入的明文大小
+func OpenStaging(path string, key []byte, size int64) (io.ReadCloser, error) {
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("打开暂存文件失败: %w", err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("打开暂存文件失败: %w", err)
+	}
+	if info.Size() != stagingSize(size) {
+		f.Close()
+		return nil, ErrCorrupted
+	}
+
+	return &stagingReader{
+		f:      f,
+		aead:   aead,
+		size:   size,
+		sealed: make([]byte, stagingSealedSize),
+	}, nil
+}
+
+// stagingReader 按记录顺序解密读取暂存文件
+type stagingReader struct {
+	f      *os.File
+	aead   cipher.AEAD
+	size   int64
+	index  int64
+	read   int64 // 已解密的明文字节数
+	plain  []byte
+	sealed []byte
+}
+
+func (r *stagingReader) Read(p []byte) (int, error) {
+	if len(r.plain) == 0 {
+		if r.read >= r.size {
+			return 0, io.EOF
+		}
+		n := min(r.size-r.read, stagingRecordSize)
+		record := r.sealed[:stagingNonceSize+n+gcmTagSize]
+		if _, err := io.ReadFull(r.f, record); err != nil {
+			return 0, fmt.Errorf("读取暂存文件失败: %w", err)
+		}
+		plain, err := r.aead.Open(record[stagingNonceSize:stagingNonceSize], record[:stagingNonceSize], record[stagingNonceSize:], stagingAAD(r.index))
+		if err != nil {
+			return 0, ErrCorrupted
+		}
+		r.plain = plain
+		r.index++
+		r.read += n
+	}
+
+	n := copy(p, r.plain)
+	r.plain = r.plain[n:]
+	return n, nil
+}
+
+// Close 关闭暂存文件
+func (r *stagingReader) Close() error {
+	return r.f.Close()
+}
@@ -0,0 +1,111 @@
+package filestore
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// readStaging 解密读取暂存文件的全部内容
+func readStaging(t *testing.T, path string, key []byte, size int64) ([]byte, error) {
+	t.Helper()
+	r, err := OpenStaging(path, key, size)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return io.ReadAll(r)
+}
+
+func TestStagingAppend(t *testing.T) {
+	key := testKey(t)
+	path := filepath.Join(t.TempDir(), "upload")
+	if err := CreateStaging(path); err != nil {
+		t.Fatal(err)
+	}
+
+	plain := testData(t, 3*stagingRecordSize+123)
+	// 分段大小跨越记录边界，最后一条记录需要多次重新加密
+	var offset int64
+	for _, n := range []int{10, stagingRecordSize, 5, stagingRecordSize*2 - 20, 128} {
+		written, err := AppendStaging(path, key, offset, bytes.NewReader(plain[offset:offset+int64(n)]))
+		if err != nil || written != int64(n) {
+			t.Fatalf("append %d at %d: %d, %v", n, offset, written, err)
+		}
+		offset += written
+	}
+
+	got, err := readStaging(t, path, key, offset)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, plain[:offset]) {
+		t.Fatal("plaintext mismatch")
+	}
+
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(raw, plain[:64]) {
+		t.Fatal("staging file contains plaintext")
+	}
+}
+
+func TestStagingRewind(t *testing.T) {
+	key := testKey(t)
+	path := filepath.Join(t.TempDir(), "upload")
+	if err := CreateStaging(path); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := AppendStaging(path, key, 0, strings.NewReader("hello world")); err != nil {
+		t.Fatal(err)
+	}
+	// 从已记录的偏移量重新写入，丢弃之后的内容
+	if _, err := AppendStaging(path, key, 5, strings.NewReader("!")); err != nil {
+		t.Fatal(err)
+	}
+	got, err := readStaging(t, path, key, 6)
+	if err != nil || string(got) != "hello!" {
+		t.Fatalf("got %q, %v", got, err)
+	}
+}
+
+func TestStagingTampered(t *testing.T) {
+	key := testKey(t)
+	path := filepath.Join(t.TempDir(), "upload")
+	if err := CreateStaging(path); err != nil {
+		t.Fatal(err)
+	}
+	size := int64(stagingRecordSize + 10)
+	if _, err := AppendStaging(path, key, 0, bytes.NewReader(testData(t, int(size)))); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := readStaging(t, path, testKey(t), size); !errors.Is(err, ErrCorrupted) {
+		t.Fatalf("wrong key: err = %v, want ErrCorrupted", err)
+	}
+	if _, err := readStaging(t, path, key, size+1); !errors.Is(err, ErrCorrupted) {
+		t.Fatalf("wrong size: err = %v, want ErrCorrupted", err)
+	}
+
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw[stagingSealedSize+stagingNonceSize] ^= 0x01
+	if err := os.WriteFile(path, raw, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := readStaging(t, path, key, size); !errors.Is(err, ErrCorrupted) {
+		t.Fatalf("flipped bit: err = %v, want ErrCorrupted", err)
+	}
+	if _, err := AppendStaging(path, key, size, strings.NewReader("x")); !errors.Is(err, ErrCorrupted) {
+		t.Fatalf("append after flipped bit: err = %v, want ErrCorrupted", err)
+	}
+}
@@ -1,18 +1,132 @@
 package filestore
 
 import (
+	"errors"
 	"io"
-	"mime/multipart"
+	"time"
 )
 
+// ErrNotFound 存储中不存在指定的对象
+var ErrNotFound = errors.New("文件不存在")
+
+// 存储对象的加密格式，记录在数据库中，读取时不根据文件内容猜测，
+// 避免被改写文件头的AES-GCM文件被当作没有认证的旧版格式解密
+const (
+	FormatUnknown = 0 // 尚未记录，需要读取文件头识别
+	FormatLegacy  = 1 // 旧版 IV + AES-CFB
+	FormatChunked = 2 // AES-GCM分块格式
+)
+
+// FileMeta 待保存文件的元数据
+type FileMeta struct {
+	Name        string
+	ContentType string
+	Size        int64 // 文件大小，未知时为-1
+	// EncryptedMeta 客户端加密的文件名和类型，非空表示内容已由客户端端到端加密，
+	// 服务端无法读取明文，Name和ContentType只是占位值
+	EncryptedMeta string
+}
+
+// SaveResult 文件保存结果
+type SaveResult struct {
+	Path    string // 存储路径
+	Backend string // 写入的存储后端ID
+	Hash    string // 明文的SHA-256哈希
+	Size    int64  // 实际写入的明文字节数
+	Format  int    // 存储格式
+
+	KeyID   string // 包装数据密钥所用的主密钥ID
+	DataKey string // 包装后的数据密钥
+}
+
+// Ref 返回读取或删除刚保存的文件所需的存储引用
+func (r *SaveResult) Ref() BlobRef {
+	return BlobRef{
+		Path:    r.Path,
+		Backend: r.Backend,
+		KeyID:   r.KeyID,
+		DataKey: r.DataKey,
+		Size:    r.Size,
+		Format:  r.Format,
+	}
+}
+
+// BlobRef 读取已保存文件所需的信息
+type BlobRef struct {
+	Path    string
+	Backend string // 存储后端ID，为空表示当前写入的后端
+	KeyID   string
+	DataKey string // 为空表示旧版文件，内容直接由主密钥加密
+	Size    int64  // 原始明文大小，压缩存储的文件需要据此支持Seek
+	Format  int    // 存储格式，FormatLegacy以外的文件缺少文件头时视为已损坏
+}
+
 // FileStorage 文件存储接口
 type FileStorage interface {
-	// Save 保存文件并返回存储路径和哈希值
-	Save(file *multipart.FileHeader) (string, string, error)
+	// Save 从r中读取文件内容，单次读取完成哈希计算与加密写入
+	Save(r io.Reader, meta FileMeta) (*SaveResult, error)
 
-	// Get 获取文件
-	Get(path string) (io.ReadCloser, error)
+	// Get 获取文件，返回的明文读取器支持Seek，可用于断点续传和Range请求
+	Get(ref BlobRef) (io.ReadSeekCloser, error)
 
 	// Delete 删除文件
+	Delete(ref BlobRef) error
+}
+
+// Upgrader 可以识别旧版加密格式文件的存储
+type Upgrader interface {
+	// NeedsUpgrade 判断文件是否仍为旧版格式，需要重新加密
+	NeedsUpgrade(ref BlobRef) (bool, error)
+
+	// DetectFormat 读取文件头识别尚未记录存储格式的文件
+	DetectFormat(ref BlobRef) (int, error)
+}
+
+// Migrator 可以在多个存储后端之间复制对象的存储，用于存储迁移
+type Migrator interface {
+	// PrimaryBackend 返回新文件写入的存储后端ID
+	PrimaryBackend() string
+
+	// Copy 将对象原样（仍为密文）复制到指定后端的相同路径
+	Copy(ref BlobRef, backend string) error
+}
+
+// ObjectInfo 底层存储中的对象信息
+type ObjectInfo struct {
+	Path    string
+	Size    int64
+	ModTime time.Time
+}
+
+// QuarantinePrefix 被隔离对象所在的路径前缀，列出对象时会跳过该前缀
+const QuarantinePrefix = "quarantine"
+
+// Reconciler 可以列出和隔离底层对象的存储，用于核对存储与数据库记录
+type Reconciler interface {
+	// PrimaryBackend 返回被核对的存储后端ID，即新文件写入的后端
+	PrimaryBackend() string
+
+	// List 遍历存储中的所有对象（不包括已隔离的对象）
+	List(fn func(ObjectInfo) error) error
+
+	// Quarantine 将对象移动到隔离区，返回隔离后的路径
+	Quarantine(path string) (string, error)
+
+	// Restore 将隔离区中的对象移回隔离前的路径，返回恢复后的路径
+	Restore(path string) (string, error)
+}
+
+// Backend 底层对象存储接口，只负责按路径读写密文字节，加密由EncryptedStorage完成
+type Backend interface {
+	// Put 写入对象，size为-1表示长度未知
+	Put(path string, r io.Reader, size int64) error
+
+	// Open 打开对象，返回的读取器需要支持Seek。对象不存在时返回ErrNotFound
+	Open(path string) (io.ReadSeekCloser, error)
+
+	// Delete 删除对象
 	Delete(path string) error
+
+	// List 遍历所有对象
+	List(fn func(ObjectInfo) error) error
 }
@@ -0,0 +1,149 @@
+package filestore
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// TransitKey 保存在Vault transit引擎（或兼容的服务）中的主密钥。
+// 数据密钥通过transit接口包装和解包，主密钥本身不会离开Vault
+type TransitKey struct {
+	Addr   string // Vault地址，例如 https://vault.example.com:8200
+	Mount  string // transit引擎的挂载路径
+	Name   string // transit密钥名称
+	Token  string
+	Client *http.Client
+}
+
+// transitResponse transit接口的响应
+type transitResponse struct {
+	Data struct {
+		Ciphertext string `json:"ciphertext"`
+		Plaintext  string `json:"plaintext"`
+	} `json:"data"`
+	Errors []string `json:"errors"`
+}
+
+// NewTransitKey 创建transit主密钥，并用一个随机值试验包装和解包，尽早发现地址、令牌或权限配置错误
+func NewTransitKey(addr, mount, name, token string) (*TransitKey, error) {
+	if addr == "" {
+		return nil, errors.New("未配置Vault地址 VAULT_ADDR")
+	}
+	if token == "" {
+		return nil, errors.New("未配置Vault令牌，请设置 VAULT_TOKEN_FILE 或 VAULT_TOKEN")
+	}
+	if name == "" {
+		return nil, errors.New("未指定transit密钥名称")
+	}
+	if mount == "" {
+		mount = "transit"
+	}
+
+	key := &TransitKey{
+		Addr:   strings.TrimRight(addr, "/"),
+		Mount:  strings.Trim(mount, "/"),
+		Name:   name,
+		Token:  token,
+		Client: &http.Client{Timeout: 10 * time.Second},
+	}
+
+	probe := make([]byte, dataKeySize)
+	if _, err := rand.Read(probe); err != nil {
+		return nil, fmt.Errorf("生成测试密钥失败: %w", err)
+	}
+	wrapped, err := key.Wrap(name, probe)
+	if err != nil {
+		return nil, err
+	}
+	unwrapped, err := key.Unwrap(name, wrapped)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(unwrapped, probe) {
+		return nil, errors.New("Vault解密结果与原文不一致")
+	}
+
+	return key, nil
+}
+
+// Wrap 调用transit encrypt接口包装数据密钥，返回Vault格式的密文（vault:v1:...）。
+// keyID作为附加认证数据（associated_data），密文只能以同一个主密钥ID解包，
+// 因此transit密钥需要是aes256-gcm96等AEAD类型
+func (k *TransitKey) Wrap(keyID string, dataKey []byte) (string, error) {
+	resp, err := k.call("encrypt", map[string]string{
+		"plaintext":       base64.StdEncoding.EncodeToString(dataKey),
+		"associated_data": base64.StdEncoding.EncodeToString([]byte(keyID)),
+	})
+	if err != nil {
+		return "", fmt.Errorf("包装数据密钥失败: %w", err)
+	}
+	if resp.Data.Ciphertext == "" {
+		return "", errors.New("包装数据密钥失败: Vault未返回密文")
+	}
+	return resp.Data.Ciphertext, nil
+}
+
+// Unwrap 调用transit decrypt接口解包数据密钥，keyID须与包装时一致
+func (k *TransitKey) Unwrap(keyID, wrapped string) ([]byte, error) {
+	resp, err := k.call("decrypt", map[string]string{
+		"ciphertext":      wrapped,
+		"associated_data": base64.StdEncoding.EncodeToString([]byte(keyID)),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("解包数据密钥失败: %w", err)
+	}
+	dataKey, err := base64.StdEncoding.DecodeString(resp.Data.Plaintext)
+	if err != nil || len(dataKey) != dataKeySize {
+		return nil, errors.New("解包数据密钥失败: Vault返回的数据密钥无效")
+	}
+	return dataKey, nil
+}
+
+// call 调用transit接口
+func (k *TransitKey) call(op string, body map[string]string) (*transitResponse, error) {
+	payload, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+
+	endpoint := fmt.Sprintf("%s/v1/%s/%s/%s", k.Addr, k.Mount, op, url.PathEscape(k.Name))
+	req, err := http.NewRequest(http.MethodPost, endpoint, bytes.NewReader(payload))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Vault-Token", k.Token)
+
+	res, err := k.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	var result transitResponse
+	data, err := io.ReadAll(io.LimitReader(res.Body, 1<<20))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, &result); err != nil && res.StatusCode == http.StatusOK {
+			return nil, fmt.Errorf("无法解析Vault响应: %w", err)
+		}
+	}
+	if res.StatusCode != http.StatusOK {
+		if len(result.Errors) > 0 {
+			return nil, fmt.Errorf("Vault返回%d: %s", res.StatusCode, strings.Join(result.Errors, "; "))
+		}
+		return nil, fmt.Errorf("Vault返回%d", res.StatusCode)
+	}
+	return &result, nil
+}
@@ -0,0 +1,173 @@
+package filestore
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeTransit 模拟Vault transit引擎的encrypt和decrypt接口，每个密钥名称对应一个AES-GCM密钥
+type fakeTransit struct {
+	t     *testing.T
+	token string
+	mu    sync.Mutex
+	keys  map[string][]byte
+}
+
+func newFakeTransit(t *testing.T, token string) *httptest.Server {
+	f := &fakeTransit{t: t, token: token, keys: map[string][]byte{}}
+	server := httptest.NewServer(f)
+	t.Cleanup(server.Close)
+	return server
+}
+
+func (f *fakeTransit) fail(w http.ResponseWriter, code int, msg string) {
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(map[string][]string{"errors": {msg}})
+}
+
+func (f *fakeTransit) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("X-Vault-Token") != f.token {
+		f.fail(w, http.StatusForbidden, "permission denied")
+		return
+	}
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/v1/"), "/")
+	if r.Method != http.MethodPost || len(parts) != 3 || parts[0] != "transit" {
+		f.fail(w, http.StatusNotFound, "no handler for route")
+		return
+	}
+	var body struct {
+		Plaintext      string `json:"plaintext"`
+		Ciphertext     string `json:"ciphertext"`
+		AssociatedData string `json:"associated_data"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		f.fail(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	aad, err := base64.StdEncoding.DecodeString(body.AssociatedData)
+	if err != nil {
+		f.fail(w, http.StatusBadRequest, "invalid associated_data")
+		return
+	}
+
+	f.mu.Lock()
+	key, ok := f.keys[parts[2]]
+	if !ok {
+		key = make([]byte, 32)
+		rand.Read(key)
+		f.keys[parts[2]] = key
+	}
+	f.mu.Unlock()
+	block, _ := aes.NewCipher(key)
+	aead, _ := cipher.NewGCM(block)
+
+	var data map[string]string
+	switch parts[1] {
+	case "encrypt":
+		plain, err := base64.StdEncoding.DecodeString(body.Plaintext)
+		if err != nil {
+			f.fail(w, http.StatusBadRequest, "invalid plaintext")
+			return
+		}
+		nonce := make([]byte, aead.NonceSize())
+		rand.Read(nonce)
+		sealed := aead.Seal(nonce, nonce, plain, aad)
+		data = map[string]string{"ciphertext": "vault:v1:" + base64.StdEncoding.EncodeToString(sealed)}
+	case "decrypt":
+		sealed, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(body.Ciphertext, "vault:v1:"))
+		if err != nil || len(sealed) < aead.NonceSize() {
+			f.fail(w, http.StatusBadRequest, "invalid ciphertext")
+			return
+		}
+		plain, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], aad)
+		if err != nil {
+			f.fail(w, http.StatusBadRequest, "cipher: message authentication failed")
+			return
+		}
+		data = map[string]string{"plaintext": base64.StdEncoding.EncodeToString(plain)}
+	default:
+		f.fail(w, http.StatusNotFound, "no handler for route")
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]any{"data": data})
+}
+
+func TestTransitWrapUnwrap(t *testing.T) {
+	server := newFakeTransit(t, "s.token")
+	key, err := NewTransitKey(server.URL+"/", "/transit/", "filebox", "s.token")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dataKey := testKey(t)
+	wrapped, err := key.Wrap("k3", dataKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(wrapped, "vault:v1:") {
+		t.Fatalf("wrapped = %q", wrapped)
+	}
+	got, err := key.Unwrap("k3", wrapped)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, dataKey) {
+		t.Fatal("data key mismatch")
+	}
+
+	// 主密钥ID与包装时不同
+	if _, err := key.Unwrap("k4", wrapped); err == nil {
+		t.Fatal("unwrapped with another key ID")
+	}
+	// Vault中的另一个密钥
+	other := *key
+	other.Name = "other"
+	if _, err := other.Unwrap("k3", wrapped); err == nil {
+		t.Fatal("unwrapped with another transit key")
+	}
+}
+
+func TestTransitKeyRing(t *testing.T) {
+	server := newFakeTransit(t, "s.token")
+	transit, err := NewTransitKey(server.URL, "", "filebox", "s.token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys, err := NewKeyRing("", "", "", ExternalKey{ID: "k3", Provider: transit}, ExternalKey{ID: "k4", Provider: transit})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dataKey, keyID, wrapped, err := keys.NewDataKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keyID != "k4" {
+		t.Fatalf("primary key = %s", keyID)
+	}
+	got, err := keys.DataKey(keyID, wrapped)
+	if err != nil || !bytes.Equal(got, dataKey) {
+		t.Fatalf("DataKey = %v", err)
+	}
+	// 同一个Vault密钥配置为两个主密钥ID时，密文也不能换用另一个ID解包
+	if _, err := keys.DataKey("k3", wrapped); err == nil {
+		t.Fatal("wrapped key accepted under another key ID")
+	}
+}
+
+func TestTransitBadToken(t *testing.T) {
+	server := newFakeTransit(t, "s.token")
+	_, err := NewTransitKey(server.URL, "transit", "filebox", "s.wrong")
+	if err == nil || !strings.Contains(err.Error(), "403") {
+		t.Fatalf("err = %v", err)
+	}
+}
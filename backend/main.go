@@ -1,9 +1,11 @@
 package main
 
 import (
+	"bufio"
 	"fmt"
 	"log"
 	"net/http"
+	"os"
 	"strings"
 	"time"
 
@@ -14,12 +16,19 @@ import (
 	"github.com/zaunist/filebox/backend/filestore"
 	"github.com/zaunist/filebox/backend/middleware"
 	"github.com/zaunist/filebox/backend/model"
+	"github.com/zaunist/filebox/backend/scanner"
 	"github.com/zaunist/filebox/backend/service"
+	"gorm.io/gorm"
 )
 
 func main() {
 	// 初始化配置
 	appConfig := config.NewAppConfig()
+	switch appConfig.TypeMismatchPolicy {
+	case service.TypeMismatchReject, service.TypeMismatchOverride, service.TypeMismatchFlag:
+	default:
+		log.Fatalf("不支持的文件类型不一致处理方式: %s", appConfig.TypeMismatchPolicy)
+	}
 
 	// 初始化数据库
 	db := config.NewDatabase()
@@ -35,11 +44,46 @@ func main() {
 	}
 
 	// 初始化存储
-	localStorage, err := filestore.NewLocalStorage(appConfig.StoragePath)
+	storage, err := newStorage(appConfig, db.DB)
 	if err != nil {
 		log.Fatalf("初始化存储失败: %v", err)
 	}
 
+	// 为现有的文件记录和Blob设置所在的存储后端
+	for _, table := range []interface{}{&model.File{}, &model.Blob{}} {
+		if err := db.DB.Model(table).Where("backend = '' OR backend IS NULL").UpdateColumn("backend", storage.BackendID).Error; err != nil {
+			log.Fatalf("设置存储后端失败: %v", err)
+		}
+	}
+
+	storageService := &service.StorageService{
+		DB:      db.DB,
+		Storage: storage,
+		Keys:    storage.Keys,
+	}
+
+	// 为历史文件记录存储格式，读取时不再根据文件头判断是否为旧版格式
+	report, err := storageService.RecordStorageFormats()
+	if err != nil {
+		log.Fatalf("记录存储格式失败: %v", err)
+	}
+	if report.Total > 0 {
+		log.Printf("已记录 %d 个文件的存储格式，失败 %d 个", report.Migrated, report.Failed)
+	}
+
+	tieringService, err := newTieringService(appConfig, storage, storageService)
+	if err != nil {
+		log.Fatalf("初始化冷热分层失败: %v", err)
+	}
+
+	// 执行命令行子命令（如数据迁移），执行完成后退出
+	if len(os.Args) > 1 {
+		if err := runCommand(os.Args[1], os.Args[2:], storageService, tieringService); err != nil {
+			log.Fatalf("执行命令失败: %v", err)
+		}
+		return
+	}
+
 	// 初始化JWT配置
 	jwtConfig := middleware.JWTConfig{
 		Secret:                 appConfig.JWTSecret,
@@ -55,15 +99,74 @@ func main() {
 
 	fileService := &service.FileService{
 		DB:        db.DB,
-		Storage:   localStorage,
+		Storage:   storage,
 		AppConfig: appConfig,
 	}
 
+	scanService, err := newScanService(appConfig, db.DB, storage, fileService)
+	if err != nil {
+		log.Fatalf("初始化恶意软件扫描失败: %v", err)
+	}
+	fileService.ScanService = scanService
+	// 在后台扫描新上传的文件
+	if scanService.Enabled() {
+		scanService.Start(time.Minute)
+	}
+
 	shareService := &service.ShareService{
 		DB:        db.DB,
 		AppConfig: appConfig,
 	}
 
+	uploadService := &service.UploadService{
+		DB:           db.DB,
+		FileService:  fileService,
+		ShareService: shareService,
+		AppConfig:    appConfig,
+		Keys:         storage.Keys,
+	}
+	// 定期清理过期的断点续传上传
+	uploadService.StartCleanup(time.Hour)
+
+	folderService := &service.FolderService{
+		DB:          db.DB,
+		FileService: fileService,
+	}
+
+	fetchClient, err := service.NewFetchClient(appConfig.FetchAllowedNetworks)
+	if err != nil {
+		log.Fatalf("FETCH_ALLOWED_NETWORKS配置错误: %v", err)
+	}
+	fetchService := &service.FetchService{
+		DB:          db.DB,
+		FileService: fileService,
+		Client:      fetchClient,
+		Timeout:     time.Duration(appConfig.FetchTimeoutMinutes) * time.Minute,
+	}
+	// 服务重启后未完成的任务无法继续
+	if err := fetchService.FailInterrupted(); err != nil {
+		log.Printf("更新中断的任务失败: %v", err)
+	}
+
+	scrubService := &service.ScrubService{
+		DB:      db.DB,
+		Storage: storage,
+	}
+	// 定期校验存储中文件的完整性
+	if appConfig.ScrubIntervalHours > 0 {
+		scrubService.StartSchedule(time.Duration(appConfig.ScrubIntervalHours) * time.Hour)
+	}
+
+	// 定期补齐镜像存储中缺失的副本
+	if appConfig.StorageType == "mirror" && appConfig.MirrorRepairMinutes > 0 {
+		storageService.StartReplicaRepair(time.Duration(appConfig.MirrorRepairMinutes) * time.Minute)
+	}
+
+	// 定期将较旧或长期未下载的文件移动到冷存储
+	if tieringService.Enabled() && appConfig.TierIntervalHours > 0 {
+		tieringService.StartSchedule(time.Duration(appConfig.TierIntervalHours) * time.Hour)
+	}
+
 	// 创建管理员用户（如果不存在）
 	err = userService.CreateAdminUser(appConfig.AdminEmail, appConfig.AdminPassword, appConfig.AdminUsername)
 	if err != nil {
@@ -78,7 +181,12 @@ func main() {
 	// 添加中间件
 	e.Use(echomiddleware.Logger())
 	e.Use(echomiddleware.Recover())
-	e.Use(echomiddleware.CORS())
+	e.Use(echomiddleware.CORSWithConfig(echomiddleware.CORSConfig{
+		// 非跨域的OPTIONS请求交给路由处理，用于tus协议的能力查询
+		Skipper: func(c echo.Context) bool {
+			return c.Request().Header.Get(echo.HeaderOrigin) == ""
+		},
+	}))
 
 	// 创建限流器
 	rateLimiter := middleware.NewRateLimiter(100, time.Minute) // 每分钟100个请求
@@ -87,6 +195,9 @@ func main() {
 	// 创建JWT中间件
 	jwtMiddleware := middleware.JWTMiddleware(jwtConfig)
 
+	// 创建允许匿名访问的JWT中间件，登录用户上传的文件归属于该用户
+	optionalJWTMiddleware := middleware.OptionalJWTMiddleware(jwtConfig)
+
 	// 创建管理员中间件
 	adminMiddleware := middleware.AdminMiddleware()
 
@@ -96,8 +207,14 @@ func main() {
 	}
 
 	fileHandler := &api.FileHandler{
-		FileService:  fileService,
-		ShareService: shareService,
+		FileService:   fileService,
+		ShareService:  shareService,
+		FetchService:  fetchService,
+		FolderService: folderService,
+	}
+
+	folderHandler := &api.FolderHandler{
+		FolderService: folderService,
 	}
 
 	shareHandler := &api.ShareHandler{
@@ -105,14 +222,23 @@ func main() {
 		FileService:  fileService,
 	}
 
+	uploadHandler := &api.UploadHandler{
+		UploadService: uploadService,
+	}
+
 	adminHandler := &api.AdminHandler{
-		DB: db.DB,
+		DB:             db.DB,
+		ScrubService:   scrubService,
+		TieringService: tieringService,
+		ScanService:    scanService,
 	}
 
 	// 注册路由
 	userHandler.RegisterRoutes(e, jwtMiddleware)
-	fileHandler.RegisterRoutes(e, jwtMiddleware)
+	fileHandler.RegisterRoutes(e, jwtMiddleware, optionalJWTMiddleware)
 	shareHandler.RegisterRoutes(e, jwtMiddleware)
+	folderHandler.RegisterRoutes(e, jwtMiddleware)
+	uploadHandler.RegisterRoutes(e, optionalJWTMiddleware)
 	adminHandler.RegisterRoutes(e, jwtMiddleware, adminMiddleware)
 
 	// 添加健康检查路由
@@ -165,3 +291,238 @@ func main() {
 		log.Fatalf("服务器启动失败: %v", err)
 	}
 }
+
+// newStorage 根据配置创建文件存储
+func newStorage(appConfig *config.AppConfig, db *gorm.DB) (*filestore.EncryptedStorage, error) {
+	backend, err := newBackend(appConfig.StorageType, "", appConfig, db)
+	if err != nil {
+		return nil, err
+	}
+
+	// 加载主密钥，未配置持久化密钥时拒绝启动
+	external, err := newKeyProviders(appConfig, db)
+	if err != nil {
+		return nil, err
+	}
+	keys, err := filestore.NewKeyRing(appConfig.StorageEncKey, appConfig.StorageMasterKeys, appConfig.StorageMasterKeyID, external...)
+	if err != nil {
+		return nil, err
+	}
+
+	storage := filestore.NewEncryptedStorage(backend, keys)
+	storage.BackendID = appConfig.StorageID
+	switch appConfig.StorageCompression {
+	case filestore.CompressionNone, filestore.CompressionZstd:
+		storage.Compression = appConfig.StorageCompression
+	default:
+		return nil, fmt.Errorf("不支持的压缩算法: %s", appConfig.StorageCompression)
+	}
+
+	// 其他仍需读取的存储后端，格式为 id=类型:位置，多个后端用分号分隔
+	storage.Backends = make(map[string]filestore.Backend)
+	for _, spec := range strings.Split(appConfig.StorageBackends, ";") {
+		spec = strings.TrimSpace(spec)
+		if spec == "" {
+			continue
+		}
+		id, target, ok := strings.Cut(spec, "=")
+		if !ok || id == "" {
+			return nil, fmt.Errorf("存储后端配置格式错误: %s", spec)
+		}
+		if id == storage.BackendID || storage.Backends[id] != nil {
+			return nil, fmt.Errorf("存储后端ID重复: %s", id)
+		}
+		kind, location, _ := strings.Cut(target, ":")
+		extra, err := newBackend(kind, location, appConfig, db)
+		if err != nil {
+			return nil, fmt.Errorf("初始化存储后端%s失败: %w", id, err)
+		}
+		storage.Backends[id] = extra
+	}
+
+	return storage, nil
+}
+
+// newKeyProviders 加载外部密钥提供者中的主密钥，格式为 id=类型:位置，多个用分号分隔。
+// file的位置为密钥文件，vault的位置为 [挂载路径/]transit密钥名称，passphrase的位置为口令文件，为空时从标准输入读取口令
+func newKeyProviders(appConfig *config.AppConfig, db *gorm.DB) ([]filestore.ExternalKey, error) {
+	var keys []filestore.ExternalKey
+	for _, spec := range strings.Split(appConfig.StorageKeyProviders, ";") {
+		spec = strings.TrimSpace(spec)
+		if spec == "" {
+			continue
+		}
+		id, target, ok := strings.Cut(spec, "=")
+		if !ok || id == "" {
+			return nil, fmt.Errorf("密钥提供者配置格式错误: %s", spec)
+		}
+		kind, location, _ := strings.Cut(target, ":")
+
+		var provider filestore.KeyProvider
+		var err error
+		switch kind {
+		case "file":
+			provider, err = filestore.LoadKeyFile(location)
+		case "vault":
+			provider, err = newTransitKey(location, appConfig)
+		case "passphrase":
+			var passphrase string
+			passphrase, err = readPassphrase(id, location)
+			if err == nil {
+				provider, err = filestore.DerivePassphraseKey(db, id, passphrase)
+			}
+		default:
+			err = fmt.Errorf("不支持的密钥提供者: %s", kind)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("加载主密钥%s失败: %w", id, err)
+		}
+		keys = append(keys, filestore.ExternalKey{ID: id, Provider: provider})
+	}
+	return keys, nil
+}
+
+// newTransitKey 创建Vault transit主密钥，令牌优先从 VAULT_TOKEN_FILE 读取
+func newTransitKey(location string, appConfig *config.AppConfig) (*filestore.TransitKey, error) {
+	token := appConfig.VaultToken
+	if appConfig.VaultTokenFile != "" {
+		var err error
+		if token, err = filestore.ReadSecretFile(appConfig.VaultTokenFile); err != nil {
+			return nil, err
+		}
+	}
+
+	mount, name := "transit", location
+	if i := strings.LastIndex(location, "/"); i >= 0 {
+		mount, name = location[:i], location[i+1:]
+	}
+	return filestore.NewTransitKey(appConfig.VaultAddr, mount, name, token)
+}
+
+// readPassphrase 从口令文件读取口令，未指定文件时从标准输入读取一行
+func readPassphrase(id, path string) (string, error) {
+	if path != "" {
+		return filestore.ReadSecretFile(path)
+	}
+
+	fmt.Fprintf(os.Stderr, "请输入主密钥 %s 的口令: ", id)
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && line == "" {
+		return "", fmt.Errorf("读取口令失败: %w", err)
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+// newTieringService 根据配置创建冷热分层服务，冷存储必须是STORAGE_BACKENDS中配置的后端
+func newTieringService(appConfig *config.AppConfig, storage *filestore.EncryptedStorage, storageService *service.StorageService) (*service.TieringService, error) {
+	tieringService := &service.TieringService{
+		StorageService: storageService,
+		Policy: service.TieringPolicy{
+			ColdBackend: appConfig.TierColdBackend,
+			MaxAge:      time.Duration(appConfig.TierAfterDays) * 24 * time.Hour,
+			MaxIdle:     time.Duration(appConfig.TierIdleDays) * 24 * time.Hour,
+		},
+	}
+	if appConfig.TierColdBackend == "" {
+		return tieringService, nil
+	}
+	if appConfig.TierColdBackend == storage.BackendID {
+		return nil, fmt.Errorf("冷存储不能是当前写入的存储后端: %s", appConfig.TierColdBackend)
+	}
+	if storage.Backends[appConfig.TierColdBackend] == nil {
+		return nil, fmt.Errorf("未配置存储后端: %s", appConfig.TierColdBackend)
+	}
+	return tieringService, nil
+}
+
+// newScanService 根据配置创建恶意软件扫描服务，SCANNER为空时不扫描上传的文件
+func newScanService(appConfig *config.AppConfig, db *gorm.DB, storage filestore.FileStorage, fileService *service.FileService) (*service.ScanService, error) {
+	scanService := &service.ScanService{
+		DB:          db,
+		Storage:     storage,
+		FileService: fileService,
+	}
+
+	switch appConfig.Scanner {
+	case "":
+		// 之前启用扫描时上传、尚未扫描的文件仍不能通过分享下载
+		var pending int64
+		db.Model(&model.File{}).Where("scan_status = ?", model.ScanStatusPending).Count(&pending)
+		if pending > 0 {
+			log.Printf("有%d个文件等待恶意软件扫描，但未配置扫描器，这些文件需要管理员放行后才能下载", pending)
+		}
+	case "clamd":
+		clamd, err := scanner.NewClamd(appConfig.ClamdAddress, time.Duration(appConfig.ScanTimeoutSeconds)*time.Second)
+		if err != nil {
+			return nil, err
+		}
+		// clamd可能晚于服务启动，不可用期间上传的文件保持待扫描状态，稍后重试
+		if err := clamd.Ping(); err != nil {
+			log.Printf("clamd暂不可用: %v", err)
+		}
+		scanService.Scanner = clamd
+	default:
+		return nil, fmt.Errorf("不支持的扫描器: %s", appConfig.Scanner)
+	}
+	return scanService, nil
+}
+
+// newBackend 创建存储后端，location为空时使用存储配置中的位置。
+// location对local为存储目录，对s3为 存储桶/前缀（使用S3配置中的地址和凭证），对mirror为逗号分隔的目录列表
+func newBackend(kind, location string, appConfig *config.AppConfig, db *gorm.DB) (filestore.Backend, error) {
+	switch kind {
+	case "local":
+		if location == "" {
+			location = appConfig.StoragePath
+		}
+		return filestore.NewLocalBackend(location)
+	case "s3":
+		cfg := filestore.S3Config{
+			Endpoint:  appConfig.S3Endpoint,
+			Region:    appConfig.S3Region,
+			Bucket:    appConfig.S3Bucket,
+			AccessKey: appConfig.S3AccessKey,
+			SecretKey: appConfig.S3SecretKey,
+			Prefix:    appConfig.S3Prefix,
+			UseSSL:    appConfig.S3UseSSL,
+			PartSize:  uint64(appConfig.S3PartSize),
+		}
+		if location != "" {
+			cfg.Bucket, cfg.Prefix, _ = strings.Cut(location, "/")
+		}
+		return filestore.NewS3Backend(cfg)
+	case "db":
+		return filestore.NewDBBackend(db)
+	case "mirror":
+		if location == "" {
+			location = appConfig.StorageMirrorPaths
+		}
+		mirror, err := newMirrorBackend(location, db)
+		if err != nil {
+			return nil, err
+		}
+		mirror.WriteTimeout = time.Duration(appConfig.MirrorWriteTimeout) * time.Second
+		return mirror, nil
+	default:
+		return nil, fmt.Errorf("不支持的存储类型: %s", kind)
+	}
+}
+
+// newMirrorBackend 创建镜像存储，每个本地目录作为一个副本，目录路径即副本名称
+func newMirrorBackend(paths string, db *gorm.DB) (*filestore.MirrorBackend, error) {
+	var replicas []filestore.Replica
+	for _, p := range strings.Split(paths, ",") {
+		p = strings.TrimSpace(p)
+		if p == "" {
+			continue
+		}
+		// 副本目录通常位于单独挂载的磁盘上，不自动创建，避免磁盘未挂载时写到根文件系统
+		if info, err := os.Stat(p); err != nil || !info.IsDir() {
+			// 单个磁盘不可用时仍然启动，该副本的写入记录为缺失，由修复任务稍后补齐
+			log.Printf("镜像副本目录不存在或不可用 %s，请确认磁盘已挂载", p)
+		}
+		backend := &filestore.LocalBackend{BasePath: p, MustExist: true}
+		replicas = append(replicas, filestore.Replica{Name: p, Backend: backend})
+	}
+	return filestore.NewMirrorBackend(db, replicas)
+}
@@ -165,3 +165,18 @@ func AdminMiddleware() echo.MiddlewareFunc {
 		}
 	}
 }
+
+// OptionalJWTMiddleware 创建可选的JWT中间件，未携带Authorization头时按匿名用户处理，
+// 携带时与JWTMiddleware一样校验令牌
+func OptionalJWTMiddleware(config JWTConfig) echo.MiddlewareFunc {
+	required := JWTMiddleware(config)
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		authenticated := required(next)
+		return func(c echo.Context) error {
+			if c.Request().Header.Get("Authorization") == "" {
+				return next(c)
+			}
+			return authenticated(c)
+		}
+	}
+}
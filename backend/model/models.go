@@ -29,18 +29,77 @@ func (u *User) BeforeCreate(tx *gorm.DB) error {
 
 // File 文件模型
 type File struct {
-	ID          uuid.UUID  `gorm:"type:uuid;primary_key" json:"id"`
-	UserID      *uuid.UUID `gorm:"type:uuid;index" json:"user_id,omitempty"`
-	Name        string     `gorm:"size:255;not null" json:"name"`
-	Size        int64      `gorm:"not null" json:"size"`
-	ContentType string     `gorm:"size:100;not null" json:"content_type"`
-	StoragePath string     `gorm:"size:255;not null" json:"-"`
-	Hash        string     `gorm:"size:64;not null" json:"hash"`
-	CreatedAt   time.Time  `json:"created_at"`
-	UpdatedAt   time.Time  `json:"updated_at"`
-	Shares      []Share    `gorm:"foreignKey:FileID" json:"shares,omitempty"`
+	ID            uuid.UUID  `gorm:"type:uuid;primary_key" json:"id"`
+	UserID        *uuid.UUID `gorm:"type:uuid;index" json:"user_id,omitempty"`
+	FolderID      *uuid.UUID `gorm:"type:uuid;index" json:"folder_id,omitempty"` // 所在文件夹，为空表示在根目录
+	Name          string     `gorm:"size:255;not null" json:"name"`
+	Description   string     `gorm:"size:1000;default:''" json:"description,omitempty"`
+	Size          int64      `gorm:"not null" json:"size"`
+	ContentType   string     `gorm:"size:100;not null" json:"content_type"`
+	ClaimedType   string     `gorm:"size:100;default:''" json:"claimed_type,omitempty"`
+	TypeMismatch  bool       `gorm:"default:false;index" json:"type_mismatch,omitempty"`
+	StoragePath   string     `gorm:"size:255;not null" json:"-"`
+	StorageFormat int        `gorm:"not null;default:0;index" json:"-"` // 存储对象的加密格式（filestore.Format*），0表示尚未记录
+	Backend       string     `gorm:"size:64;default:'';index" json:"-"`
+	Hash          string     `gorm:"size:64;not null" json:"hash"`
+	KeyID         string     `gorm:"size:64;default:'';index" json:"-"`
+	DataKey       string     `gorm:"size:255;default:''" json:"-"`
+	Encrypted     bool       `gorm:"default:false" json:"encrypted"`
+	EncryptedMeta string     `gorm:"size:4096;default:''" json:"encrypted_meta,omitempty"`
+	VerifiedAt    *time.Time `json:"verified_at,omitempty"`
+	VerifyStatus  string     `gorm:"size:16;default:'';index" json:"verify_status,omitempty"`
+	VerifyError   string     `gorm:"size:255;default:''" json:"verify_error,omitempty"`
+	ScanStatus    string     `gorm:"size:16;default:'';index" json:"scan_status,omitempty"`
+	ScanResult    string     `gorm:"size:255;default:''" json:"scan_result,omitempty"`
+	ScannedAt     *time.Time `json:"scanned_at,omitempty"`
+	DownloadedAt  *time.Time `json:"downloaded_at,omitempty"`
+	Tier          string     `gorm:"-" json:"tier,omitempty"`
+	Tags          []string   `gorm:"-" json:"tags,omitempty"` // 由FileTag填充
+	CreatedAt     time.Time  `json:"created_at"`
+	UpdatedAt     time.Time  `json:"updated_at"`
+	Shares        []Share    `gorm:"foreignKey:FileID" json:"shares,omitempty"`
 }
 
+// FileTag 文件的标签，UserID冗余保存文件所有者，用于按用户补全标签
+type FileTag struct {
+	FileID uuid.UUID `gorm:"type:uuid;primaryKey" json:"file_id"`
+	Tag    string    `gorm:"size:64;primaryKey;index" json:"tag"`
+	UserID uuid.UUID `gorm:"type:uuid;not null;index" json:"user_id"`
+}
+
+// Folder 注册用户的文件夹，ParentID为空表示在根目录。同一文件夹下的子文件夹不能重名
+type Folder struct {
+	ID        uuid.UUID  `gorm:"type:uuid;primary_key" json:"id"`
+	UserID    uuid.UUID  `gorm:"type:uuid;not null;uniqueIndex:idx_folder_name" json:"user_id"`
+	ParentID  *uuid.UUID `gorm:"type:uuid;index;uniqueIndex:idx_folder_name" json:"parent_id,omitempty"`
+	Name      string     `gorm:"size:255;not null;uniqueIndex:idx_folder_name" json:"name"`
+	CreatedAt time.Time  `json:"created_at"`
+	UpdatedAt time.Time  `json:"updated_at"`
+}
+
+// 端到端加密文件的占位文件名和类型，真实的文件名和类型只保存在客户端加密的元数据中
+const (
+	EncryptedFileName    = "encrypted.bin"
+	EncryptedContentType = "application/octet-stream"
+)
+
+// 文件完整性校验结果
+const (
+	VerifyStatusOK        = "ok"        // 内容与哈希一致
+	VerifyStatusCorrupted = "corrupted" // 内容损坏或被篡改
+	VerifyStatusMissing   = "missing"   // 存储中找不到文件
+	VerifyStatusError     = "error"     // 校验过程出错（如存储暂时不可用），不代表内容损坏
+)
+
+// 恶意软件扫描状态，为空表示未扫描（未启用扫描时上传的文件或端到端加密的文件）
+const (
+	ScanStatusPending  = "pending_scan" // 等待扫描，扫描完成前不能通过分享下载
+	ScanStatusClean    = "clean"        // 未发现威胁
+	ScanStatusInfected = "infected"     // 发现威胁，内容已移到隔离区
+	ScanStatusFailed   = "failed"       // 扫描器无法扫描（如超过大小限制），需要管理员检查
+	ScanStatusReleased = "released"     // 管理员检查后放行
+)
+
 // BeforeCreate 创建文件前生成UUID
 func (f *File) BeforeCreate(tx *gorm.DB) error {
 	if f.ID == uuid.Nil {
@@ -49,6 +108,62 @@ func (f *File) BeforeCreate(tx *gorm.DB) error {
 	return nil
 }
 
+// Blob 按内容哈希索引的存储对象。内容相同的文件共用同一个Blob，
+// RefCount记录引用该Blob的文件数，降为0时才删除存储中的对象
+type Blob struct {
+	Hash          string    `gorm:"size:64;primary_key" json:"hash"`
+	StoragePath   string    `gorm:"size:255;not null" json:"-"`
+	StorageFormat int       `gorm:"not null;default:0" json:"-"` // 存储对象的加密格式（filestore.Format*），0表示尚未记录
+	Backend       string    `gorm:"size:64;default:''" json:"-"`
+	Size          int64     `gorm:"not null" json:"size"`
+	KeyID         string    `gorm:"size:64;default:''" json:"-"`
+	DataKey       string    `gorm:"size:255;default:''" json:"-"`
+	RefCount      int       `gorm:"not null;default:0" json:"ref_count"`
+	CreatedAt     time.Time `json:"created_at"`
+	UpdatedAt     time.Time `json:"updated_at"`
+}
+
+// Upload 断点续传的上传会话（tus协议）。内容先追加写入本地暂存文件，
+// 全部接收后再交给文件服务写入存储，FileID记录生成的文件
+type Upload struct {
+	ID        uuid.UUID  `gorm:"type:uuid;primary_key" json:"id"`
+	UserID    *uuid.UUID `gorm:"type:uuid;index" json:"user_id,omitempty"`
+	Length    int64      `gorm:"not null" json:"length"`
+	Offset    int64      `gorm:"column:upload_offset;not null;default:0" json:"offset"`
+	Metadata  string     `gorm:"size:8192" json:"-"`
+	KeyID     string     `gorm:"size:64;default:''" json:"-"`  // 包装暂存内容数据密钥的主密钥ID
+	DataKey   string     `gorm:"size:255;default:''" json:"-"` // 包装后的暂存内容数据密钥，为空表示旧版本创建的未加密上传
+	FileID    *uuid.UUID `gorm:"type:uuid" json:"file_id,omitempty"`
+	ShareCode string     `gorm:"size:10" json:"share_code,omitempty"`
+	ExpiresAt time.Time  `gorm:"not null;index" json:"expires_at"`
+	CreatedAt time.Time  `json:"created_at"`
+	UpdatedAt time.Time  `json:"updated_at"`
+}
+
+// FetchJob 从URL获取文件的后台任务。服务端下载URL中的内容并写入存储，完成后FileID记录生成的文件
+type FetchJob struct {
+	ID        uuid.UUID  `gorm:"type:uuid;primary_key" json:"id"`
+	UserID    uuid.UUID  `gorm:"type:uuid;not null;index" json:"user_id"`
+	URL       string     `gorm:"size:2048;not null" json:"url"`
+	Name      string     `gorm:"size:255;default:''" json:"name,omitempty"`
+	Status    string     `gorm:"size:16;not null;index" json:"status"`
+	Total     int64      `gorm:"not null;default:-1" json:"total"` // 内容总长度，未知时为-1
+	Received  int64      `gorm:"not null;default:0" json:"received"`
+	FileID    *uuid.UUID `gorm:"type:uuid" json:"file_id,omitempty"`
+	Error     string     `gorm:"size:255;default:''" json:"error,omitempty"`
+	CreatedAt time.Time  `json:"created_at"`
+	UpdatedAt time.Time  `json:"updated_at"`
+}
+
+// 从URL获取文件的任务状态
+const (
+	FetchStatusPending  = "pending"  // 等待开始
+	FetchStatusRunning  = "running"  // 正在下载
+	FetchStatusDone     = "done"     // 已完成，FileID为生成的文件
+	FetchStatusFailed   = "failed"   // 失败，Error为失败原因
+	FetchStatusCanceled = "canceled" // 已被用户取消
+)
+
 // Share 分享记录模型
 type Share struct {
 	ID            uuid.UUID `gorm:"type:uuid;primary_key" json:"id"`
@@ -57,11 +172,36 @@ type Share struct {
 	ExpiresAt     time.Time `gorm:"not null" json:"expires_at"`
 	DownloadLimit int       `gorm:"default:5" json:"download_limit"`
 	DownloadCount int       `gorm:"default:0" json:"download_count"`
+	Bundle        bool      `gorm:"default:false" json:"bundle,omitempty"` // 分享包，包含的全部文件记录在ShareFile中
 	CreatedAt     time.Time `json:"created_at"`
 	UpdatedAt     time.Time `json:"updated_at"`
 	File          File      `gorm:"foreignKey:FileID" json:"file,omitempty"`
 }
 
+// ShareFile 分享包中的文件。分享包通过一个取件码分享多个文件，Share.FileID为排在最前的文件
+type ShareFile struct {
+	ShareID  uuid.UUID `gorm:"type:uuid;primaryKey" json:"share_id"`
+	FileID   uuid.UUID `gorm:"type:uuid;primaryKey;index" json:"file_id"`
+	Position int       `gorm:"not null;default:0" json:"position"`
+	File     File      `gorm:"foreignKey:FileID" json:"file,omitempty"`
+}
+
+// DownloadTicket 分享的下载凭证。每次计入下载次数的下载（一次取件）生成一个随机凭证并通过Cookie下发，
+// 有效期内携带凭证的续传请求，以及分享包中本次取件尚未下载过的文件属于同一次取件，不重复计数。只保存凭证的哈希
+type DownloadTicket struct {
+	ID        string    `gorm:"size:64;primaryKey" json:"-"` // 凭证的SHA-256哈希
+	ShareID   uuid.UUID `gorm:"type:uuid;not null;index" json:"share_id"`
+	ExpiresAt time.Time `gorm:"not null;index" json:"expires_at"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// DownloadTicketFile 一次取件中已开始下载的文件。分享包的每个文件在一次取件中只能从头下载一次，
+// FileID为uuid.Nil表示下载全部文件的ZIP
+type DownloadTicketFile struct {
+	TicketID string    `gorm:"size:64;primaryKey" json:"-"`
+	FileID   uuid.UUID `gorm:"type:uuid;primaryKey" json:"file_id"`
+}
+
 // BeforeCreate 创建分享记录前生成UUID
 func (s *Share) BeforeCreate(tx *gorm.DB) error {
 	if s.ID == uuid.Nil {
@@ -72,5 +212,10 @@ func (s *Share) BeforeCreate(tx *gorm.DB) error {
 
 // IsExpired 检查分享是否过期
 func (s *Share) IsExpired() bool {
-	return time.Now().After(s.ExpiresAt) || s.DownloadCount >= s.DownloadLimit
+	return s.IsTimeExpired() || s.DownloadCount >= s.DownloadLimit
+}
+
+// IsTimeExpired 检查分享是否超过有效期（不考虑下载次数）
+func (s *Share) IsTimeExpired() bool {
+	return time.Now().After(s.ExpiresAt)
 }
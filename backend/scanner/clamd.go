@@ -0,0 +1,172 @@
+package scanner
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+// defaultChunkSize INSTREAM每个分块的大小
+const defaultChunkSize = 64 * 1024
+
+// maxReplySize clamd响应的最大长度
+const maxReplySize = 4096
+
+// Clamd 通过clamd的INSTREAM命令扫描内容。内容分块通过套接字发送，
+// clamd不需要访问存储目录，也不会在clamd所在机器上留下明文文件
+type Clamd struct {
+	Network   string        // tcp 或 unix
+	Address   string        // host:port 或套接字路径
+	Timeout   time.Duration // 连接和单次读写的超时时间，扫描大文件时总耗时可以更长
+	ChunkSize int
+}
+
+// NewClamd 根据地址创建clamd扫描器，地址格式为 tcp://host:port 或 unix:///path/to/clamd.sock，
+// 省略协议时按TCP地址处理
+func NewClamd(addr string, timeout time.Duration) (*Clamd, error) {
+	network, address := "tcp", addr
+	if scheme, rest, ok := strings.Cut(addr, "://"); ok {
+		network, address = scheme, rest
+	}
+	if network != "tcp" && network != "unix" {
+		return nil, fmt.Errorf("不支持的clamd地址: %s", addr)
+	}
+	if address == "" {
+		return nil, errors.New("未配置clamd地址")
+	}
+	if timeout <= 0 {
+		timeout = time.Minute
+	}
+
+	return &Clamd{
+		Network:   network,
+		Address:   address,
+		Timeout:   timeout,
+		ChunkSize: defaultChunkSize,
+	}, nil
+}
+
+// Ping 检查clamd是否可用
+func (c *Clamd) Ping() error {
+	conn, err := c.dial()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if err := c.write(conn, []byte("zPING\x00")); err != nil {
+		return err
+	}
+	reply, err := c.readReply(conn)
+	if err != nil {
+		return err
+	}
+	if reply != "PONG" {
+		return fmt.Errorf("无法识别的clamd响应: %q", reply)
+	}
+	return nil
+}
+
+// Scan 使用INSTREAM命令扫描r中的内容：每个分块前是4字节大端序的长度，长度为0的分块表示结束
+func (c *Clamd) Scan(r io.Reader) (*Result, error) {
+	conn, err := c.dial()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	if err := c.write(conn, []byte("zINSTREAM\x00")); err != nil {
+		return nil, err
+	}
+
+	chunkSize := c.ChunkSize
+	if chunkSize <= 0 {
+		chunkSize = defaultChunkSize
+	}
+	buf := make([]byte, 4+chunkSize)
+	for {
+		n, readErr := io.ReadFull(r, buf[4:])
+		if n > 0 {
+			binary.BigEndian.PutUint32(buf[:4], uint32(n))
+			if err := c.write(conn, buf[:4+n]); err != nil {
+				// 超过StreamMaxLength时clamd会先返回错误再关闭连接
+				if reply, replyErr := c.readReply(conn); replyErr == nil && reply != "" {
+					return parseReply(reply)
+				}
+				return nil, err
+			}
+		}
+		if readErr == io.EOF || readErr == io.ErrUnexpectedEOF {
+			break
+		}
+		if readErr != nil {
+			return nil, fmt.Errorf("读取文件失败: %w", readErr)
+		}
+	}
+
+	if err := c.write(conn, []byte{0, 0, 0, 0}); err != nil {
+		return nil, err
+	}
+	reply, err := c.readReply(conn)
+	if err != nil {
+		return nil, err
+	}
+	return parseReply(reply)
+}
+
+// dial 连接clamd
+func (c *Clamd) dial() (net.Conn, error) {
+	conn, err := net.DialTimeout(c.Network, c.Address, c.Timeout)
+	if err != nil {
+		return nil, fmt.Errorf("连接clamd失败: %w", err)
+	}
+	return conn, nil
+}
+
+// write 写入数据，每次写入单独计算超时
+func (c *Clamd) write(conn net.Conn, data []byte) error {
+	if err := conn.SetWriteDeadline(time.Now().Add(c.Timeout)); err != nil {
+		return err
+	}
+	if _, err := conn.Write(data); err != nil {
+		return fmt.Errorf("发送数据到clamd失败: %w", err)
+	}
+	return nil
+}
+
+// readReply 读取以\0结尾的响应（z前缀的命令）
+func (c *Clamd) readReply(conn net.Conn) (string, error) {
+	if err := conn.SetReadDeadline(time.Now().Add(c.Timeout)); err != nil {
+		return "", err
+	}
+	data, err := bufio.NewReader(io.LimitReader(conn, maxReplySize)).ReadBytes(0)
+	if err != nil && (err != io.EOF || len(data) == 0) {
+		return "", fmt.Errorf("读取clamd响应失败: %w", err)
+	}
+	return strings.TrimSpace(string(bytes.TrimSuffix(data, []byte{0}))), nil
+}
+
+// parseReply 解析扫描结果，例如 "stream: OK"、"stream: Eicar-Signature FOUND"、
+// "INSTREAM size limit exceeded. ERROR"
+func parseReply(reply string) (*Result, error) {
+	body := strings.TrimPrefix(reply, "stream: ")
+	switch {
+	case body == "OK":
+		return &Result{}, nil
+	case strings.HasSuffix(body, " FOUND"):
+		return &Result{Infected: true, Signature: strings.TrimSuffix(body, " FOUND")}, nil
+	case strings.HasSuffix(body, " ERROR"):
+		msg := strings.TrimSuffix(body, " ERROR")
+		if strings.Contains(msg, "size limit") {
+			return nil, fmt.Errorf("%w: %s", ErrRejected, msg)
+		}
+		return nil, fmt.Errorf("clamd返回错误: %s", msg)
+	}
+	return nil, fmt.Errorf("无法识别的clamd响应: %q", reply)
+}
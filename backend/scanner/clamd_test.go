@@ -0,0 +1,245 @@
+package scanner
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const eicar = `X5O!P%@AP[4\PZX54(P^)7CC)7}$EICAR-STANDARD-ANTIVIRUS-TEST-FILE!$H+H*`
+
+// fakeClamd 模拟clamd的zPING和zINSTREAM命令，记录收到的分块长度
+type fakeClamd struct {
+	t        *testing.T
+	maxSize  int // 超过该大小时返回size limit错误，0表示不限制
+	mu       sync.Mutex
+	chunks   []int
+	received []byte
+}
+
+// startFakeClamd 在本地TCP端口上启动模拟的clamd，返回连接它的扫描器
+func startFakeClamd(t *testing.T, maxSize int) (*fakeClamd, *Clamd) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	f := &fakeClamd{t: t, maxSize: maxSize}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go f.serve(conn)
+		}
+	}()
+
+	clamd, err := NewClamd("tcp://"+ln.Addr().String(), 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return f, clamd
+}
+
+func (f *fakeClamd) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	cmd, err := r.ReadString(0)
+	if err != nil {
+		return
+	}
+
+	switch cmd {
+	case "zPING\x00":
+		conn.Write([]byte("PONG\x00"))
+	case "zINSTREAM\x00":
+		var data []byte
+		var chunks []int
+		header := make([]byte, 4)
+		for {
+			if _, err := io.ReadFull(r, header); err != nil {
+				return
+			}
+			n := int(binary.BigEndian.Uint32(header))
+			if n == 0 {
+				break
+			}
+			chunk := make([]byte, n)
+			if _, err := io.ReadFull(r, chunk); err != nil {
+				return
+			}
+			chunks = append(chunks, n)
+			data = append(data, chunk...)
+			if f.maxSize > 0 && len(data) > f.maxSize {
+				// 与clamd一样先返回错误，之后不再处理收到的内容
+				conn.Write([]byte("INSTREAM size limit exceeded. ERROR\x00"))
+				io.Copy(io.Discard, r)
+				return
+			}
+		}
+
+		f.mu.Lock()
+		f.chunks = chunks
+		f.received = data
+		f.mu.Unlock()
+		if bytes.Contains(data, []byte(eicar)) {
+			conn.Write([]byte("stream: Eicar-Signature FOUND\x00"))
+		} else {
+			conn.Write([]byte("stream: OK\x00"))
+		}
+	default:
+		conn.Write([]byte("UNKNOWN COMMAND\x00"))
+	}
+}
+
+// result 返回最近一次完整扫描收到的分块长度和内容
+func (f *fakeClamd) result() ([]int, []byte) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.chunks, f.received
+}
+
+func TestClamdPing(t *testing.T) {
+	_, clamd := startFakeClamd(t, 0)
+	if err := clamd.Ping(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestClamdClean(t *testing.T) {
+	fake, clamd := startFakeClamd(t, 0)
+	result, err := clamd.Scan(strings.NewReader("hello filebox"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Infected {
+		t.Fatalf("clean file reported as %s", result.Signature)
+	}
+	if _, received := fake.result(); string(received) != "hello filebox" {
+		t.Fatalf("clamd received %q", received)
+	}
+}
+
+func TestClamdFound(t *testing.T) {
+	_, clamd := startFakeClamd(t, 0)
+	result, err := clamd.Scan(strings.NewReader("prefix " + eicar))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !result.Infected || result.Signature != "Eicar-Signature" {
+		t.Fatalf("result = %+v", result)
+	}
+}
+
+func TestClamdChunkFraming(t *testing.T) {
+	fake, clamd := startFakeClamd(t, 0)
+	clamd.ChunkSize = 10
+
+	tests := []struct {
+		size   int
+		chunks []int
+	}{
+		{0, nil},
+		{7, []int{7}},
+		{20, []int{10, 10}},
+		{25, []int{10, 10, 5}},
+	}
+	for _, tt := range tests {
+		data := bytes.Repeat([]byte("a"), tt.size)
+		if _, err := clamd.Scan(bytes.NewReader(data)); err != nil {
+			t.Fatalf("size %d: %v", tt.size, err)
+		}
+		chunks, received := fake.result()
+		if !slices.Equal(chunks, tt.chunks) {
+			t.Errorf("size %d: chunks %v, want %v", tt.size, chunks, tt.chunks)
+		}
+		if !bytes.Equal(received, data) {
+			t.Errorf("size %d: content mismatch", tt.size)
+		}
+	}
+}
+
+func TestClamdSizeLimit(t *testing.T) {
+	_, clamd := startFakeClamd(t, 100)
+	clamd.ChunkSize = 16
+
+	_, err := clamd.Scan(bytes.NewReader(make([]byte, 64*1024)))
+	if !errors.Is(err, ErrRejected) {
+		t.Fatalf("err = %v, want ErrRejected", err)
+	}
+}
+
+func TestClamdReadError(t *testing.T) {
+	_, clamd := startFakeClamd(t, 0)
+	readErr := errors.New("disk failure")
+	_, err := clamd.Scan(io.MultiReader(strings.NewReader("partial"), &errReader{readErr}))
+	if !errors.Is(err, readErr) {
+		t.Fatalf("err = %v", err)
+	}
+}
+
+func TestClamdUnavailable(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+
+	clamd, err := NewClamd(addr, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := clamd.Scan(strings.NewReader("data")); err == nil || errors.Is(err, ErrRejected) {
+		t.Fatalf("err = %v, want retryable error", err)
+	}
+}
+
+func TestParseReply(t *testing.T) {
+	if _, err := parseReply("stream: Can't allocate memory ERROR"); err == nil || errors.Is(err, ErrRejected) {
+		t.Fatalf("err = %v, want retryable error", err)
+	}
+	if _, err := parseReply("garbage"); err == nil {
+		t.Fatal("unknown reply accepted")
+	}
+}
+
+func TestNewClamdAddress(t *testing.T) {
+	tests := []struct {
+		addr, network, address string
+	}{
+		{"127.0.0.1:3310", "tcp", "127.0.0.1:3310"},
+		{"tcp://clamav:3310", "tcp", "clamav:3310"},
+		{"unix:///run/clamav/clamd.sock", "unix", "/run/clamav/clamd.sock"},
+	}
+	for _, tt := range tests {
+		c, err := NewClamd(tt.addr, 0)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.addr, err)
+		}
+		if c.Network != tt.network || c.Address != tt.address {
+			t.Errorf("%s: got %s %s", tt.addr, c.Network, c.Address)
+		}
+	}
+	for _, addr := range []string{"", "tcp://", "http://clamav:3310"} {
+		if _, err := NewClamd(addr, 0); err == nil {
+			t.Errorf("%q accepted", addr)
+		}
+	}
+}
+
+// errReader 读取时总是返回err
+type errReader struct{ err error }
+
+func (r *errReader) Read([]byte) (int, error) { return 0, r.err }
@@ -0,0 +1,22 @@
+package scanner
+
+import (
+	"errors"
+	"io"
+)
+
+// ErrRejected 扫描器拒绝扫描该内容（如超过扫描器允许的大小），重试也不会成功
+var ErrRejected = errors.New("扫描器拒绝扫描该文件")
+
+// Result 扫描结果
+type Result struct {
+	Infected  bool
+	Signature string // 发现的威胁名称，例如 Eicar-Signature
+}
+
+// Scanner 恶意软件扫描器
+type Scanner interface {
+	// Scan 扫描r中的全部内容。扫描器无法处理该内容时返回包装了ErrRejected的错误，
+	// 其他错误（如扫描器暂时不可用）可以稍后重试
+	Scan(r io.Reader) (*Result, error)
+}
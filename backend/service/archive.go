@@ -0,0 +1,137 @@
+package service
+
+import (
+	"archive/zip"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/zaunist/filebox/backend/model"
+)
+
+// MaxArchiveFiles 一次打包下载的最多文件数
+const MaxArchiveFiles = 1000
+
+// GetArchiveFiles 按请求中的顺序获取用户要打包下载的文件（重复的ID只保留一个）。
+// 端到端加密的文件需要客户端逐个解密，发现威胁的文件已被隔离，均不能打包
+func (s *FileService) GetArchiveFiles(fileIDs []string, userID uuid.UUID) ([]model.File, error) {
+	ids := make([]string, 0, len(fileIDs))
+	seen := make(map[string]bool)
+	for _, id := range fileIDs {
+		if !seen[id] {
+			seen[id] = true
+			ids = append(ids, id)
+		}
+	}
+	if len(ids) == 0 {
+		return nil, errors.New("请选择要下载的文件")
+	}
+	if len(ids) > MaxArchiveFiles {
+		return nil, fmt.Errorf("最多同时下载%d个文件", MaxArchiveFiles)
+	}
+
+	var found []model.File
+	if err := s.DB.Where("id IN ? AND user_id = ?", ids, userID).Find(&found).Error; err != nil {
+		return nil, err
+	}
+	byID := make(map[string]model.File, len(found))
+	for _, file := range found {
+		byID[file.ID.String()] = file
+	}
+
+	files := make([]model.File, 0, len(ids))
+	for _, id := range ids {
+		file, ok := byID[id]
+		if !ok {
+			return nil, errors.New("文件不存在或无权访问")
+		}
+		if file.Encrypted {
+			return nil, fmt.Errorf("%s 是端到端加密的文件，请单独下载", file.ID)
+		}
+		if file.ScanStatus == model.ScanStatusInfected {
+			return nil, fmt.Errorf("%s: %w", file.Name, ErrScanBlocked)
+		}
+		files = append(files, file)
+	}
+	return files, nil
+}
+
+// WriteArchive 将文件依次从存储中解密后写入ZIP压缩包，边读边写，不在服务端暂存。
+// 文件名使用UTF-8编码，同名文件依次重命名为 "name (1).ext"；
+// 单个文件或整个压缩包超过4GB时自动使用ZIP64格式
+func (s *FileService) WriteArchive(w io.Writer, files []model.File) error {
+	archive := zip.NewWriter(w)
+	names := make(map[string]bool, len(files))
+	for i := range files {
+		file := &files[i]
+		name := uniqueArchiveName(archiveName(file.Name), names)
+		if err := s.writeArchiveEntry(archive, file, name); err != nil {
+			return fmt.Errorf("打包文件 %s 失败: %w", file.ID, err)
+		}
+	}
+	return archive.Close()
+}
+
+// writeArchiveEntry 写入单个文件，内容大多已经压缩过（图片、视频、压缩包），直接存储不再压缩
+func (s *FileService) writeArchiveEntry(archive *zip.Writer, file *model.File, name string) error {
+	content, err := s.GetFileContent(file)
+	if err != nil {
+		return err
+	}
+	defer content.Close()
+
+	w, err := archive.CreateHeader(&zip.FileHeader{
+		Name:     name,
+		Method:   zip.Store,
+		Modified: file.CreatedAt,
+	})
+	if err != nil {
+		return err
+	}
+	n, err := io.Copy(w, content)
+	if err != nil {
+		return err
+	}
+	if n != file.Size {
+		return fmt.Errorf("文件大小不一致: 应为%d字节，实际为%d字节", file.Size, n)
+	}
+	return nil
+}
+
+// archiveName 将文件名转换为压缩包中的条目名。去掉路径分隔符和控制字符，
+// 避免解压时写到目标目录之外
+func archiveName(name string) string {
+	name = strings.Map(func(r rune) rune {
+		switch {
+		case r == '/' || r == '\\':
+			return '_'
+		case r < 0x20 || r == 0x7f:
+			return -1
+		}
+		return r
+	}, strings.ToValidUTF8(name, "_"))
+	name = strings.TrimSpace(name)
+	if strings.Trim(name, ".") == "" {
+		return "file"
+	}
+	return name
+}
+
+// uniqueArchiveName 返回压缩包中未使用的条目名。不区分大小写比较，
+// 避免在Windows、macOS上解压时互相覆盖
+func uniqueArchiveName(name string, used map[string]bool) string {
+	ext := path.Ext(name)
+	if ext == name {
+		ext = "" // 以点开头的文件名，如 .env
+	}
+	base := strings.TrimSuffix(name, ext)
+	candidate := name
+	for i := 1; used[strings.ToLower(candidate)]; i++ {
+		candidate = fmt.Sprintf("%s (%d)%s", base, i, ext)
+	}
+	used[strings.ToLower(candidate)] = true
+	return candidate
+}
@@ -0,0 +1,138 @@
+package service
+
+import (
+	"errors"
+
+	"github.com/zaunist/filebox/backend/filestore"
+	"github.com/zaunist/filebox/backend/model"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// acquireBlob 为刚保存的内容登记一次Blob引用。
+// 相同哈希的Blob已存在时增加其引用计数并返回已有Blob（reused为true），调用方应删除刚保存的重复对象；
+// 否则以saved创建引用计数为1的新Blob。
+func acquireBlob(tx *gorm.DB, saved *filestore.SaveResult) (blob *model.Blob, reused bool, err error) {
+	// 与并发删除或创建冲突时重试
+	for attempt := 0; attempt < 3; attempt++ {
+		existing, err := referenceBlob(tx, saved.Hash)
+		if err != nil {
+			return nil, false, err
+		}
+		if existing != nil {
+			return existing, true, nil
+		}
+
+		created := &model.Blob{
+			Hash:          saved.Hash,
+			StoragePath:   saved.Path,
+			StorageFormat: saved.Format,
+			Backend:       saved.Backend,
+			Size:          saved.Size,
+			KeyID:         saved.KeyID,
+			DataKey:       saved.DataKey,
+			RefCount:      1,
+		}
+		result := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(created)
+		if result.Error != nil {
+			return nil, false, result.Error
+		}
+		if result.RowsAffected == 1 {
+			return created, false, nil
+		}
+	}
+
+	return nil, false, errors.New("登记文件内容失败，请稍后再试")
+}
+
+// referenceBlob 为已存在的Blob增加一次引用，Blob不存在时返回nil
+func referenceBlob(tx *gorm.DB, hash string) (*model.Blob, error) {
+	// 引用计数为0的Blob正在被删除，不能复用
+	result := tx.Model(&model.Blob{}).Where("hash = ? AND ref_count > 0", hash).
+		UpdateColumn("ref_count", gorm.Expr("ref_count + ?", 1))
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	if result.RowsAffected == 0 {
+		return nil, nil
+	}
+
+	var blob model.Blob
+	if err := tx.First(&blob, "hash = ?", hash).Error; err != nil {
+		return nil, err
+	}
+	return &blob, nil
+}
+
+// lockBlob 锁定哈希对应的Blob记录直到事务结束，使删除文件和存储迁移等修改同一内容的操作依次进行。
+// Blob不存在时返回nil
+func lockBlob(tx *gorm.DB, hash string) (*model.Blob, error) {
+	var blob model.Blob
+	err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&blob, "hash = ?", hash).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &blob, nil
+}
+
+// releaseBlob 释放文件对Blob的引用，调用前文件记录应已在同一事务中删除，并已用lockBlob锁定Blob。
+// 返回引用已全部释放、需要在事务提交后从存储中删除的对象，仍被引用时返回nil。
+func releaseBlob(tx *gorm.DB, file *model.File) (*filestore.BlobRef, error) {
+	blob, err := lockBlob(tx, file.Hash)
+	if err != nil {
+		return nil, err
+	}
+
+	// 历史文件可能尚未建立Blob索引，或者内容相同但保存在其他位置，此时按存储位置判断是否还有其他引用。
+	// 存储后端不同时仍是同一对象（正在迁移），照常释放Blob的引用
+	if blob == nil || blob.StoragePath != file.StoragePath {
+		inUse, err := isReferenced(tx, file.StoragePath, file.Backend)
+		if err != nil || inUse {
+			return nil, err
+		}
+		ref := blobRef(file)
+		return &ref, nil
+	}
+
+	if err := tx.Model(&model.Blob{}).Where("hash = ?", blob.Hash).
+		UpdateColumn("ref_count", gorm.Expr("ref_count - ?", 1)).Error; err != nil {
+		return nil, err
+	}
+
+	result := tx.Where("hash = ? AND ref_count <= 0", blob.Hash).Delete(&model.Blob{})
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	if result.RowsAffected == 0 {
+		return nil, nil
+	}
+	ref := blobRefOf(blob)
+	return &ref, nil
+}
+
+// isReferenced 判断存储后端中的路径是否仍被文件记录或Blob引用
+func isReferenced(tx *gorm.DB, path, backend string) (bool, error) {
+	var files, blobs int64
+	if err := tx.Model(&model.File{}).Where("storage_path = ? AND backend = ?", path, backend).Count(&files).Error; err != nil {
+		return false, err
+	}
+	if err := tx.Model(&model.Blob{}).Where("storage_path = ? AND backend = ?", path, backend).Count(&blobs).Error; err != nil {
+		return false, err
+	}
+	return files > 0 || blobs > 0, nil
+}
+
+// blobRefOf 返回读取Blob内容所需的存储引用
+func blobRefOf(blob *model.Blob) filestore.BlobRef {
+	return filestore.BlobRef{
+		Path:    blob.StoragePath,
+		Backend: blob.Backend,
+		KeyID:   blob.KeyID,
+		DataKey: blob.DataKey,
+		Size:    blob.Size,
+		Format:  blob.StorageFormat,
+	}
+}
@@ -0,0 +1,249 @@
+package service
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/zaunist/filebox/backend/filestore"
+	"github.com/zaunist/filebox/backend/model"
+	"gorm.io/gorm"
+)
+
+// 上传文件的内容与客户端声明的类型不一致时的处理方式
+const (
+	TypeMismatchReject   = "reject"   // 拒绝上传
+	TypeMismatchOverride = "override" // 使用检测到的类型
+	TypeMismatchFlag     = "flag"     // 使用检测到的类型，并标记文件供管理员检查
+)
+
+// sniffLength 检测文件类型需要读取的文件头长度，与http.DetectContentType一致
+const sniffLength = 512
+
+const octetStream = "application/octet-stream"
+
+// typeAliases 同一类型的不同写法
+var typeAliases = map[string]string{
+	"image/jpg":                    "image/jpeg",
+	"image/pjpeg":                  "image/jpeg",
+	"image/x-ms-bmp":               "image/bmp",
+	"application/x-zip-compressed": "application/zip",
+	"application/x-zip":            "application/zip",
+	"application/gzip":             "application/x-gzip",
+	"application/vnd.rar":          "application/x-rar-compressed",
+	"application/x-javascript":     "application/javascript",
+	"application/xml":              "text/xml",
+	"audio/wav":                    "audio/wave",
+	"audio/x-wav":                  "audio/wave",
+}
+
+// sniffableTypes 有固定文件头、一定能从内容识别的类型，内容识别不出来说明声明的类型是错的
+var sniffableTypes = map[string]bool{
+	"image/png":                    true,
+	"image/jpeg":                   true,
+	"image/gif":                    true,
+	"image/webp":                   true,
+	"image/bmp":                    true,
+	"application/pdf":              true,
+	"application/zip":              true,
+	"application/x-gzip":           true,
+	"application/x-rar-compressed": true,
+	"application/wasm":             true,
+	"font/woff":                    true,
+	"font/woff2":                   true,
+}
+
+// activeTypes 浏览器可能执行其中脚本的类型，只有内容确实如此时才使用
+var activeTypes = map[string]bool{
+	"text/html":              true,
+	"application/xhtml+xml":  true,
+	"image/svg+xml":          true,
+	"text/xml":               true,
+	"application/xml":        true,
+	"text/javascript":        true,
+	"application/javascript": true,
+	"application/ecmascript": true,
+}
+
+// contentTypeCheck 文件类型检测结果
+type contentTypeCheck struct {
+	ContentType string // 检测到的类型，下载时使用
+	Mismatch    bool   // 与客户端声明的类型不一致，且策略要求标记
+}
+
+// checkContentType 根据文件头、文件名和客户端声明的类型检测文件类型，并按配置处理不一致的情况
+func (s *FileService) checkContentType(head []byte, name, claimed string) (*contentTypeCheck, error) {
+	detected := detectContentType(head, name, claimed)
+	check := &contentTypeCheck{ContentType: detected}
+	if typeMismatch(claimed, detected) {
+		if s.AppConfig.TypeMismatchPolicy == TypeMismatchReject {
+			return nil, fmt.Errorf("文件内容与声明的类型不一致: 声明为%s，实际为%s", mediaType(claimed), mediaType(detected))
+		}
+		check.Mismatch = s.AppConfig.TypeMismatchPolicy != TypeMismatchOverride
+	}
+	return check, nil
+}
+
+// DetectContentTypes 检测历史文件的类型。旧版本直接保存客户端声明的类型，
+// 检测后原类型记为声明的类型，不一致的文件会被标记（无法拒绝已上传的文件）
+func (s *StorageService) DetectContentTypes(dryRun bool) (*MigrationReport, error) {
+	report := &MigrationReport{}
+	var files []model.File
+	result := s.DB.Model(&model.File{}).Where("claimed_type = '' AND encrypted = ?", false).
+		FindInBatches(&files, 100, func(tx *gorm.DB, batch int) error {
+			for i := range files {
+				file := &files[i]
+				report.Total++
+				if dryRun {
+					report.Migrated++
+					continue
+				}
+
+				head, err := readHead(s.Storage, blobRef(file))
+				if err != nil {
+					log.Printf("读取文件失败 %s: %v", file.ID, err)
+					report.Failed++
+					continue
+				}
+				detected := detectContentType(head, file.Name, file.ContentType)
+				if err := s.DB.Model(&model.File{}).Where("id = ?", file.ID).UpdateColumns(map[string]interface{}{
+					"content_type":  detected,
+					"claimed_type":  file.ContentType,
+					"type_mismatch": typeMismatch(file.ContentType, detected),
+				}).Error; err != nil {
+					log.Printf("更新文件类型失败 %s: %v", file.ID, err)
+					report.Failed++
+					continue
+				}
+				report.Migrated++
+			}
+			return nil
+		})
+	if result.Error != nil {
+		return report, result.Error
+	}
+	return report, nil
+}
+
+// readHead 读取存储中文件开头用于检测类型的内容
+func readHead(storage filestore.FileStorage, ref filestore.BlobRef) ([]byte, error) {
+	content, err := storage.Get(ref)
+	if err != nil {
+		return nil, err
+	}
+	defer content.Close()
+
+	head := make([]byte, sniffLength)
+	n, err := io.ReadFull(content, head)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return nil, fmt.Errorf("读取文件失败: %w", err)
+	}
+	return head[:n], nil
+}
+
+// detectContentType 检测文件类型。以文件头（magic bytes）为准，
+// 内容只能识别为通用类型（zip容器、纯文本、未知二进制）时再参考扩展名和声明的类型细分
+func detectContentType(head []byte, name, claimed string) string {
+	sniffed := http.DetectContentType(head)
+	hints := []string{
+		mediaType(mime.TypeByExtension(strings.ToLower(path.Ext(name)))),
+		mediaType(claimed),
+	}
+	refine := func(accept func(string) bool) string {
+		for _, hint := range hints {
+			if hint != "" && accept(hint) {
+				return hint
+			}
+		}
+		return ""
+	}
+
+	switch mediaType(sniffed) {
+	case "application/zip":
+		// docx、xlsx、apk等格式都是zip容器
+		if t := refine(isZipBased); t != "" {
+			return t
+		}
+	case octetStream:
+		// 无法从内容识别的二进制格式参考扩展名，但有固定文件头的类型必须与内容一致
+		if t := refine(func(t string) bool {
+			return t != octetStream && !sniffableTypes[t] && !activeTypes[t] && !isTextType(t)
+		}); t != "" {
+			return t
+		}
+	case "text/plain":
+		if looksLikeSVG(head) && refine(func(t string) bool { return t == "image/svg+xml" }) != "" {
+			return "image/svg+xml"
+		}
+		// 纯文本可以细分为CSS、CSV、JSON等，但不能标记为会被浏览器执行的类型
+		if t := refine(func(t string) bool { return isTextType(t) && !activeTypes[t] }); t != "" {
+			return t
+		}
+	case "text/xml":
+		if looksLikeSVG(head) && refine(func(t string) bool { return t == "image/svg+xml" }) != "" {
+			return "image/svg+xml"
+		}
+	}
+	return sniffed
+}
+
+// typeMismatch 判断客户端声明的类型是否与检测到的类型矛盾。
+// 未声明类型，或内容无法识别且声明的类型本身也无法从内容识别时，不算不一致
+func typeMismatch(claimed, detected string) bool {
+	claimed, detected = mediaType(claimed), mediaType(detected)
+	switch {
+	case claimed == "" || claimed == octetStream || claimed == detected:
+		return false
+	case detected == octetStream:
+		return sniffableTypes[claimed] || isTextType(claimed)
+	case detected == "application/zip":
+		return !isZipBased(claimed)
+	case isTextType(detected) && !activeTypes[detected]:
+		// 声明为HTML的纯文本按纯文本下载，没有风险
+		return !isTextType(claimed)
+	}
+	return true
+}
+
+// mediaType 返回去掉参数并规范化后的类型，如 "text/plain; charset=utf-8" 返回 "text/plain"
+func mediaType(contentType string) string {
+	t := strings.ToLower(strings.TrimSpace(contentType))
+	if i := strings.IndexByte(t, ';'); i >= 0 {
+		t = strings.TrimSpace(t[:i])
+	}
+	if alias, ok := typeAliases[t]; ok {
+		return alias
+	}
+	return t
+}
+
+// isTextType 判断是否为文本类型
+func isTextType(t string) bool {
+	switch t {
+	case "application/json", "application/xml", "application/javascript", "application/x-sh",
+		"application/x-yaml", "application/yaml", "application/toml", "application/sql":
+		return true
+	}
+	return strings.HasPrefix(t, "text/") || strings.HasSuffix(t, "+json") || strings.HasSuffix(t, "+xml")
+}
+
+// isZipBased 判断是否为使用zip容器的格式
+func isZipBased(t string) bool {
+	switch t {
+	case "application/zip", "application/java-archive", "application/vnd.android.package-archive", "application/x-xpinstall":
+		return true
+	}
+	return strings.HasSuffix(t, "+zip") ||
+		strings.HasPrefix(t, "application/vnd.openxmlformats-officedocument.") ||
+		strings.HasPrefix(t, "application/vnd.oasis.opendocument.")
+}
+
+// looksLikeSVG 判断文本内容是否为SVG图片
+func looksLikeSVG(head []byte) bool {
+	return bytes.Contains(bytes.ToLower(head), []byte("<svg"))
+}
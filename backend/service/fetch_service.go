@@ -0,0 +1,423 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/zaunist/filebox/backend/filestore"
+	"github.com/zaunist/filebox/backend/model"
+	"gorm.io/gorm"
+)
+
+// ErrFetchNotFound 任务不存在或无权访问
+var ErrFetchNotFound = errors.New("任务不存在")
+
+const (
+	// maxFetchRedirects 最多跟随的重定向次数
+	maxFetchRedirects = 5
+	// maxActiveFetches 每个用户同时进行的任务数
+	maxActiveFetches = 3
+)
+
+// reservedNetworks 除回环、内网、链路本地等地址外，同样不能从服务端访问的保留网段
+var reservedNetworks = mustParseNetworks(
+	"0.0.0.0/8",       // 本网络
+	"100.64.0.0/10",   // 运营商级NAT
+	"192.0.0.0/24",    // IETF协议分配
+	"192.0.2.0/24",    // 文档示例
+	"198.18.0.0/15",   // 基准测试
+	"198.51.100.0/24", // 文档示例
+	"203.0.113.0/24",  // 文档示例
+	"240.0.0.0/4",     // 保留
+	"64:ff9b::/96",    // NAT64，可能映射到内网IPv4地址
+	"2002::/16",       // 6to4，可能内嵌内网IPv4地址
+)
+
+// FetchService 从URL获取文件的服务。服务端在后台下载URL中的内容，
+// 与普通上传一样写入存储并生成文件记录，客户端通过任务查询进度
+type FetchService struct {
+	DB          *gorm.DB
+	FileService *FileService
+	Client      *http.Client  // 应使用NewFetchClient创建，拒绝访问内网地址
+	Timeout     time.Duration // 单个任务的最长时间
+
+	mu      sync.Mutex
+	running map[uuid.UUID]*fetchTask
+}
+
+// fetchTask 正在进行的任务
+type fetchTask struct {
+	cancel   context.CancelFunc
+	canceled atomic.Bool
+	received atomic.Int64
+}
+
+// FetchRequest 从URL获取文件的请求
+type FetchRequest struct {
+	URL  string `json:"url"`
+	Name string `json:"name"` // 可选，默认使用响应中的文件名或URL路径中的文件名
+}
+
+// NewFetchClient 创建从URL获取文件使用的HTTP客户端。建立连接前检查DNS解析后的IP地址，
+// 拒绝回环、内网、链路本地和保留地址（allowed中的网段除外），重定向后的地址同样检查。
+// allowed为逗号分隔的CIDR列表，不使用环境变量中的代理，避免绕过地址检查
+func NewFetchClient(allowed string) (*http.Client, error) {
+	var allowlist []*net.IPNet
+	for _, cidr := range strings.Split(allowed, ",") {
+		cidr = strings.TrimSpace(cidr)
+		if cidr == "" {
+			continue
+		}
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("无效的网段: %s", cidr)
+		}
+		allowlist = append(allowlist, network)
+	}
+
+	dialer := &net.Dialer{
+		Timeout: 10 * time.Second,
+		Control: func(network, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			ip := net.ParseIP(host)
+			if ip == nil {
+				return fmt.Errorf("无效的地址: %s", host)
+			}
+			if !isPublicIP(ip) && !containsIP(allowlist, ip) {
+				return fmt.Errorf("不允许访问内网地址: %s", ip)
+			}
+			return nil
+		},
+	}
+
+	transport := &http.Transport{
+		Proxy:                 nil,
+		DialContext:           dialer.DialContext,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ResponseHeaderTimeout: 30 * time.Second,
+		MaxIdleConns:          10,
+		IdleConnTimeout:       90 * time.Second,
+	}
+
+	return &http.Client{
+		Transport: transport,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= maxFetchRedirects {
+				return errors.New("重定向次数过多")
+			}
+			if req.URL.Scheme != "http" && req.URL.Scheme != "https" {
+				return fmt.Errorf("不支持重定向到 %s 地址", req.URL.Scheme)
+			}
+			return nil
+		},
+	}, nil
+}
+
+// CreateJob 创建从URL获取文件的任务并在后台开始下载
+func (s *FetchService) CreateJob(req FetchRequest, userID uuid.UUID) (*model.FetchJob, error) {
+	target, err := parseFetchURL(req.URL)
+	if err != nil {
+		return nil, err
+	}
+	name := strings.TrimSpace(req.Name)
+	if name != "" {
+		if name, err = CleanName(name); err != nil {
+			return nil, fmt.Errorf("无效的文件名: %w", err)
+		}
+	}
+
+	var active int64
+	if err := s.DB.Model(&model.FetchJob{}).
+		Where("user_id = ? AND status IN ?", userID, []string{model.FetchStatusPending, model.FetchStatusRunning}).
+		Count(&active).Error; err != nil {
+		return nil, err
+	}
+	if active >= maxActiveFetches {
+		return nil, fmt.Errorf("最多同时进行%d个任务，请稍后再试", maxActiveFetches)
+	}
+
+	job := &model.FetchJob{
+		ID:        uuid.New(),
+		UserID:    userID,
+		URL:       target.String(),
+		Name:      name,
+		Status:    model.FetchStatusPending,
+		Total:     -1,
+		CreatedAt: time.Now(),
+		UpdatedAt: time.Now(),
+	}
+	if err := s.DB.Create(job).Error; err != nil {
+		return nil, err
+	}
+
+	timeout := s.Timeout
+	if timeout <= 0 {
+		timeout = 30 * time.Minute
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	task := &fetchTask{cancel: cancel}
+	s.mu.Lock()
+	if s.running == nil {
+		s.running = make(map[uuid.UUID]*fetchTask)
+	}
+	s.running[job.ID] = task
+	s.mu.Unlock()
+
+	go s.run(ctx, job, task)
+	return job, nil
+}
+
+// GetJob 获取任务，正在下载的任务返回实时进度
+func (s *FetchService) GetJob(id string, userID uuid.UUID) (*model.FetchJob, error) {
+	var job model.FetchJob
+	if err := s.DB.Where("id = ? AND user_id = ?", id, userID).First(&job).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrFetchNotFound
+		}
+		return nil, err
+	}
+	s.withProgress(&job)
+	return &job, nil
+}
+
+// GetJobs 获取用户的任务列表
+func (s *FetchService) GetJobs(userID uuid.UUID, page, pageSize int) ([]model.FetchJob, int64, error) {
+	var jobs []model.FetchJob
+	var total int64
+
+	query := s.DB.Model(&model.FetchJob{}).Where("user_id = ?", userID)
+	if err := query.Count(&total).Error; err != nil {
+		return nil, 0, err
+	}
+
+	offset := (page - 1) * pageSize
+	if err := query.Order("created_at DESC").Offset(offset).Limit(pageSize).Find(&jobs).Error; err != nil {
+		return nil, 0, err
+	}
+	for i := range jobs {
+		s.withProgress(&jobs[i])
+	}
+
+	return jobs, total, nil
+}
+
+// CancelJob 取消正在进行的任务
+func (s *FetchService) CancelJob(id string, userID uuid.UUID) error {
+	job, err := s.GetJob(id, userID)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	task := s.running[job.ID]
+	s.mu.Unlock()
+	if task == nil {
+		return errors.New("任务已结束")
+	}
+	task.canceled.Store(true)
+	task.cancel()
+	return nil
+}
+
+// FailInterrupted 将服务重启前未完成的任务标记为失败，启动时调用
+func (s *FetchService) FailInterrupted() error {
+	return s.DB.Model(&model.FetchJob{}).
+		Where("status IN ?", []string{model.FetchStatusPending, model.FetchStatusRunning}).
+		Updates(map[string]interface{}{
+			"status": model.FetchStatusFailed,
+			"error":  "服务重启，任务中断",
+		}).Error
+}
+
+// withProgress 用内存中的实时进度更新正在下载的任务
+func (s *FetchService) withProgress(job *model.FetchJob) {
+	s.mu.Lock()
+	task := s.running[job.ID]
+	s.mu.Unlock()
+	if task != nil {
+		job.Received = task.received.Load()
+	}
+}
+
+// run 执行下载并记录结果
+func (s *FetchService) run(ctx context.Context, job *model.FetchJob, task *fetchTask) {
+	defer func() {
+		task.cancel()
+		s.mu.Lock()
+		delete(s.running, job.ID)
+		s.mu.Unlock()
+	}()
+
+	s.update(job.ID, map[string]interface{}{"status": model.FetchStatusRunning})
+	fileInfo, err := s.fetch(ctx, job, task)
+	if err != nil {
+		status := model.FetchStatusFailed
+		switch {
+		case task.canceled.Load():
+			status = model.FetchStatusCanceled
+			err = errors.New("任务已取消")
+		case errors.Is(ctx.Err(), context.DeadlineExceeded):
+			err = errors.New("下载超时")
+		}
+		msg := err.Error()
+		if len(msg) > 255 {
+			msg = strings.ToValidUTF8(msg[:255], "")
+		}
+		s.update(job.ID, map[string]interface{}{
+			"status":   status,
+			"received": task.received.Load(),
+			"error":    msg,
+		})
+		return
+	}
+
+	fileID, err := uuid.Parse(fileInfo.ID)
+	if err != nil {
+		log.Printf("无效的文件ID %s: %v", fileInfo.ID, err)
+	}
+	s.update(job.ID, map[string]interface{}{
+		"status":   model.FetchStatusDone,
+		"received": fileInfo.Size,
+		"file_id":  fileID,
+	})
+}
+
+// fetch 下载URL中的内容并保存为文件，大小限制与普通上传相同
+func (s *FetchService) fetch(ctx context.Context, job *model.FetchJob, task *fetchTask) (*FileUploadResponse, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, job.URL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", "FileBox")
+
+	resp, err := s.Client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("请求失败: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("服务器返回%d", resp.StatusCode)
+	}
+	maxSize := s.FileService.AppConfig.MaxFileSize
+	if resp.ContentLength > maxSize {
+		return nil, fmt.Errorf("文件大小超过限制，最大允许 %d 字节", maxSize)
+	}
+
+	name := job.Name
+	if name == "" {
+		name = responseFileName(resp)
+	}
+	s.update(job.ID, map[string]interface{}{"name": name, "total": resp.ContentLength})
+
+	return s.FileService.UploadFile(&progressReader{r: resp.Body, n: &task.received}, filestore.FileMeta{
+		Name:        name,
+		ContentType: resp.Header.Get("Content-Type"),
+		Size:        resp.ContentLength,
+	}, &job.UserID)
+}
+
+// update 更新任务状态
+func (s *FetchService) update(id uuid.UUID, values map[string]interface{}) {
+	values["updated_at"] = time.Now()
+	if err := s.DB.Model(&model.FetchJob{}).Where("id = ?", id).UpdateColumns(values).Error; err != nil {
+		log.Printf("更新任务状态失败 %s: %v", id, err)
+	}
+}
+
+// parseFetchURL 检查URL，只支持http和https，不允许在URL中携带用户名和密码
+func parseFetchURL(raw string) (*url.URL, error) {
+	raw = strings.TrimSpace(raw)
+	if raw == "" || len(raw) > 2048 {
+		return nil, errors.New("无效的URL")
+	}
+	target, err := url.Parse(raw)
+	if err != nil || target.Host == "" {
+		return nil, errors.New("无效的URL")
+	}
+	if target.Scheme != "http" && target.Scheme != "https" {
+		return nil, errors.New("只支持http和https地址")
+	}
+	if target.User != nil {
+		return nil, errors.New("URL中不能包含用户名和密码")
+	}
+	target.Fragment = ""
+	return target, nil
+}
+
+// responseFileName 从Content-Disposition或最终请求的URL路径中获取文件名，都不是有效的文件名时使用download
+func responseFileName(resp *http.Response) string {
+	if _, params, err := mime.ParseMediaType(resp.Header.Get("Content-Disposition")); err == nil {
+		if name, err := CleanName(path.Base(strings.ReplaceAll(params["filename"], "\\", "/"))); err == nil {
+			return name
+		}
+	}
+	if name, err := CleanName(path.Base(resp.Request.URL.Path)); err == nil {
+		return name
+	}
+	return "download"
+}
+
+// isPublicIP 判断是否为公网地址
+func isPublicIP(ip net.IP) bool {
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() || ip.IsMulticast() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() {
+		return false
+	}
+	return !containsIP(reservedNetworks, ip)
+}
+
+// containsIP 判断地址是否属于任一网段
+func containsIP(networks []*net.IPNet, ip net.IP) bool {
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// mustParseNetworks 解析固定的网段列表
+func mustParseNetworks(cidrs ...string) []*net.IPNet {
+	networks := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		networks = append(networks, network)
+	}
+	return networks
+}
+
+// progressReader 统计已读取的字节数，供查询任务进度
+type progressReader struct {
+	r io.Reader
+	n *atomic.Int64
+}
+
+func (p *progressReader) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	p.n.Add(int64(n))
+	return n, err
+}
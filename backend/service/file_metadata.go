@@ -0,0 +1,204 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/google/uuid"
+	"github.com/zaunist/filebox/backend/model"
+	"gorm.io/gorm"
+)
+
+const (
+	// maxDescriptionLength 文件描述的最大长度（字符）
+	maxDescriptionLength = 1000
+	// maxTagLength 单个标签的最大长度（字符）
+	maxTagLength = 64
+	// maxFileTags 每个文件最多的标签数
+	maxFileTags = 20
+)
+
+// ErrFileNotFound 文件不存在或不属于当前用户
+var ErrFileNotFound = errors.New("文件不存在或无权访问")
+
+// UpdateFileRequest 修改文件信息的请求，字段为nil表示不修改，Tags为空数组表示清空标签
+type UpdateFileRequest struct {
+	Name        *string   `json:"name"`
+	Description *string   `json:"description"`
+	Tags        *[]string `json:"tags"`
+}
+
+// TagCount 标签及使用该标签的文件数
+type TagCount struct {
+	Tag   string `json:"tag"`
+	Count int64  `json:"count"`
+}
+
+// CleanName 检查并规范文件或文件夹名称：去掉首尾空白，不能为空、不能是 . 或 ..，
+// 不能包含路径分隔符和控制字符，最长255字节。上传、重命名文件和文件夹都使用同样的规则
+func CleanName(name string) (string, error) {
+	name = strings.TrimSpace(name)
+	switch {
+	case name == "":
+		return "", errors.New("名称不能为空")
+	case name == "." || name == "..":
+		return "", errors.New("无效的名称")
+	case len(name) > 255:
+		return "", errors.New("名称过长，最多255字节")
+	case !utf8.ValidString(name):
+		return "", errors.New("名称不是有效的UTF-8文本")
+	case strings.ContainsAny(name, `/\`):
+		return "", errors.New("名称不能包含 / 或 \\")
+	case strings.IndexFunc(name, unicode.IsControl) >= 0:
+		return "", errors.New("名称不能包含控制字符")
+	}
+	return name, nil
+}
+
+// UpdateFile 修改文件名、描述和标签。端到端加密文件的真实文件名保存在客户端加密的元数据中，不能在服务端修改
+func (s *FileService) UpdateFile(id string, req UpdateFileRequest, userID uuid.UUID) (*model.File, error) {
+	var file model.File
+	if err := s.DB.Where("id = ? AND user_id = ?", id, userID).First(&file).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrFileNotFound
+		}
+		return nil, err
+	}
+
+	updates := map[string]interface{}{"updated_at": time.Now()}
+	if req.Name != nil {
+		if file.Encrypted {
+			return nil, errors.New("端到端加密的文件不能在服务端重命名")
+		}
+		name, err := CleanName(*req.Name)
+		if err != nil {
+			return nil, err
+		}
+		updates["name"] = name
+	}
+	if req.Description != nil {
+		description := strings.TrimSpace(*req.Description)
+		if utf8.RuneCountInString(description) > maxDescriptionLength {
+			return nil, fmt.Errorf("描述过长，最多%d个字符", maxDescriptionLength)
+		}
+		updates["description"] = description
+	}
+	var tags []string
+	if req.Tags != nil {
+		var err error
+		if tags, err = cleanTags(*req.Tags); err != nil {
+			return nil, err
+		}
+	}
+
+	err := s.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&file).Updates(updates).Error; err != nil {
+			return err
+		}
+		if req.Tags == nil {
+			return nil
+		}
+
+		// 替换全部标签
+		if err := tx.Where("file_id = ?", file.ID).Delete(&model.FileTag{}).Error; err != nil {
+			return err
+		}
+		if len(tags) == 0 {
+			return nil
+		}
+		entries := make([]model.FileTag, len(tags))
+		for i, tag := range tags {
+			entries[i] = model.FileTag{FileID: file.ID, Tag: tag, UserID: userID}
+		}
+		return tx.Create(&entries).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.DB.First(&file, "id = ?", file.ID).Error; err != nil {
+		return nil, err
+	}
+	files := []model.File{file}
+	if err := s.WithTags(files); err != nil {
+		return nil, err
+	}
+	return &files[0], nil
+}
+
+// WithTags 填充文件的标签
+func (s *FileService) WithTags(files []model.File) error {
+	if len(files) == 0 {
+		return nil
+	}
+	ids := make([]uuid.UUID, len(files))
+	for i := range files {
+		ids[i] = files[i].ID
+	}
+
+	var tags []model.FileTag
+	if err := s.DB.Where("file_id IN ?", ids).Order("tag").Find(&tags).Error; err != nil {
+		return err
+	}
+	byFile := make(map[uuid.UUID][]string)
+	for _, tag := range tags {
+		byFile[tag.FileID] = append(byFile[tag.FileID], tag.Tag)
+	}
+	for i := range files {
+		files[i].Tags = byFile[files[i].ID]
+	}
+	return nil
+}
+
+// GetUserTags 获取用户使用过的标签，prefix不为空时只返回以其开头的标签。标签不区分大小写，
+// 只有大小写不同的标签合并计数。按使用次数从多到少排序，用于输入时补全
+func (s *FileService) GetUserTags(userID uuid.UUID, prefix string, limit int) ([]TagCount, error) {
+	query := s.DB.Model(&model.FileTag{}).Select("MIN(tag) AS tag, COUNT(*) AS count").Where("user_id = ?", userID)
+	if prefix = strings.TrimSpace(prefix); prefix != "" {
+		escaped := strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(strings.ToLower(prefix))
+		query = query.Where(`LOWER(tag) LIKE ? ESCAPE '\'`, escaped+"%")
+	}
+
+	tags := []TagCount{}
+	if err := query.Group("LOWER(tag)").Order("count DESC, tag").Limit(limit).Scan(&tags).Error; err != nil {
+		return nil, err
+	}
+	return tags, nil
+}
+
+// cleanTags 检查并规范标签：去掉首尾空白，忽略空标签，重复的标签（不区分大小写）只保留第一个
+func cleanTags(tags []string) ([]string, error) {
+	cleaned := make([]string, 0, len(tags))
+	seen := make(map[string]bool)
+	for _, tag := range tags {
+		tag = strings.TrimSpace(tag)
+		if tag == "" {
+			continue
+		}
+		switch {
+		case !utf8.ValidString(tag):
+			return nil, errors.New("标签不是有效的UTF-8文本")
+		case utf8.RuneCountInString(tag) > maxTagLength:
+			return nil, fmt.Errorf("标签过长，最多%d个字符", maxTagLength)
+		case strings.IndexFunc(tag, unicode.IsControl) >= 0:
+			return nil, errors.New("标签不能包含控制字符")
+		case strings.Contains(tag, ","):
+			// 按标签过滤时用逗号分隔多个标签
+			return nil, errors.New("标签不能包含逗号")
+		}
+		key := strings.ToLower(tag)
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		cleaned = append(cleaned, tag)
+	}
+	if len(cleaned) > maxFileTags {
+		return nil, fmt.Errorf("每个文件最多%d个标签", maxFileTags)
+	}
+	return cleaned, nil
+}
@@ -1,10 +1,15 @@
 package service
 
 import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
-	"mime/multipart"
+	"regexp"
+	"strings"
 	"time"
 
 	"github.com/google/uuid"
@@ -16,9 +21,10 @@ import (
 
 // FileService 文件服务
 type FileService struct {
-	DB        *gorm.DB
-	Storage   filestore.FileStorage
-	AppConfig *config.AppConfig
+	DB          *gorm.DB
+	Storage     filestore.FileStorage
+	AppConfig   *config.AppConfig
+	ScanService *ScanService // 为nil或未配置扫描器时不扫描上传的文件
 }
 
 // FileUploadResponse 文件上传响应
@@ -28,11 +34,28 @@ type FileUploadResponse struct {
 	Size        int64     `json:"size"`
 	ContentType string    `json:"content_type"`
 	Hash        string    `json:"hash"`
+	Encrypted   bool      `json:"encrypted,omitempty"`
+	ScanStatus  string    `json:"scan_status,omitempty"`
+	FolderID    string    `json:"folder_id,omitempty"`
 	CreatedAt   time.Time `json:"created_at"`
 }
 
-// UploadFile 上传文件
-func (s *FileService) UploadFile(file *multipart.FileHeader, userID *uuid.UUID) (*FileUploadResponse, error) {
+// maxEncryptedMetaSize 客户端加密的元数据的最大长度
+const maxEncryptedMetaSize = 4096
+
+// encryptedMetaPattern 客户端加密的元数据应为base64或base64url编码
+var encryptedMetaPattern = regexp.MustCompile(`^[A-Za-z0-9+/_-]+={0,2}$`)
+
+// validateEncryptedMeta 检查客户端加密的元数据，服务端无法解密，只检查长度和编码
+func validateEncryptedMeta(meta string) error {
+	if len(meta) > maxEncryptedMetaSize || !encryptedMetaPattern.MatchString(meta) {
+		return errors.New("无效的加密元数据")
+	}
+	return nil
+}
+
+// UploadFile 上传文件，src为文件内容流，meta.Size未知时为-1
+func (s *FileService) UploadFile(src io.Reader, meta filestore.FileMeta, userID *uuid.UUID) (*FileUploadResponse, error) {
 	// 检查文件大小
 	var maxSize int64
 	if userID == nil {
@@ -41,46 +64,140 @@ func (s *FileService) UploadFile(file *multipart.FileHeader, userID *uuid.UUID)
 		maxSize = s.AppConfig.MaxFileSize
 	}
 
-	if file.Size > maxSize {
+	if meta.Size > maxSize {
 		return nil, fmt.Errorf("文件大小超过限制，最大允许 %d 字节", maxSize)
 	}
 
+	// 端到端加密的文件只保存密文，服务端不使用客户端提供的文件名和类型
+	if meta.EncryptedMeta != "" {
+		if err := validateEncryptedMeta(meta.EncryptedMeta); err != nil {
+			return nil, err
+		}
+		meta.Name = model.EncryptedFileName
+		meta.ContentType = model.EncryptedContentType
+	} else {
+		name, err := CleanName(meta.Name)
+		if err != nil {
+			return nil, fmt.Errorf("无效的文件名: %w", err)
+		}
+		meta.Name = name
+	}
+
+	// 客户端声明的大小不可信，读取时再次限制
+	limited := &sizeLimitReader{r: src, remaining: maxSize}
+
+	// 客户端声明的类型不可信，从上传流中读取文件头检测类型，不需要缓存整个文件
+	var content io.Reader = limited
+	claimedType := meta.ContentType
+	mismatch := false
+	if meta.EncryptedMeta == "" {
+		buffered := bufio.NewReaderSize(limited, sniffLength)
+		head, err := buffered.Peek(sniffLength)
+		if err != nil && !errors.Is(err, io.EOF) {
+			if limited.exceeded {
+				return nil, fmt.Errorf("文件大小超过限制，最大允许 %d 字节", maxSize)
+			}
+			return nil, fmt.Errorf("读取文件失败: %w", err)
+		}
+		checked, err := s.checkContentType(head, meta.Name, claimedType)
+		if err != nil {
+			return nil, err
+		}
+		meta.ContentType = checked.ContentType
+		mismatch = checked.Mismatch
+		content = buffered
+	} else {
+		claimedType = ""
+	}
+
 	// 保存文件到存储
-	storagePath, hash, err := s.Storage.Save(file)
+	result, err := s.Storage.Save(content, meta)
 	if err != nil {
+		if limited.exceeded {
+			return nil, fmt.Errorf("文件大小超过限制，最大允许 %d 字节", maxSize)
+		}
 		return nil, err
 	}
 
 	// 创建文件记录
 	fileModel := &model.File{
-		ID:          uuid.New(),
-		UserID:      userID,
-		Name:        file.Filename,
-		Size:        file.Size,
-		ContentType: file.Header.Get("Content-Type"),
-		StoragePath: storagePath,
-		Hash:        hash,
-		CreatedAt:   time.Now(),
-		UpdatedAt:   time.Now(),
-	}
-
-	// 保存到数据库
-	if err := s.DB.Create(fileModel).Error; err != nil {
+		ID:            uuid.New(),
+		UserID:        userID,
+		Name:          meta.Name,
+		Size:          result.Size,
+		ContentType:   meta.ContentType,
+		ClaimedType:   claimedType,
+		TypeMismatch:  mismatch,
+		Hash:          result.Hash,
+		Encrypted:     meta.EncryptedMeta != "",
+		EncryptedMeta: meta.EncryptedMeta,
+		ScanStatus:    s.ScanService.InitialStatus(meta.EncryptedMeta != ""),
+		CreatedAt:     time.Now(),
+		UpdatedAt:     time.Now(),
+	}
+
+	// 登记内容并保存到数据库，内容已存在时引用已有的Blob
+	reused := false
+	err = s.DB.Transaction(func(tx *gorm.DB) error {
+		blob, ok, err := acquireBlob(tx, result)
+		if err != nil {
+			return err
+		}
+		reused = ok
+		if fileModel.ScanStatus, err = inheritScanStatus(tx, blob.Hash, fileModel.ScanStatus); err != nil {
+			return err
+		}
+		fileModel.StoragePath = blob.StoragePath
+		fileModel.StorageFormat = blob.StorageFormat
+		fileModel.Backend = blob.Backend
+		fileModel.KeyID = blob.KeyID
+		fileModel.DataKey = blob.DataKey
+		return tx.Create(fileModel).Error
+	})
+	if err != nil {
 		// 如果数据库保存失败，尝试删除已上传的文件
-		_ = s.Storage.Delete(storagePath)
+		_ = s.Storage.Delete(result.Ref())
 		return nil, err
 	}
 
+	// 内容重复，删除刚写入的副本
+	if reused {
+		if err := s.Storage.Delete(result.Ref()); err != nil {
+			fmt.Printf("删除重复的存储文件失败: %v\n", err)
+		}
+	}
+
+	if fileModel.ScanStatus == model.ScanStatusPending {
+		s.ScanService.Notify()
+	}
+
 	return &FileUploadResponse{
 		ID:          fileModel.ID.String(),
 		Name:        fileModel.Name,
 		Size:        fileModel.Size,
 		ContentType: fileModel.ContentType,
 		Hash:        fileModel.Hash,
+		Encrypted:   fileModel.Encrypted,
+		ScanStatus:  fileModel.ScanStatus,
 		CreatedAt:   fileModel.CreatedAt,
 	}, nil
 }
 
+// DeleteToken 生成文件的删除凭证，持有凭证即可删除文件，用于没有账号的匿名上传
+func (s *FileService) DeleteToken(fileID string) string {
+	mac := hmac.New(sha256.New, []byte(s.AppConfig.JWTSecret))
+	mac.Write([]byte("delete:" + fileID))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// DeleteFileWithToken 使用删除凭证删除文件
+func (s *FileService) DeleteFileWithToken(fileID, token string) error {
+	if !hmac.Equal([]byte(token), []byte(s.DeleteToken(fileID))) {
+		return errors.New("文件不存在或无权限删除")
+	}
+	return s.DeleteFile(fileID, nil)
+}
+
 // GetFileByID 根据ID获取文件
 func (s *FileService) GetFileByID(id string) (*model.File, error) {
 	var file model.File
@@ -94,9 +211,33 @@ func (s *FileService) GetFileByID(id string) (*model.File, error) {
 	return &file, nil
 }
 
-// GetFileContent 获取文件内容
-func (s *FileService) GetFileContent(file *model.File) (io.ReadCloser, error) {
-	return s.Storage.Get(file.StoragePath)
+// GetFileContent 获取文件内容，文件可能位于任意已配置的存储后端（如冷存储）
+func (s *FileService) GetFileContent(file *model.File) (io.ReadSeekCloser, error) {
+	content, err := s.Storage.Get(blobRef(file))
+	if err != nil {
+		return nil, err
+	}
+
+	// 记录最近下载时间，用于冷热分层。同一文件一小时内只记录一次，不更新文件的修改时间
+	now := time.Now()
+	if file.DownloadedAt == nil || file.DownloadedAt.Before(now.Add(-time.Hour)) {
+		if err := s.DB.Model(&model.File{}).Where("id = ?", file.ID).UpdateColumn("downloaded_at", now).Error; err != nil {
+			fmt.Printf("记录下载时间失败 %s: %v\n", file.ID, err)
+		}
+	}
+	return content, nil
+}
+
+// blobRef 返回读取文件内容所需的存储引用
+func blobRef(file *model.File) filestore.BlobRef {
+	return filestore.BlobRef{
+		Path:    file.StoragePath,
+		Backend: file.Backend,
+		KeyID:   file.KeyID,
+		DataKey: file.DataKey,
+		Size:    file.Size,
+		Format:  file.StorageFormat,
+	}
 }
 
 // DeleteFile 删除文件
@@ -120,47 +261,141 @@ func (s *FileService) DeleteFile(id string, userID *uuid.UUID) error {
 	// 开始事务
 	tx := s.DB.Begin()
 
-	// 删除相关的分享记录
-	if err := tx.Where("file_id = ?", file.ID).Delete(&model.Share{}).Error; err != nil {
+	// 先锁定内容对应的Blob，与存储迁移等操作互斥，再重新读取文件记录，确保存储位置是最新的
+	if _, err := lockBlob(tx, file.Hash); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := tx.First(&file, "id = ?", file.ID).Error; err != nil {
+		tx.Rollback()
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return errors.New("文件不存在或无权限删除")
+		}
+		return err
+	}
+
+	// 删除相关的分享记录，分享包中只移除该文件
+	if err := detachFile(tx, file.ID); err != nil {
 		tx.Rollback()
 		return err
 	}
 
-	// 删除文件记录
+	// 删除文件记录和标签
+	if err := tx.Where("file_id = ?", file.ID).Delete(&model.FileTag{}).Error; err != nil {
+		tx.Rollback()
+		return err
+	}
 	if err := tx.Delete(&file).Error; err != nil {
 		tx.Rollback()
 		return err
 	}
 
+	// 释放对内容的引用，最后一个引用释放后才删除存储中的文件
+	orphan, err := releaseBlob(tx, &file)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
 	// 提交事务
 	if err := tx.Commit().Error; err != nil {
 		return err
 	}
 
 	// 删除存储中的文件
-	if err := s.Storage.Delete(file.StoragePath); err != nil {
-		// 即使删除存储文件失败，数据库事务已经提交，所以只记录错误
-		fmt.Printf("删除存储文件失败: %v\n", err)
+	if orphan != nil {
+		if err := s.Storage.Delete(*orphan); err != nil {
+			// 即使删除存储文件失败，数据库事务已经提交，所以只记录错误
+			fmt.Printf("删除存储文件失败: %v\n", err)
+		}
 	}
 
 	return nil
 }
 
+// FileFilter 文件列表的过滤条件
+type FileFilter struct {
+	Folder string   // 文件夹ID，RootFolder表示根目录，为空时不按文件夹过滤
+	Tags   []string // 只返回同时带有这些标签的文件
+}
+
 // GetUserFiles 获取用户的文件列表
-func (s *FileService) GetUserFiles(userID string, page, pageSize int) ([]model.File, int64, error) {
+func (s *FileService) GetUserFiles(userID string, filter FileFilter, page, pageSize int) ([]model.File, int64, error) {
 	var files []model.File
 	var total int64
 
+	query := s.DB.Model(&model.File{}).Where("user_id = ?", userID)
+	switch filter.Folder {
+	case "":
+	case RootFolder:
+		query = query.Where("folder_id IS NULL")
+	default:
+		if _, err := uuid.Parse(filter.Folder); err != nil {
+			return nil, 0, ErrFolderNotFound
+		}
+		var count int64
+		if err := s.DB.Model(&model.Folder{}).Where("id = ? AND user_id = ?", filter.Folder, userID).Count(&count).Error; err != nil {
+			return nil, 0, err
+		}
+		if count == 0 {
+			return nil, 0, ErrFolderNotFound
+		}
+		query = query.Where("folder_id = ?", filter.Folder)
+	}
+	if len(filter.Tags) > 0 {
+		// 标签不区分大小写，同一文件的标签不会只有大小写不同，因此匹配数等于标签数即包含全部标签
+		tags := make([]string, 0, len(filter.Tags))
+		seen := make(map[string]bool)
+		for _, tag := range filter.Tags {
+			if tag = strings.ToLower(tag); !seen[tag] {
+				seen[tag] = true
+				tags = append(tags, tag)
+			}
+		}
+		tagged := s.DB.Model(&model.FileTag{}).Select("file_id").
+			Where("user_id = ? AND LOWER(tag) IN ?", userID, tags).
+			Group("file_id").Having("COUNT(*) = ?", len(tags))
+		query = query.Where("id IN (?)", tagged)
+	}
+
 	// 计算总数
-	if err := s.DB.Model(&model.File{}).Where("user_id = ?", userID).Count(&total).Error; err != nil {
+	if err := query.Count(&total).Error; err != nil {
 		return nil, 0, err
 	}
 
 	// 分页查询
 	offset := (page - 1) * pageSize
-	if err := s.DB.Where("user_id = ?", userID).Order("created_at DESC").Offset(offset).Limit(pageSize).Find(&files).Error; err != nil {
+	if err := query.Order("created_at DESC").Offset(offset).Limit(pageSize).Find(&files).Error; err != nil {
+		return nil, 0, err
+	}
+	if err := s.WithTags(files); err != nil {
 		return nil, 0, err
 	}
 
 	return files, total, nil
 }
+
+// sizeLimitReader 限制最多读取remaining字节，超出时返回错误而不是静默截断
+type sizeLimitReader struct {
+	r         io.Reader
+	remaining int64
+	exceeded  bool
+}
+
+func (l *sizeLimitReader) Read(p []byte) (int, error) {
+	if l.remaining < 0 {
+		l.exceeded = true
+		return 0, errors.New("文件大小超过限制")
+	}
+	// 多读一个字节用于判断是否超出限制
+	if int64(len(p)) > l.remaining+1 {
+		p = p[:l.remaining+1]
+	}
+	n, err := l.r.Read(p)
+	l.remaining -= int64(n)
+	if l.remaining < 0 {
+		l.exceeded = true
+		return n, errors.New("文件大小超过限制")
+	}
+	return n, err
+}
@@ -0,0 +1,390 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/zaunist/filebox/backend/model"
+	"gorm.io/gorm"
+)
+
+// 文件夹相关错误
+var (
+	ErrFolderNotFound = errors.New("文件夹不存在")
+	ErrFolderNotEmpty = errors.New("文件夹不为空")
+	ErrFolderExists   = errors.New("同名文件夹已存在")
+	ErrPathNotFound   = errors.New("路径不存在")
+)
+
+// RootFolder 查询文件列表时表示根目录
+const RootFolder = "root"
+
+// maxFolderDepth 文件夹的最大层数，也用于查找上级文件夹时防止数据异常导致死循环
+const maxFolderDepth = 64
+
+// FolderService 文件夹服务，只有注册用户的文件可以放入文件夹
+type FolderService struct {
+	DB          *gorm.DB
+	FileService *FileService
+}
+
+// CreateFolder 创建文件夹，parentID为空时创建在根目录
+func (s *FolderService) CreateFolder(name, parentID string, userID uuid.UUID) (*model.Folder, error) {
+	name, err := CleanName(name)
+	if err != nil {
+		return nil, err
+	}
+	parent, err := s.parentFolder(parentID, userID)
+	if err != nil {
+		return nil, err
+	}
+	if parent != nil {
+		depth, err := s.depth(*parent, userID)
+		if err != nil {
+			return nil, err
+		}
+		if depth >= maxFolderDepth {
+			return nil, fmt.Errorf("文件夹最多%d层", maxFolderDepth)
+		}
+	}
+	if err := s.checkName(userID, parent, name, uuid.Nil); err != nil {
+		return nil, err
+	}
+
+	folder := &model.Folder{
+		ID:        uuid.New(),
+		UserID:    userID,
+		ParentID:  parent,
+		Name:      name,
+		CreatedAt: time.Now(),
+		UpdatedAt: time.Now(),
+	}
+	if err := s.DB.Create(folder).Error; err != nil {
+		return nil, s.folderWriteError(err)
+	}
+	return folder, nil
+}
+
+// GetFolder 获取用户的文件夹
+func (s *FolderService) GetFolder(id string, userID uuid.UUID) (*model.Folder, error) {
+	folderID, err := uuid.Parse(id)
+	if err != nil {
+		return nil, ErrFolderNotFound
+	}
+
+	var folder model.Folder
+	if err := s.DB.Where("id = ? AND user_id = ?", folderID, userID).First(&folder).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrFolderNotFound
+		}
+		return nil, err
+	}
+	return &folder, nil
+}
+
+// GetFolders 获取文件夹下的子文件夹，parentID为空时获取根目录下的文件夹
+func (s *FolderService) GetFolders(parentID string, userID uuid.UUID) ([]model.Folder, error) {
+	parent, err := s.parentFolder(parentID, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	var folders []model.Folder
+	if err := whereParent(s.DB.Where("user_id = ?", userID), parent).Order("name").Find(&folders).Error; err != nil {
+		return nil, err
+	}
+	return folders, nil
+}
+
+// GetPath 获取文件夹的完整路径，如 /文档/2024
+func (s *FolderService) GetPath(folder *model.Folder) (string, error) {
+	names := []string{folder.Name}
+	parentID := folder.ParentID
+	for parentID != nil {
+		if len(names) > maxFolderDepth {
+			return "", errors.New("文件夹层级异常")
+		}
+		var parent model.Folder
+		if err := s.DB.Where("id = ? AND user_id = ?", *parentID, folder.UserID).First(&parent).Error; err != nil {
+			return "", err
+		}
+		names = append(names, parent.Name)
+		parentID = parent.ParentID
+	}
+
+	for i, j := 0, len(names)-1; i < j; i, j = i+1, j-1 {
+		names[i], names[j] = names[j], names[i]
+	}
+	return "/" + strings.Join(names, "/"), nil
+}
+
+// RenameFolder 重命名文件夹
+func (s *FolderService) RenameFolder(id, name string, userID uuid.UUID) (*model.Folder, error) {
+	folder, err := s.GetFolder(id, userID)
+	if err != nil {
+		return nil, err
+	}
+	name, err = CleanName(name)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.checkName(userID, folder.ParentID, name, folder.ID); err != nil {
+		return nil, err
+	}
+
+	folder.Name = name
+	folder.UpdatedAt = time.Now()
+	if err := s.DB.Model(folder).Updates(map[string]interface{}{
+		"name":       folder.Name,
+		"updated_at": folder.UpdatedAt,
+	}).Error; err != nil {
+		return nil, s.folderWriteError(err)
+	}
+	return folder, nil
+}
+
+// MoveFolder 将文件夹移动到另一个文件夹下，parentID为空时移动到根目录。
+// 不能移动到自身或自己的子文件夹中
+func (s *FolderService) MoveFolder(id, parentID string, userID uuid.UUID) (*model.Folder, error) {
+	folder, err := s.GetFolder(id, userID)
+	if err != nil {
+		return nil, err
+	}
+	parent, err := s.parentFolder(parentID, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	if parent != nil {
+		// 从目标文件夹向上查找，遇到被移动的文件夹说明目标在它内部
+		depth := 0
+		for current := parent; current != nil; depth++ {
+			if *current == folder.ID {
+				return nil, errors.New("不能移动到自身或子文件夹中")
+			}
+			if depth > maxFolderDepth {
+				return nil, errors.New("文件夹层级异常")
+			}
+			var next model.Folder
+			if err := s.DB.Select("parent_id").Where("id = ? AND user_id = ?", *current, userID).First(&next).Error; err != nil {
+				return nil, err
+			}
+			current = next.ParentID
+		}
+
+		levels, err := s.levels(folder.ID, userID)
+		if err != nil {
+			return nil, err
+		}
+		if depth+len(levels) > maxFolderDepth {
+			return nil, fmt.Errorf("文件夹最多%d层", maxFolderDepth)
+		}
+	}
+	if err := s.checkName(userID, parent, folder.Name, folder.ID); err != nil {
+		return nil, err
+	}
+
+	folder.ParentID = parent
+	folder.UpdatedAt = time.Now()
+	if err := s.DB.Model(folder).Updates(map[string]interface{}{
+		"parent_id":  folder.ParentID,
+		"updated_at": folder.UpdatedAt,
+	}).Error; err != nil {
+		return nil, s.folderWriteError(err)
+	}
+	return folder, nil
+}
+
+// DeleteFolder 删除文件夹。recursive为false时只能删除空文件夹，
+// 为true时删除其中全部子文件夹和文件，文件按普通删除处理，同时删除存储中的内容和相关分享
+func (s *FolderService) DeleteFolder(id string, userID uuid.UUID, recursive bool) error {
+	folder, err := s.GetFolder(id, userID)
+	if err != nil {
+		return err
+	}
+
+	// 收集全部子文件夹
+	levels, err := s.levels(folder.ID, userID)
+	if err != nil {
+		return err
+	}
+	var folderIDs []uuid.UUID
+	for _, level := range levels {
+		folderIDs = append(folderIDs, level...)
+	}
+	if len(folderIDs) > 1 && !recursive {
+		return ErrFolderNotEmpty
+	}
+
+	var fileIDs []uuid.UUID
+	if err := s.DB.Model(&model.File{}).Where("folder_id IN ? AND user_id = ?", folderIDs, userID).
+		Pluck("id", &fileIDs).Error; err != nil {
+		return err
+	}
+	if len(fileIDs) > 0 && !recursive {
+		return ErrFolderNotEmpty
+	}
+
+	// 先删除文件，中途失败时保留文件夹，可以重新删除
+	for _, fileID := range fileIDs {
+		if err := s.FileService.DeleteFile(fileID.String(), &userID); err != nil {
+			return fmt.Errorf("删除文件 %s 失败: %w", fileID, err)
+		}
+	}
+
+	return s.DB.Where("id IN ? AND user_id = ?", folderIDs, userID).Delete(&model.Folder{}).Error
+}
+
+// MoveFile 将文件移动到文件夹，folderID为空时移动到根目录
+func (s *FolderService) MoveFile(fileID, folderID string, userID uuid.UUID) (*model.File, error) {
+	folder, err := s.parentFolder(folderID, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	var file model.File
+	if err := s.DB.Where("id = ? AND user_id = ?", fileID, userID).First(&file).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, errors.New("文件不存在或无权访问")
+		}
+		return nil, err
+	}
+
+	file.FolderID = folder
+	if err := s.DB.Model(&file).UpdateColumn("folder_id", file.FolderID).Error; err != nil {
+		return nil, err
+	}
+	return &file, nil
+}
+
+// ResolvePath 根据路径查找文件夹或文件，如 /文档/2024/报告.pdf。
+// 最后一级同时存在同名文件夹和文件时返回文件夹，同名文件有多个时返回最新上传的
+func (s *FolderService) ResolvePath(path string, userID uuid.UUID) (*model.Folder, *model.File, error) {
+	var parts []string
+	for _, part := range strings.Split(path, "/") {
+		if part != "" {
+			parts = append(parts, part)
+		}
+	}
+	if len(parts) == 0 {
+		return nil, nil, ErrPathNotFound
+	}
+
+	var parent *uuid.UUID
+	var folder *model.Folder
+	for i, part := range parts {
+		var found model.Folder
+		err := whereParent(s.DB.Where("user_id = ? AND name = ?", userID, part), parent).First(&found).Error
+		if err == nil {
+			folder = &found
+			parent = &found.ID
+			continue
+		}
+		if !errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, nil, err
+		}
+
+		// 只有最后一级可以是文件
+		if i < len(parts)-1 {
+			return nil, nil, ErrPathNotFound
+		}
+		var file model.File
+		query := s.DB.Where("user_id = ? AND name = ?", userID, part)
+		if parent == nil {
+			query = query.Where("folder_id IS NULL")
+		} else {
+			query = query.Where("folder_id = ?", *parent)
+		}
+		if err := query.Order("created_at DESC").First(&file).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return nil, nil, ErrPathNotFound
+			}
+			return nil, nil, err
+		}
+		return nil, &file, nil
+	}
+	return folder, nil, nil
+}
+
+// parentFolder 检查目标文件夹属于当前用户，id为空表示根目录，返回nil
+func (s *FolderService) parentFolder(id string, userID uuid.UUID) (*uuid.UUID, error) {
+	if id == "" || id == RootFolder {
+		return nil, nil
+	}
+	folder, err := s.GetFolder(id, userID)
+	if err != nil {
+		return nil, err
+	}
+	return &folder.ID, nil
+}
+
+// depth 返回文件夹所在的层数，根目录下的文件夹为1
+func (s *FolderService) depth(id uuid.UUID, userID uuid.UUID) (int, error) {
+	depth := 0
+	for current := &id; current != nil; depth++ {
+		if depth > maxFolderDepth {
+			return 0, errors.New("文件夹层级异常")
+		}
+		var folder model.Folder
+		if err := s.DB.Select("parent_id").Where("id = ? AND user_id = ?", *current, userID).First(&folder).Error; err != nil {
+			return 0, err
+		}
+		current = folder.ParentID
+	}
+	return depth, nil
+}
+
+// levels 按层返回文件夹及其全部子文件夹，第一层为文件夹自身
+func (s *FolderService) levels(id uuid.UUID, userID uuid.UUID) ([][]uuid.UUID, error) {
+	levels := [][]uuid.UUID{{id}}
+	for {
+		if len(levels) > maxFolderDepth {
+			return nil, errors.New("文件夹层级异常")
+		}
+		var children []uuid.UUID
+		if err := s.DB.Model(&model.Folder{}).Where("parent_id IN ? AND user_id = ?", levels[len(levels)-1], userID).
+			Pluck("id", &children).Error; err != nil {
+			return nil, err
+		}
+		if len(children) == 0 {
+			return levels, nil
+		}
+		levels = append(levels, children)
+	}
+}
+
+// checkName 检查同一文件夹下是否已有同名的文件夹，exclude为重命名或移动的文件夹自身
+func (s *FolderService) checkName(userID uuid.UUID, parent *uuid.UUID, name string, exclude uuid.UUID) error {
+	var count int64
+	query := whereParent(s.DB.Model(&model.Folder{}).Where("user_id = ? AND name = ? AND id <> ?", userID, name, exclude), parent)
+	if err := query.Count(&count).Error; err != nil {
+		return err
+	}
+	if count > 0 {
+		return ErrFolderExists
+	}
+	return nil
+}
+
+// folderWriteError 转换写入文件夹时的错误。checkName之后并发的请求可能已创建同名文件夹，由唯一索引拒绝，
+// 只在这里把数据库驱动的唯一约束错误转换为gorm.ErrDuplicatedKey
+func (s *FolderService) folderWriteError(err error) error {
+	if translator, ok := s.DB.Dialector.(gorm.ErrorTranslator); ok {
+		err = translator.Translate(err)
+	}
+	if errors.Is(err, gorm.ErrDuplicatedKey) {
+		return ErrFolderExists
+	}
+	return err
+}
+
+// whereParent 按上级文件夹过滤，parent为nil表示根目录
+func whereParent(query *gorm.DB, parent *uuid.UUID) *gorm.DB {
+	if parent == nil {
+		return query.Where("parent_id IS NULL")
+	}
+	return query.Where("parent_id = ?", *parent)
+}
@@ -0,0 +1,325 @@
+package service
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/zaunist/filebox/backend/model"
+	"gorm.io/gorm"
+)
+
+const (
+	// instantProofRanges 秒传时要求客户端证明持有的随机区间数量
+	instantProofRanges = 4
+	// instantProofRangeSize 每个区间的最大长度
+	instantProofRangeSize = 4096
+	// instantChallengeTTL 秒传挑战的有效期
+	instantChallengeTTL = 5 * time.Minute
+	// instantNonceSize 挑战随机数的长度
+	instantNonceSize = 32
+)
+
+// ByteRange 文件内容中的一段区间
+type ByteRange struct {
+	Offset int64 `json:"offset"`
+	Length int64 `json:"length"`
+}
+
+// InstantCheckRequest 秒传预检请求
+type InstantCheckRequest struct {
+	Hash string `json:"hash"`
+	Size int64  `json:"size"`
+}
+
+// InstantCheckResponse 秒传预检响应。内容已存在时返回挑战，客户端需要对每个区间
+// 计算 SHA-256(nonce解码后的字节 ‖ 区间内容) 后连同token一起提交
+type InstantCheckResponse struct {
+	Exists    bool        `json:"exists"`
+	Token     string      `json:"token,omitempty"`
+	Nonce     string      `json:"nonce,omitempty"`
+	Ranges    []ByteRange `json:"ranges,omitempty"`
+	ExpiresAt *time.Time  `json:"expires_at,omitempty"`
+}
+
+// InstantUploadRequest 秒传请求
+type InstantUploadRequest struct {
+	Token       string   `json:"token"`
+	Name        string   `json:"name"`
+	ContentType string   `json:"content_type"`
+	Proofs      []string `json:"proofs"`
+}
+
+// instantChallenge 秒传挑战内容，由服务端签名后交给客户端，提交时原样带回
+type instantChallenge struct {
+	UserID    string      `json:"u"`
+	Hash      string      `json:"h"`
+	Size      int64       `json:"s"`
+	Nonce     string      `json:"n"`
+	Ranges    []ByteRange `json:"r"`
+	ExpiresAt int64       `json:"e"`
+}
+
+// CheckInstantUpload 检查内容是否已存在。存在时生成由服务端随机选择区间和随机数的挑战，
+// 客户端只有真正持有文件内容才能给出这些区间加上随机数后的哈希。小文件的区间就是整个文件，
+// 随机数保证证明不会等于公开的内容哈希，仅凭哈希值无法获取他人的文件
+func (s *FileService) CheckInstantUpload(req InstantCheckRequest, userID uuid.UUID) (*InstantCheckResponse, error) {
+	req.Hash = strings.ToLower(req.Hash)
+	if _, err := hex.DecodeString(req.Hash); err != nil || len(req.Hash) != sha256.Size*2 {
+		return nil, errors.New("无效的文件哈希")
+	}
+	if req.Size < 0 {
+		return nil, errors.New("无效的文件大小")
+	}
+	if req.Size > s.AppConfig.MaxFileSize {
+		return nil, fmt.Errorf("文件大小超过限制，最大允许 %d 字节", s.AppConfig.MaxFileSize)
+	}
+
+	var blob model.Blob
+	err := s.DB.Where("hash = ? AND size = ? AND ref_count > 0", req.Hash, req.Size).First(&blob).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return &InstantCheckResponse{Exists: false}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	// 端到端加密文件的哈希是密文的哈希，秒传得到的普通文件下载时只有密文，按内容不存在处理
+	encrypted, err := encryptedContent(s.DB, blob.Hash)
+	if err != nil {
+		return nil, err
+	}
+	if encrypted {
+		return &InstantCheckResponse{Exists: false}, nil
+	}
+
+	ranges, err := randomRanges(req.Size)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, instantNonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("生成挑战失败: %w", err)
+	}
+
+	expiresAt := time.Now().Add(instantChallengeTTL)
+	token, err := s.signChallenge(&instantChallenge{
+		UserID:    userID.String(),
+		Hash:      req.Hash,
+		Size:      req.Size,
+		Nonce:     hex.EncodeToString(nonce),
+		Ranges:    ranges,
+		ExpiresAt: expiresAt.Unix(),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &InstantCheckResponse{
+		Exists:    true,
+		Token:     token,
+		Nonce:     hex.EncodeToString(nonce),
+		Ranges:    ranges,
+		ExpiresAt: &expiresAt,
+	}, nil
+}
+
+// InstantUpload 校验持有证明后创建引用已有内容的文件记录，不需要再传输文件内容
+func (s *FileService) InstantUpload(req InstantUploadRequest, userID uuid.UUID) (*FileUploadResponse, error) {
+	name, err := CleanName(req.Name)
+	if err != nil {
+		return nil, fmt.Errorf("无效的文件名: %w", err)
+	}
+	req.Name = name
+
+	challenge, err := s.parseChallenge(req.Token)
+	if err != nil {
+		return nil, err
+	}
+	if challenge.UserID != userID.String() {
+		return nil, errors.New("无效的秒传凭证")
+	}
+	if len(req.Proofs) != len(challenge.Ranges) {
+		return nil, errors.New("持有证明校验失败")
+	}
+
+	var blob model.Blob
+	if err := s.DB.First(&blob, "hash = ?", challenge.Hash).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, errors.New("文件内容不存在，请重新上传")
+		}
+		return nil, err
+	}
+
+	nonce, err := hex.DecodeString(challenge.Nonce)
+	if err != nil || len(nonce) != instantNonceSize {
+		return nil, errors.New("无效的秒传凭证")
+	}
+	if err := s.verifyProofs(&blob, nonce, challenge.Ranges, req.Proofs); err != nil {
+		return nil, err
+	}
+
+	head, err := readHead(s.Storage, blobRefOf(&blob))
+	if err != nil {
+		return nil, err
+	}
+	checked, err := s.checkContentType(head, req.Name, req.ContentType)
+	if err != nil {
+		return nil, err
+	}
+
+	fileModel := &model.File{
+		ID:           uuid.New(),
+		UserID:       &userID,
+		Name:         req.Name,
+		Size:         blob.Size,
+		ContentType:  checked.ContentType,
+		ClaimedType:  req.ContentType,
+		TypeMismatch: checked.Mismatch,
+		Hash:         blob.Hash,
+		ScanStatus:   s.ScanService.InitialStatus(false),
+		CreatedAt:    time.Now(),
+		UpdatedAt:    time.Now(),
+	}
+
+	// 校验期间内容可能已被删除，引用失败时要求客户端重新上传
+	err = s.DB.Transaction(func(tx *gorm.DB) error {
+		current, err := referenceBlob(tx, blob.Hash)
+		if err != nil {
+			return err
+		}
+		encrypted, err := encryptedContent(tx, blob.Hash)
+		if err != nil {
+			return err
+		}
+		if current == nil || encrypted {
+			return errors.New("文件内容不存在，请重新上传")
+		}
+		if fileModel.ScanStatus, err = inheritScanStatus(tx, current.Hash, fileModel.ScanStatus); err != nil {
+			return err
+		}
+		fileModel.StoragePath = current.StoragePath
+		fileModel.StorageFormat = current.StorageFormat
+		fileModel.Backend = current.Backend
+		fileModel.KeyID = current.KeyID
+		fileModel.DataKey = current.DataKey
+		return tx.Create(fileModel).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	if fileModel.ScanStatus == model.ScanStatusPending {
+		s.ScanService.Notify()
+	}
+
+	return &FileUploadResponse{
+		ID:          fileModel.ID.String(),
+		Name:        fileModel.Name,
+		Size:        fileModel.Size,
+		ContentType: fileModel.ContentType,
+		Hash:        fileModel.Hash,
+		ScanStatus:  fileModel.ScanStatus,
+		CreatedAt:   fileModel.CreatedAt,
+	}, nil
+}
+
+// encryptedContent 判断内容是否被端到端加密的文件引用
+func encryptedContent(tx *gorm.DB, hash string) (bool, error) {
+	var count int64
+	if err := tx.Model(&model.File{}).Where("hash = ? AND encrypted = ?", hash, true).Count(&count).Error; err != nil {
+		return false, err
+	}
+	return count > 0, nil
+}
+
+// verifyProofs 读取挑战区间的内容，计算随机数加区间内容的哈希并与客户端提交的证明比较
+func (s *FileService) verifyProofs(blob *model.Blob, nonce []byte, ranges []ByteRange, proofs []string) error {
+	content, err := s.Storage.Get(blobRefOf(blob))
+	if err != nil {
+		return err
+	}
+	defer content.Close()
+
+	for i, r := range ranges {
+		if _, err := content.Seek(r.Offset, io.SeekStart); err != nil {
+			return err
+		}
+		h := sha256.New()
+		h.Write(nonce)
+		if _, err := io.CopyN(h, content, r.Length); err != nil {
+			return fmt.Errorf("读取文件内容失败: %w", err)
+		}
+		expected := hex.EncodeToString(h.Sum(nil))
+		if !hmac.Equal([]byte(expected), []byte(strings.ToLower(proofs[i]))) {
+			return errors.New("持有证明校验失败")
+		}
+	}
+	return nil
+}
+
+// randomRanges 在文件内容中随机选择挑战区间，小文件直接使用整个文件（证明中的随机数保证其不等于内容哈希）
+func randomRanges(size int64) ([]ByteRange, error) {
+	if size == 0 {
+		return []ByteRange{}, nil
+	}
+	if size <= instantProofRangeSize {
+		return []ByteRange{{Offset: 0, Length: size}}, nil
+	}
+
+	ranges := make([]ByteRange, 0, instantProofRanges)
+	max := big.NewInt(size - instantProofRangeSize + 1)
+	for i := 0; i < instantProofRanges; i++ {
+		offset, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return nil, fmt.Errorf("生成挑战失败: %w", err)
+		}
+		ranges = append(ranges, ByteRange{Offset: offset.Int64(), Length: instantProofRangeSize})
+	}
+	return ranges, nil
+}
+
+// signChallenge 对挑战签名，挑战无需保存在服务端，多实例部署时同样可用
+func (s *FileService) signChallenge(challenge *instantChallenge) (string, error) {
+	payload, err := json.Marshal(challenge)
+	if err != nil {
+		return "", err
+	}
+	encoded := base64.RawURLEncoding.EncodeToString(payload)
+	return encoded + "." + s.challengeMAC(encoded), nil
+}
+
+// parseChallenge 校验签名和有效期并解析挑战
+func (s *FileService) parseChallenge(token string) (*instantChallenge, error) {
+	encoded, mac, ok := strings.Cut(token, ".")
+	if !ok || !hmac.Equal([]byte(mac), []byte(s.challengeMAC(encoded))) {
+		return nil, errors.New("无效的秒传凭证")
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, errors.New("无效的秒传凭证")
+	}
+	var challenge instantChallenge
+	if err := json.Unmarshal(payload, &challenge); err != nil {
+		return nil, errors.New("无效的秒传凭证")
+	}
+	if time.Now().Unix() > challenge.ExpiresAt {
+		return nil, errors.New("秒传凭证已过期，请重新检查")
+	}
+	return &challenge, nil
+}
+
+func (s *FileService) challengeMAC(encoded string) string {
+	mac := hmac.New(sha256.New, []byte(s.AppConfig.JWTSecret))
+	mac.Write([]byte("instant:" + encoded))
+	return hex.EncodeToString(mac.Sum(nil))
+}
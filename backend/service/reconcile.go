@@ -0,0 +1,181 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/zaunist/filebox/backend/filestore"
+	"github.com/zaunist/filebox/backend/model"
+)
+
+// 孤立对象的处理方式
+const (
+	OrphanActionQuarantine = "quarantine" // 移动到隔离区，确认无误后可手动删除
+	OrphanActionDelete     = "delete"     // 直接删除
+)
+
+// ReconcileOptions 存储核对选项
+type ReconcileOptions struct {
+	DryRun bool
+	Action string
+	// MinAge 只处理早于该时长之前写入的对象，避免误删正在上传、尚未写入数据库记录的文件
+	MinAge time.Duration
+}
+
+// ReconcileReport 存储核对结果
+type ReconcileReport struct {
+	Objects       int   `json:"objects"`
+	OrphanObjects int   `json:"orphan_objects"`
+	OrphanBytes   int64 `json:"orphan_bytes"`
+	Recent        int   `json:"recent"`
+	Quarantined   int   `json:"quarantined"`
+	Deleted       int   `json:"deleted"`
+	Failed        int   `json:"failed"`
+	MissingFiles  int   `json:"missing_files"`
+	MissingBlobs  int   `json:"missing_blobs"`
+}
+
+// Reconcile 核对存储中的对象与数据库记录。
+// 没有任何文件记录或Blob引用的对象视为孤立对象，按opts.Action隔离或删除；
+// 存储中找不到对象的文件记录标记为丢失，Blob记录只报告。dryRun为true时只统计不处理
+func (s *StorageService) Reconcile(opts ReconcileOptions) (*ReconcileReport, error) {
+	reconciler, ok := s.Storage.(filestore.Reconciler)
+	if !ok {
+		return nil, errors.New("当前存储不支持核对")
+	}
+	if opts.Action != OrphanActionQuarantine && opts.Action != OrphanActionDelete {
+		return nil, fmt.Errorf("未知的处理方式: %s", opts.Action)
+	}
+
+	// 先列出对象再读取数据库引用，列出后才写入的新文件不会被误判为孤立对象
+	report := &ReconcileReport{}
+	listedAt := time.Now()
+	objects := make(map[string]filestore.ObjectInfo)
+	if err := reconciler.List(func(obj filestore.ObjectInfo) error {
+		objects[obj.Path] = obj
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	report.Objects = len(objects)
+
+	// 只核对当前写入的后端，其他后端中的文件记录不在核对范围内
+	backend := reconciler.PrimaryBackend()
+	var filePaths, blobPaths []string
+	if err := s.DB.Model(&model.File{}).Where("backend = ?", backend).Distinct("storage_path").Pluck("storage_path", &filePaths).Error; err != nil {
+		return nil, err
+	}
+	if err := s.DB.Model(&model.Blob{}).Where("backend = ?", backend).Pluck("storage_path", &blobPaths).Error; err != nil {
+		return nil, err
+	}
+
+	referenced := make(map[string]bool, len(filePaths)+len(blobPaths))
+	for _, p := range filePaths {
+		referenced[p] = true
+	}
+	for _, p := range blobPaths {
+		referenced[p] = true
+	}
+
+	// 没有记录的对象
+	cutoff := time.Now().Add(-opts.MinAge)
+	for p, obj := range objects {
+		if referenced[p] {
+			continue
+		}
+		if obj.ModTime.After(cutoff) {
+			report.Recent++
+			continue
+		}
+		// 读取引用后可能有迁移等任务把记录指向了该对象，处理前再确认一次
+		inUse, err := isReferenced(s.DB, p, backend)
+		if err != nil {
+			log.Printf("检查文件引用失败 %s: %v", p, err)
+			report.Failed++
+			continue
+		}
+		if inUse {
+			continue
+		}
+
+		report.OrphanObjects++
+		report.OrphanBytes += obj.Size
+		if opts.DryRun {
+			log.Printf("孤立对象: %s (%d字节)", p, obj.Size)
+			continue
+		}
+		s.handleOrphan(reconciler, filestore.BlobRef{Path: p, Backend: backend}, opts.Action, report)
+	}
+
+	// 没有对象的记录，列出对象之后才写入或修改的记录不在核对范围内
+	for _, p := range filePaths {
+		if _, ok := objects[p]; ok || quarantined(p) {
+			continue
+		}
+		var files []model.File
+		if err := s.DB.Where("storage_path = ? AND backend = ? AND updated_at < ?", p, backend, listedAt).Find(&files).Error; err != nil {
+			return report, err
+		}
+		if len(files) == 0 {
+			continue
+		}
+		for _, file := range files {
+			log.Printf("文件内容丢失: %s %s (%s)", file.ID, file.Name, p)
+		}
+		report.MissingFiles += len(files)
+		if opts.DryRun {
+			continue
+		}
+		if err := s.DB.Model(&model.File{}).Where("storage_path = ? AND backend = ? AND updated_at < ?", p, backend, listedAt).UpdateColumns(map[string]interface{}{
+			"verified_at":   time.Now(),
+			"verify_status": model.VerifyStatusMissing,
+			"verify_error":  filestore.ErrNotFound.Error(),
+		}).Error; err != nil {
+			return report, err
+		}
+	}
+	var blobs []model.Blob
+	if err := s.DB.Where("backend = ? AND updated_at < ?", backend, listedAt).Find(&blobs).Error; err != nil {
+		return report, err
+	}
+	for _, blob := range blobs {
+		if _, ok := objects[blob.StoragePath]; !ok && !quarantined(blob.StoragePath) {
+			log.Printf("Blob内容丢失: %s (%s)", blob.Hash, blob.StoragePath)
+			report.MissingBlobs++
+		}
+	}
+
+	return report, nil
+}
+
+// quarantined 判断路径是否位于隔离区，隔离区中的对象不在核对范围内
+func quarantined(p string) bool {
+	return strings.HasPrefix(p, filestore.QuarantinePrefix+"/")
+}
+
+// handleOrphan 隔离或删除孤立对象
+func (s *StorageService) handleOrphan(reconciler filestore.Reconciler, ref filestore.BlobRef, action string, report *ReconcileReport) {
+	p := ref.Path
+	switch action {
+	case OrphanActionQuarantine:
+		dst, err := reconciler.Quarantine(p)
+		if err != nil {
+			log.Printf("隔离孤立对象失败 %s: %v", p, err)
+			report.Failed++
+			return
+		}
+		log.Printf("已隔离孤立对象: %s -> %s", p, dst)
+		report.Quarantined++
+	case OrphanActionDelete:
+		if err := s.Storage.Delete(ref); err != nil {
+			log.Printf("删除孤立对象失败 %s: %v", p, err)
+			report.Failed++
+			return
+		}
+		log.Printf("已删除孤立对象: %s", p)
+		report.Deleted++
+	}
+}
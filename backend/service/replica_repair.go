@@ -0,0 +1,47 @@
+package service
+
+import (
+	"errors"
+	"log"
+	"time"
+
+	"github.com/zaunist/filebox/backend/filestore"
+)
+
+// RepairReplicas 补齐镜像存储中缺失的副本，并删除之前因副本不可用而未删除的对象
+func (s *StorageService) RepairReplicas(opts filestore.RepairOptions) (*filestore.RepairReport, error) {
+	storage, ok := s.Storage.(*filestore.EncryptedStorage)
+	if !ok {
+		return nil, errors.New("当前存储未配置镜像副本")
+	}
+	mirror, ok := storage.Backend.(*filestore.MirrorBackend)
+	if !ok {
+		return nil, errors.New("当前存储未配置镜像副本")
+	}
+	return mirror.Repair(opts)
+}
+
+// StartReplicaRepair 启动定期副本修复，磁盘恢复后自动补齐期间缺失的副本
+func (s *StorageService) StartReplicaRepair(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			report, err := s.RepairReplicas(filestore.RepairOptions{})
+			logRepairReport(report, err)
+			<-ticker.C
+		}
+	}()
+}
+
+// logRepairReport 记录副本修复结果
+func logRepairReport(report *filestore.RepairReport, err error) {
+	if err != nil {
+		log.Printf("副本修复失败: %v", err)
+		return
+	}
+	if report.Copied > 0 || report.Deleted > 0 || report.Failed > 0 || report.Lost > 0 || len(report.Unavailable) > 0 {
+		log.Printf("副本修复完成: 共%d个对象，补齐%d个副本，删除%d个，失败%d个，丢失%d个，不可用的副本: %v",
+			report.Objects, report.Copied, report.Deleted, report.Failed, report.Lost, report.Unavailable)
+	}
+}
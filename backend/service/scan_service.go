@@ -0,0 +1,395 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/zaunist/filebox/backend/filestore"
+	"github.com/zaunist/filebox/backend/model"
+	"github.com/zaunist/filebox/backend/scanner"
+	"gorm.io/gorm"
+)
+
+var (
+	// ErrScanPending 文件尚未完成恶意软件扫描
+	ErrScanPending = errors.New("文件正在进行安全扫描，请稍后再试")
+	// ErrScanBlocked 文件未通过恶意软件扫描
+	ErrScanBlocked = errors.New("文件未通过安全扫描，无法下载")
+	// ErrContentQuarantined 内容与发现威胁而被隔离的文件相同，不能通过去重或秒传复用
+	ErrContentQuarantined = errors.New("文件内容未通过安全扫描，无法上传")
+)
+
+// reviewStatuses 需要管理员检查的扫描状态
+var reviewStatuses = []string{model.ScanStatusInfected, model.ScanStatusFailed}
+
+// ScanService 恶意软件扫描服务。启用后新上传的文件进入待扫描状态，由后台任务读取内容交给扫描器，
+// 扫描完成前不能通过分享下载，发现威胁的文件移到隔离区等待管理员放行或删除
+type ScanService struct {
+	DB          *gorm.DB
+	Storage     filestore.FileStorage
+	Scanner     scanner.Scanner // 为nil表示未启用扫描
+	FileService *FileService
+
+	wakeOnce sync.Once
+	wake     chan struct{}
+}
+
+// ScanReport 一轮扫描的结果统计
+type ScanReport struct {
+	Total    int `json:"total"`
+	Clean    int `json:"clean"`
+	Infected int `json:"infected"`
+	Failed   int `json:"failed"`
+}
+
+// scanOutcome 单个存储对象的扫描结果
+type scanOutcome struct {
+	status string
+	detail string
+}
+
+// Enabled 是否启用了恶意软件扫描
+func (s *ScanService) Enabled() bool {
+	return s != nil && s.Scanner != nil
+}
+
+// InitialStatus 返回新上传文件的扫描状态。端到端加密的文件服务端只有密文，无法扫描。
+// 复用已有内容时还要经过inheritScanStatus
+func (s *ScanService) InitialStatus(encrypted bool) string {
+	if !s.Enabled() || encrypted {
+		return ""
+	}
+	return model.ScanStatusPending
+}
+
+// scanSeverity 扫描状态的严重程度，复用已有内容的文件沿用其中最严重的状态
+var scanSeverity = map[string]int{
+	model.ScanStatusPending:  1,
+	model.ScanStatusFailed:   2,
+	model.ScanStatusInfected: 3,
+}
+
+// inheritScanStatus 返回复用hash对应内容的新文件的扫描状态，status为新文件本身的初始状态。
+// 相同内容的已有文件状态更严重时（等待扫描、无法扫描）沿用该状态，内容已被隔离时返回ErrContentQuarantined。
+// 未启用扫描时同样检查，避免通过去重或秒传得到未扫描或已隔离内容的可下载副本
+func inheritScanStatus(tx *gorm.DB, hash, status string) (string, error) {
+	var statuses []string
+	if err := tx.Model(&model.File{}).Where("hash = ?", hash).Distinct().Pluck("scan_status", &statuses).Error; err != nil {
+		return "", err
+	}
+	for _, existing := range statuses {
+		if existing == model.ScanStatusInfected {
+			return "", ErrContentQuarantined
+		}
+		if scanSeverity[existing] > scanSeverity[status] {
+			status = existing
+		}
+	}
+	return status, nil
+}
+
+// Notify 通知后台任务有新的待扫描文件
+func (s *ScanService) Notify() {
+	select {
+	case s.wakeup() <- struct{}{}:
+	default:
+	}
+}
+
+// wakeup 返回唤醒后台任务的通道
+func (s *ScanService) wakeup() chan struct{} {
+	s.wakeOnce.Do(func() {
+		s.wake = make(chan struct{}, 1)
+	})
+	return s.wake
+}
+
+// Start 启动后台扫描任务，有新上传的文件时立即扫描，扫描器不可用时每隔interval重试
+func (s *ScanService) Start(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			report, err := s.Run()
+			logScanReport(report, err)
+			select {
+			case <-ticker.C:
+			case <-s.wakeup():
+			}
+		}
+	}()
+}
+
+// Run 扫描所有待扫描的文件。扫描器或存储暂时不可用时停止并返回错误，剩余的文件留待下次扫描
+func (s *ScanService) Run() (*ScanReport, error) {
+	report := &ScanReport{}
+	// 内容相同的文件只扫描一次
+	results := make(map[string]scanOutcome)
+	for {
+		var files []model.File
+		if err := s.DB.Where("scan_status = ?", model.ScanStatusPending).
+			Order("created_at").Limit(100).Find(&files).Error; err != nil {
+			return report, err
+		}
+		if len(files) == 0 {
+			return report, nil
+		}
+
+		for i := range files {
+			file := &files[i]
+			res, ok := results[file.Hash]
+			if !ok {
+				var err error
+				if res, err = s.scan(file); err != nil {
+					return report, err
+				}
+				results[file.Hash] = res
+			}
+
+			if err := s.record(file, res); err != nil {
+				return report, err
+			}
+			report.Total++
+			switch res.status {
+			case model.ScanStatusClean:
+				report.Clean++
+			case model.ScanStatusInfected:
+				report.Infected++
+			default:
+				report.Failed++
+			}
+		}
+	}
+}
+
+// scan 读取并扫描文件内容。返回错误表示暂时无法扫描，文件保持待扫描状态
+func (s *ScanService) scan(file *model.File) (scanOutcome, error) {
+	content, err := s.Storage.Get(blobRef(file))
+	if err != nil {
+		if errors.Is(err, filestore.ErrNotFound) {
+			return scanOutcome{status: model.ScanStatusFailed, detail: err.Error()}, nil
+		}
+		return scanOutcome{}, fmt.Errorf("读取文件失败 %s: %w", file.ID, err)
+	}
+	defer content.Close()
+
+	result, err := s.Scanner.Scan(content)
+	switch {
+	case errors.Is(err, scanner.ErrRejected), errors.Is(err, filestore.ErrCorrupted):
+		return scanOutcome{status: model.ScanStatusFailed, detail: err.Error()}, nil
+	case err != nil:
+		return scanOutcome{}, fmt.Errorf("扫描文件失败 %s: %w", file.ID, err)
+	case result.Infected:
+		return scanOutcome{status: model.ScanStatusInfected, detail: result.Signature}, nil
+	}
+	return scanOutcome{status: model.ScanStatusClean}, nil
+}
+
+// record 保存文件的扫描结果，发现威胁时隔离文件内容
+func (s *ScanService) record(file *model.File, res scanOutcome) error {
+	if res.status == model.ScanStatusInfected {
+		return s.quarantine(file, res.detail)
+	}
+	return s.DB.Model(&model.File{}).
+		Where("id = ? AND scan_status = ?", file.ID, model.ScanStatusPending).
+		UpdateColumns(scanColumns(res.status, res.detail)).Error
+}
+
+// quarantine 将发现威胁的文件内容移到隔离区，引用同一对象的文件记录指向隔离区中的路径，
+// 内容相同且未被管理员放行的文件都标记为发现威胁。
+// 只能隔离当前写入的存储后端中的对象，其他后端中的文件只标记状态，同样不能下载
+func (s *ScanService) quarantine(file *model.File, signature string) error {
+	// 同一内容的其他待扫描文件已随第一个文件一起处理
+	var current model.File
+	if err := s.DB.Select("scan_status").First(&current, "id = ?", file.ID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil
+		}
+		return err
+	}
+	if current.ScanStatus != model.ScanStatusPending {
+		return nil
+	}
+
+	// 管理员检查后放行过相同的内容时沿用放行结果
+	var released int64
+	if err := s.DB.Model(&model.File{}).Where("hash = ? AND scan_status = ?", file.Hash, model.ScanStatusReleased).
+		Count(&released).Error; err != nil {
+		return err
+	}
+	if released > 0 {
+		return s.DB.Model(&model.File{}).Where("id = ?", file.ID).
+			UpdateColumns(scanColumns(model.ScanStatusReleased, signature)).Error
+	}
+
+	reconciler, _ := s.Storage.(filestore.Reconciler)
+	moved := ""
+	if reconciler != nil && file.Backend == reconciler.PrimaryBackend() && !quarantined(file.StoragePath) {
+		dst, err := reconciler.Quarantine(file.StoragePath)
+		if err != nil {
+			log.Printf("隔离文件失败 %s: %v", file.ID, err)
+		} else {
+			moved = dst
+		}
+	}
+
+	err := s.DB.Transaction(func(tx *gorm.DB) error {
+		if moved != "" {
+			dst := blobRef(file)
+			dst.Path = moved
+			if _, err := repoint(tx, blobRef(file), file.Hash, dst); err != nil {
+				return err
+			}
+		}
+		return tx.Model(&model.File{}).
+			Where("hash = ? AND scan_status IN ?", file.Hash, []string{"", model.ScanStatusPending, model.ScanStatusClean}).
+			UpdateColumns(scanColumns(model.ScanStatusInfected, signature)).Error
+	})
+	if err != nil && moved != "" {
+		// 文件记录未更新，把对象移回原路径，避免记录指向不存在的对象
+		if _, restoreErr := reconciler.Restore(moved); restoreErr != nil {
+			log.Printf("恢复隔离的文件失败 %s: %v", moved, restoreErr)
+		}
+	}
+	if err == nil {
+		log.Printf("文件发现威胁，已隔离: %s %s (%s)", file.ID, file.Name, signature)
+	}
+	return err
+}
+
+// scanColumns 返回保存扫描结果需要更新的字段，不更新文件的修改时间
+func scanColumns(status, detail string) map[string]interface{} {
+	if len(detail) > 255 {
+		detail = strings.ToValidUTF8(detail[:255], "")
+	}
+	return map[string]interface{}{
+		"scan_status": status,
+		"scan_result": detail,
+		"scanned_at":  time.Now(),
+	}
+}
+
+// GetQuarantinedFiles 获取发现威胁或无法扫描、需要管理员检查的文件
+func (s *ScanService) GetQuarantinedFiles(page, pageSize int) ([]model.File, int64, error) {
+	var files []model.File
+	var total int64
+
+	query := s.DB.Model(&model.File{}).Where("scan_status IN ?", reviewStatuses)
+	if err := query.Count(&total).Error; err != nil {
+		return nil, 0, err
+	}
+
+	offset := (page - 1) * pageSize
+	if err := query.Order("scanned_at DESC").Offset(offset).Limit(pageSize).Find(&files).Error; err != nil {
+		return nil, 0, err
+	}
+
+	return files, total, nil
+}
+
+// Release 管理员检查后放行文件，内容相同的文件一并放行，隔离区中的对象移回原路径。
+// 也可以放行停用扫描器后无法完成扫描的待扫描文件。返回放行的文件数
+func (s *ScanService) Release(id string) (int64, error) {
+	statuses := append([]string{model.ScanStatusPending}, reviewStatuses...)
+	file, err := s.reviewFile(id, statuses)
+	if err != nil {
+		return 0, err
+	}
+
+	if quarantined(file.StoragePath) {
+		reconciler, ok := s.Storage.(filestore.Reconciler)
+		if !ok || file.Backend != reconciler.PrimaryBackend() {
+			return 0, errors.New("隔离的文件不在当前存储后端中，无法恢复")
+		}
+		restored, err := reconciler.Restore(file.StoragePath)
+		if err != nil {
+			return 0, fmt.Errorf("恢复文件失败: %w", err)
+		}
+		dst := blobRef(file)
+		dst.Path = restored
+		if err := s.DB.Transaction(func(tx *gorm.DB) error {
+			_, err := repoint(tx, blobRef(file), file.Hash, dst)
+			return err
+		}); err != nil {
+			log.Printf("文件已恢复到 %s，但更新文件记录失败: %v", restored, err)
+			return 0, err
+		}
+	}
+
+	result := s.DB.Model(&model.File{}).
+		Where("hash = ? AND scan_status IN ?", file.Hash, statuses).
+		UpdateColumn("scan_status", model.ScanStatusReleased)
+	if result.Error != nil {
+		return 0, result.Error
+	}
+	log.Printf("管理员放行文件: %s %s (%s)", file.ID, file.Name, file.ScanResult)
+	return result.RowsAffected, nil
+}
+
+// Purge 删除被隔离或无法扫描的文件及其分享，内容相同的文件一并删除，
+// 最后一个引用删除后存储中的对象随之删除。返回删除的文件数
+func (s *ScanService) Purge(id string) (int64, error) {
+	file, err := s.reviewFile(id, reviewStatuses)
+	if err != nil {
+		return 0, err
+	}
+
+	var ids []string
+	if err := s.DB.Model(&model.File{}).Where("hash = ? AND scan_status IN ?", file.Hash, reviewStatuses).
+		Pluck("id", &ids).Error; err != nil {
+		return 0, err
+	}
+
+	var purged int64
+	for _, fileID := range ids {
+		if err := s.FileService.DeleteFile(fileID, nil); err != nil {
+			return purged, err
+		}
+		purged++
+	}
+	log.Printf("管理员删除隔离的文件: %s %s (%s)，共%d个文件", file.ID, file.Name, file.ScanResult, purged)
+	return purged, nil
+}
+
+// reviewFile 查找扫描状态为statuses之一的文件
+func (s *ScanService) reviewFile(id string, statuses []string) (*model.File, error) {
+	var file model.File
+	if err := s.DB.First(&file, "id = ?", id).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, errors.New("文件不存在")
+		}
+		return nil, err
+	}
+	for _, status := range statuses {
+		if file.ScanStatus == status {
+			return &file, nil
+		}
+	}
+	return nil, errors.New("文件未被隔离")
+}
+
+// CheckScanStatus 检查文件能否分享给他人下载，未完成扫描或未通过扫描的文件不能下载
+func CheckScanStatus(file *model.File) error {
+	switch file.ScanStatus {
+	case model.ScanStatusPending:
+		return ErrScanPending
+	case model.ScanStatusInfected, model.ScanStatusFailed:
+		return ErrScanBlocked
+	}
+	return nil
+}
+
+// logScanReport 记录扫描结果
+func logScanReport(report *ScanReport, err error) {
+	if err != nil {
+		log.Printf("恶意软件扫描中断，稍后重试: %v", err)
+	}
+	if report != nil && report.Total > 0 {
+		log.Printf("恶意软件扫描完成: 共%d个文件，未发现威胁%d个，发现威胁%d个，无法扫描%d个",
+			report.Total, report.Clean, report.Infected, report.Failed)
+	}
+}
@@ -0,0 +1,251 @@
+package service
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/zaunist/filebox/backend/filestore"
+	"github.com/zaunist/filebox/backend/model"
+	"gorm.io/gorm"
+)
+
+// ErrScrubRunning 已有校验任务正在执行
+var ErrScrubRunning = errors.New("完整性校验正在进行中")
+
+// ScrubService 存储完整性校验服务。逐个解密存储中的文件并重新计算SHA-256，
+// 与写入时记录的哈希比较，在接收者下载之前发现损坏或丢失的文件
+type ScrubService struct {
+	DB      *gorm.DB
+	Storage filestore.FileStorage
+
+	mu      sync.Mutex
+	running bool
+	last    *ScrubReport
+}
+
+// ScrubReport 校验结果统计
+type ScrubReport struct {
+	Total      int        `json:"total"`
+	OK         int        `json:"ok"`
+	Corrupted  int        `json:"corrupted"`
+	Missing    int        `json:"missing"`
+	Errors     int        `json:"errors"`
+	StartedAt  time.Time  `json:"started_at"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+}
+
+// ScrubStatus 校验任务状态
+type ScrubStatus struct {
+	Running bool         `json:"running"`
+	Last    *ScrubReport `json:"last,omitempty"`
+}
+
+// verifyResult 单个存储对象的校验结果
+type verifyResult struct {
+	status string
+	detail string
+}
+
+// Run 校验最近一次校验时间早于olderThan（或从未校验过）的所有文件。
+// 按文件ID分批处理，中断后再次执行会跳过已校验的文件
+func (s *ScrubService) Run(olderThan time.Time) (*ScrubReport, error) {
+	report, err := s.begin()
+	if err != nil {
+		return nil, err
+	}
+	defer s.end(report)
+
+	return report, s.scan(report, olderThan)
+}
+
+// Start 在后台执行一次全量校验
+func (s *ScrubService) Start() error {
+	report, err := s.begin()
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		defer s.end(report)
+		err := s.scan(report, report.StartedAt)
+		logScrubReport(report, err)
+	}()
+	return nil
+}
+
+// begin 标记校验任务开始，已有任务在执行时返回ErrScrubRunning
+func (s *ScrubService) begin() (*ScrubReport, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.running {
+		return nil, ErrScrubRunning
+	}
+	s.running = true
+	s.last = &ScrubReport{StartedAt: time.Now()}
+	return s.last, nil
+}
+
+// end 标记校验任务结束
+func (s *ScrubService) end(report *ScrubReport) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	finished := time.Now()
+	report.FinishedAt = &finished
+	s.running = false
+}
+
+// scan 逐个校验文件并记录结果
+func (s *ScrubService) scan(report *ScrubReport, olderThan time.Time) error {
+	// 相同内容的文件共用存储对象，每个对象只校验一次
+	results := make(map[string]verifyResult)
+	var files []model.File
+	return s.DB.Model(&model.File{}).
+		Where("verified_at IS NULL OR verified_at < ?", olderThan).
+		FindInBatches(&files, 100, func(tx *gorm.DB, batch int) error {
+			for i := range files {
+				file := &files[i]
+
+				key := file.Backend + ":" + file.StoragePath + ":" + file.Hash
+				res, ok := results[key]
+				if !ok {
+					res = s.verify(blobRef(file), file.Hash)
+					results[key] = res
+				}
+
+				if err := s.record(file, res); err != nil {
+					return err
+				}
+				s.count(report, res.status)
+			}
+			return nil
+		}).Error
+}
+
+// StartSchedule 启动定期校验，每隔interval校验一次超过interval未校验的文件
+func (s *ScrubService) StartSchedule(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			report, err := s.Run(time.Now().Add(-interval))
+			if !errors.Is(err, ErrScrubRunning) {
+				logScrubReport(report, err)
+			}
+			<-ticker.C
+		}
+	}()
+}
+
+// Status 返回当前或最近一次校验任务的状态
+func (s *ScrubService) Status() ScrubStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	status := ScrubStatus{Running: s.running}
+	if s.last != nil {
+		last := *s.last
+		status.Last = &last
+	}
+	return status
+}
+
+// GetDamagedFiles 获取校验发现损坏或丢失的文件
+func (s *ScrubService) GetDamagedFiles(page, pageSize int) ([]model.File, int64, error) {
+	var files []model.File
+	var total int64
+
+	query := s.DB.Model(&model.File{}).
+		Where("verify_status IN ?", []string{model.VerifyStatusCorrupted, model.VerifyStatusMissing})
+	if err := query.Count(&total).Error; err != nil {
+		return nil, 0, err
+	}
+
+	offset := (page - 1) * pageSize
+	if err := query.Order("verified_at DESC").Offset(offset).Limit(pageSize).Find(&files).Error; err != nil {
+		return nil, 0, err
+	}
+
+	return files, total, nil
+}
+
+// logScrubReport 记录校验结果
+func logScrubReport(report *ScrubReport, err error) {
+	if err != nil {
+		log.Printf("完整性校验失败: %v", err)
+		return
+	}
+	if report.Corrupted > 0 || report.Missing > 0 {
+		log.Printf("完整性校验发现问题: 共%d个文件，损坏%d个，丢失%d个，出错%d个",
+			report.Total, report.Corrupted, report.Missing, report.Errors)
+	} else if report.Total > 0 {
+		log.Printf("完整性校验完成: 共%d个文件，出错%d个", report.Total, report.Errors)
+	}
+}
+
+// verify 读取并解密文件内容，校验哈希
+func (s *ScrubService) verify(ref filestore.BlobRef, hash string) verifyResult {
+	src, err := s.Storage.Get(ref)
+	if err != nil {
+		if errors.Is(err, filestore.ErrNotFound) {
+			return verifyResult{status: model.VerifyStatusMissing, detail: filestore.ErrNotFound.Error()}
+		}
+		return verifyResult{status: model.VerifyStatusError, detail: err.Error()}
+	}
+	defer src.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, src); err != nil {
+		if errors.Is(err, filestore.ErrCorrupted) {
+			return verifyResult{status: model.VerifyStatusCorrupted, detail: err.Error()}
+		}
+		return verifyResult{status: model.VerifyStatusError, detail: err.Error()}
+	}
+
+	if actual := hex.EncodeToString(h.Sum(nil)); actual != hash {
+		return verifyResult{
+			status: model.VerifyStatusCorrupted,
+			detail: fmt.Sprintf("哈希不匹配，实际 %s", actual),
+		}
+	}
+	return verifyResult{status: model.VerifyStatusOK}
+}
+
+// record 保存文件的校验结果，不更新文件的修改时间
+func (s *ScrubService) record(file *model.File, res verifyResult) error {
+	detail := res.detail
+	if len(detail) > 255 {
+		detail = strings.ToValidUTF8(detail[:255], "")
+	}
+	return s.DB.Model(&model.File{}).Where("id = ?", file.ID).UpdateColumns(map[string]interface{}{
+		"verified_at":   time.Now(),
+		"verify_status": res.status,
+		"verify_error":  detail,
+	}).Error
+}
+
+// count 累计校验结果
+func (s *ScrubService) count(report *ScrubReport, status string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	report.Total++
+	switch status {
+	case model.VerifyStatusOK:
+		report.OK++
+	case model.VerifyStatusCorrupted:
+		report.Corrupted++
+	case model.VerifyStatusMissing:
+		report.Missing++
+	default:
+		report.Errors++
+	}
+}
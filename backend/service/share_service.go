@@ -1,7 +1,11 @@
 package service
 
 import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
+	"fmt"
 	"time"
 
 	"github.com/google/uuid"
@@ -9,6 +13,7 @@ import (
 	"github.com/zaunist/filebox/backend/model"
 	"github.com/zaunist/filebox/backend/utils"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
 // ShareService 分享服务
@@ -17,83 +22,70 @@ type ShareService struct {
 	AppConfig *config.AppConfig
 }
 
+// MaxBundleFiles 分享包最多包含的文件数
+const MaxBundleFiles = 50
+
 // CreateShareRequest 创建分享请求
 type CreateShareRequest struct {
-	FileID        string `json:"file_id" validate:"required"`
-	Code          string `json:"code"`
-	ExpiresIn     int    `json:"expires_in"`
-	DownloadLimit int    `json:"download_limit"`
+	FileID        string   `json:"file_id"`
+	FileIDs       []string `json:"file_ids"` // 非空时创建分享包，通过一个取件码分享其中全部文件，忽略FileID
+	Code          string   `json:"code"`
+	ExpiresIn     int      `json:"expires_in"`
+	DownloadLimit int      `json:"download_limit"`
 }
 
-// ShareResponse 分享响应
+// ShareResponse 分享响应。分享包的File*字段为排在最前的文件，Files为全部文件
 type ShareResponse struct {
+	ID            string       `json:"id"`
+	FileID        string       `json:"file_id"`
+	FileName      string       `json:"file_name"`
+	FileSize      int64        `json:"file_size"`
+	ContentType   string       `json:"content_type"`
+	Encrypted     bool         `json:"encrypted,omitempty"`
+	EncryptedMeta string       `json:"encrypted_meta,omitempty"`
+	ScanStatus    string       `json:"scan_status,omitempty"`
+	Bundle        bool         `json:"bundle,omitempty"`
+	Files         []SharedFile `json:"files,omitempty"`
+	Code          string       `json:"code"`
+	ExpiresAt     time.Time    `json:"expires_at"`
+	DownloadLimit int          `json:"download_limit"`
+	DownloadCount int          `json:"download_count"`
+	CreatedAt     time.Time    `json:"created_at"`
+}
+
+// SharedFile 分享中的文件信息
+type SharedFile struct {
 	ID            string    `json:"id"`
-	FileID        string    `json:"file_id"`
-	FileName      string    `json:"file_name"`
-	FileSize      int64     `json:"file_size"`
+	Name          string    `json:"name"`
+	Size          int64     `json:"size"`
 	ContentType   string    `json:"content_type"`
-	Code          string    `json:"code"`
-	ExpiresAt     time.Time `json:"expires_at"`
-	DownloadLimit int       `json:"download_limit"`
-	DownloadCount int       `json:"download_count"`
+	Encrypted     bool      `json:"encrypted,omitempty"`
+	EncryptedMeta string    `json:"encrypted_meta,omitempty"`
+	ScanStatus    string    `json:"scan_status,omitempty"`
 	CreatedAt     time.Time `json:"created_at"`
 }
 
-// CreateShare 创建分享
+// CreateShare 创建分享，FileIDs非空时创建包含多个文件的分享包
 func (s *ShareService) CreateShare(req CreateShareRequest, userID *uuid.UUID) (*ShareResponse, error) {
-	// 查找文件
-	var file model.File
-	result := s.DB.First(&file, "id = ?", req.FileID)
-	if result.Error != nil {
-		if errors.Is(result.Error, gorm.ErrRecordNotFound) {
-			return nil, errors.New("文件不存在")
-		}
-		return nil, result.Error
+	fileIDs := req.FileIDs
+	bundle := len(fileIDs) > 0
+	if !bundle {
+		fileIDs = []string{req.FileID}
+	}
+	if len(fileIDs) > MaxBundleFiles {
+		return nil, fmt.Errorf("分享包最多包含%d个文件", MaxBundleFiles)
 	}
 
-	// 检查文件所有权（如果是注册用户）
-	if userID != nil && file.UserID != nil && *file.UserID != *userID {
-		return nil, errors.New("无权限分享此文件")
+	// 查找文件并检查权限
+	files, err := s.shareableFiles(fileIDs, userID)
+	if err != nil {
+		return nil, err
 	}
 
 	// 生成或验证取件码
-	var code string
-	if req.Code != "" {
-		// 验证自定义取件码
-		if !utils.IsValidCode(req.Code) {
-			return nil, errors.New("无效的取件码格式")
-		}
-
-		// 检查取件码是否已存在
-		var existingShare model.Share
-		result = s.DB.Where("code = ?", req.Code).First(&existingShare)
-		if result.Error == nil {
-			return nil, errors.New("取件码已被使用，请尝试其他取件码")
-		} else if !errors.Is(result.Error, gorm.ErrRecordNotFound) {
-			return nil, result.Error
-		}
-
-		code = req.Code
-	} else {
-		// 生成随机取件码
-		var err error
-		for i := 0; i < 5; i++ { // 尝试最多5次
-			code, err = utils.GenerateRandomCode(6)
-			if err != nil {
-				return nil, err
-			}
-
-			// 检查是否已存在
-			var existingShare model.Share
-			result = s.DB.Where("code = ?", code).First(&existingShare)
-			if errors.Is(result.Error, gorm.ErrRecordNotFound) {
-				break // 找到可用的取件码
-			}
-
-			if i == 4 {
-				return nil, errors.New("无法生成唯一取件码，请稍后再试")
-			}
-		}
+	code, err := s.allocateCode(req.Code)
+	if err != nil {
+		return nil, err
 	}
 
 	// 设置过期时间
@@ -112,32 +104,177 @@ func (s *ShareService) CreateShare(req CreateShareRequest, userID *uuid.UUID) (*
 	// 创建分享记录
 	share := &model.Share{
 		ID:            uuid.New(),
-		FileID:        file.ID,
+		FileID:        files[0].ID,
 		Code:          code,
 		ExpiresAt:     expiresAt,
 		DownloadLimit: downloadLimit,
 		DownloadCount: 0,
+		Bundle:        bundle,
 		CreatedAt:     time.Now(),
 		UpdatedAt:     time.Now(),
 	}
 
 	// 保存到数据库
-	if err := s.DB.Create(share).Error; err != nil {
+	err = s.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(share).Error; err != nil {
+			return err
+		}
+		if !bundle {
+			return nil
+		}
+		entries := make([]model.ShareFile, len(files))
+		for i, file := range files {
+			entries[i] = model.ShareFile{ShareID: share.ID, FileID: file.ID, Position: i}
+		}
+		return tx.Create(&entries).Error
+	})
+	if err != nil {
 		return nil, err
 	}
 
-	return &ShareResponse{
+	return shareResponse(share, files), nil
+}
+
+// shareableFiles 按请求中的顺序查找要分享的文件（重复的ID只保留一个），检查所有权和扫描状态
+func (s *ShareService) shareableFiles(fileIDs []string, userID *uuid.UUID) ([]model.File, error) {
+	ids := make([]string, 0, len(fileIDs))
+	seen := make(map[string]bool)
+	for _, id := range fileIDs {
+		if !seen[id] {
+			seen[id] = true
+			ids = append(ids, id)
+		}
+	}
+
+	var found []model.File
+	if err := s.DB.Where("id IN ?", ids).Find(&found).Error; err != nil {
+		return nil, err
+	}
+	byID := make(map[string]model.File, len(found))
+	for _, file := range found {
+		byID[file.ID.String()] = file
+	}
+
+	files := make([]model.File, 0, len(ids))
+	for _, id := range ids {
+		file, ok := byID[id]
+		if !ok {
+			return nil, errors.New("文件不存在")
+		}
+
+		// 检查文件所有权（如果是注册用户），注册用户不能分享匿名上传的文件
+		if userID != nil && (file.UserID == nil || *file.UserID != *userID) {
+			return nil, errors.New("无权限分享此文件")
+		}
+
+		// 发现威胁的文件已被隔离，不能再分享
+		if file.ScanStatus == model.ScanStatusInfected {
+			return nil, errors.New("文件未通过安全扫描，无法分享")
+		}
+		files = append(files, file)
+	}
+	return files, nil
+}
+
+// allocateCode 验证自定义取件码，未指定时生成随机取件码
+func (s *ShareService) allocateCode(custom string) (string, error) {
+	if custom != "" {
+		// 验证自定义取件码
+		if !utils.IsValidCode(custom) {
+			return "", errors.New("无效的取件码格式")
+		}
+
+		// 检查取件码是否已存在
+		var existingShare model.Share
+		result := s.DB.Where("code = ?", custom).First(&existingShare)
+		if result.Error == nil {
+			return "", errors.New("取件码已被使用，请尝试其他取件码")
+		} else if !errors.Is(result.Error, gorm.ErrRecordNotFound) {
+			return "", result.Error
+		}
+
+		return custom, nil
+	}
+
+	// 生成随机取件码
+	for i := 0; i < 5; i++ { // 尝试最多5次
+		code, err := utils.GenerateRandomCode(6)
+		if err != nil {
+			return "", err
+		}
+
+		// 检查是否已存在
+		var existingShare model.Share
+		result := s.DB.Where("code = ?", code).First(&existingShare)
+		if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+			return code, nil // 找到可用的取件码
+		}
+	}
+	return "", errors.New("无法生成唯一取件码，请稍后再试")
+}
+
+// shareResponse 生成分享响应，files为分享中的文件，第一个为Share.FileID
+func shareResponse(share *model.Share, files []model.File) *ShareResponse {
+	file := files[0]
+	resp := &ShareResponse{
 		ID:            share.ID.String(),
 		FileID:        file.ID.String(),
 		FileName:      file.Name,
 		FileSize:      file.Size,
 		ContentType:   file.ContentType,
+		Encrypted:     file.Encrypted,
+		EncryptedMeta: file.EncryptedMeta,
+		ScanStatus:    file.ScanStatus,
+		Bundle:        share.Bundle,
 		Code:          share.Code,
 		ExpiresAt:     share.ExpiresAt,
 		DownloadLimit: share.DownloadLimit,
 		DownloadCount: share.DownloadCount,
 		CreatedAt:     share.CreatedAt,
-	}, nil
+	}
+	if share.Bundle {
+		resp.Files = make([]SharedFile, len(files))
+		for i := range files {
+			resp.Files[i] = SharedFileOf(&files[i])
+		}
+	}
+	return resp
+}
+
+// PublicShare 通过取件码查看的分享信息，不包含分享和文件的ID
+type PublicShare struct {
+	Code          string    `json:"code"`
+	Bundle        bool      `json:"bundle,omitempty"`
+	ExpiresAt     time.Time `json:"expires_at"`
+	DownloadLimit int       `json:"download_limit"`
+	DownloadCount int       `json:"download_count"`
+	CreatedAt     time.Time `json:"created_at"`
+}
+
+// PublicShareOf 生成通过取件码查看的分享信息
+func PublicShareOf(share *model.Share) PublicShare {
+	return PublicShare{
+		Code:          share.Code,
+		Bundle:        share.Bundle,
+		ExpiresAt:     share.ExpiresAt,
+		DownloadLimit: share.DownloadLimit,
+		DownloadCount: share.DownloadCount,
+		CreatedAt:     share.CreatedAt,
+	}
+}
+
+// SharedFileOf 生成分享中的文件信息，端到端加密的文件只包含加密的元数据
+func SharedFileOf(file *model.File) SharedFile {
+	return SharedFile{
+		ID:            file.ID.String(),
+		Name:          file.Name,
+		Size:          file.Size,
+		ContentType:   file.ContentType,
+		Encrypted:     file.Encrypted,
+		EncryptedMeta: file.EncryptedMeta,
+		ScanStatus:    file.ScanStatus,
+		CreatedAt:     file.CreatedAt,
+	}
 }
 
 // GetShareByCode 根据取件码获取分享
@@ -161,6 +298,188 @@ func (s *ShareService) GetShareByCode(code string) (*model.Share, *model.File, e
 	return &share, &share.File, nil
 }
 
+// GetShareFiles 获取分享中的全部文件，分享包按加入顺序返回
+func (s *ShareService) GetShareFiles(share *model.Share) ([]model.File, error) {
+	if !share.Bundle {
+		return []model.File{share.File}, nil
+	}
+
+	var entries []model.ShareFile
+	if err := s.DB.Preload("File").Where("share_id = ?", share.ID).Order("position").Find(&entries).Error; err != nil {
+		return nil, err
+	}
+	files := make([]model.File, len(entries))
+	for i, entry := range entries {
+		files[i] = entry.File
+	}
+	return files, nil
+}
+
+// GetSharedFile 获取分享中的指定文件
+func (s *ShareService) GetSharedFile(share *model.Share, fileID string) (*model.File, error) {
+	if !share.Bundle {
+		if share.FileID.String() != fileID {
+			return nil, errors.New("文件不存在")
+		}
+		return &share.File, nil
+	}
+
+	var entry model.ShareFile
+	if err := s.DB.Preload("File").Where("share_id = ? AND file_id = ?", share.ID, fileID).First(&entry).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, errors.New("文件不存在")
+		}
+		return nil, err
+	}
+	return &entry.File, nil
+}
+
+// downloadTicketTTL 下载凭证的有效期，之后的续传按新的下载计数
+const downloadTicketTTL = 2 * time.Hour
+
+// IssueDownloadTicket 为一次计入下载次数的取件生成凭证，返回凭证及其过期时间。
+// 凭证为随机值，每次取件都不同，有效期不超过分享本身的有效期。fileID为本次下载的分享包文件，
+// 为空表示下载分享的文件或分享包的ZIP
+func (s *ShareService) IssueDownloadTicket(share *model.Share, fileID string) (string, time.Time, error) {
+	key, err := pickupFileKey(share, fileID)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	token := make([]byte, 32)
+	if _, err := rand.Read(token); err != nil {
+		return "", time.Time{}, fmt.Errorf("生成下载凭证失败: %w", err)
+	}
+	ticket := hex.EncodeToString(token)
+
+	now := time.Now()
+	expiresAt := now.Add(downloadTicketTTL)
+	if share.ExpiresAt.Before(expiresAt) {
+		expiresAt = share.ExpiresAt
+	}
+
+	err = s.DB.Transaction(func(tx *gorm.DB) error {
+		// 顺便清理已过期的凭证
+		expired := tx.Model(&model.DownloadTicket{}).Select("id").Where("expires_at < ?", now)
+		if err := tx.Where("ticket_id IN (?)", expired).Delete(&model.DownloadTicketFile{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("expires_at < ?", now).Delete(&model.DownloadTicket{}).Error; err != nil {
+			return err
+		}
+
+		hash := ticketHash(ticket)
+		if err := tx.Create(&model.DownloadTicket{
+			ID:        hash,
+			ShareID:   share.ID,
+			ExpiresAt: expiresAt,
+		}).Error; err != nil {
+			return err
+		}
+		return tx.Create(&model.DownloadTicketFile{TicketID: hash, FileID: key}).Error
+	})
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	return ticket, expiresAt, nil
+}
+
+// ContinuePickup 判断携带有效凭证的下载是否属于凭证对应的同一次取件，属于时不再计数。
+// 续传（resume为true）只适用于本次取件中已开始下载的文件，ZIP不支持续传；
+// 分享包中本次取件尚未下载过的文件可以从头下载一次，下载过ZIP后不再有未下载的文件
+func (s *ShareService) ContinuePickup(share *model.Share, ticket, fileID string, resume bool) (bool, error) {
+	key, err := pickupFileKey(share, fileID)
+	if err != nil {
+		// 无效的文件ID，之后获取文件时返回404
+		return false, nil
+	}
+	hash := ticketHash(ticket)
+
+	if resume {
+		if key == uuid.Nil {
+			return false, nil
+		}
+		var count int64
+		err := s.DB.Model(&model.DownloadTicketFile{}).Where("ticket_id = ? AND file_id = ?", hash, key).Count(&count).Error
+		return count > 0, err
+	}
+
+	if !share.Bundle || key == uuid.Nil {
+		return false, nil
+	}
+
+	continued := false
+	err = s.DB.Transaction(func(tx *gorm.DB) error {
+		var count int64
+		if err := tx.Model(&model.DownloadTicketFile{}).Where("ticket_id = ? AND file_id = ?", hash, uuid.Nil).
+			Count(&count).Error; err != nil || count > 0 {
+			return err
+		}
+		if err := tx.Model(&model.ShareFile{}).Where("share_id = ? AND file_id = ?", share.ID, key).
+			Count(&count).Error; err != nil || count == 0 {
+			return err
+		}
+
+		// 同一文件并发的两个请求只有一个能记为本次取件
+		result := tx.Clauses(clause.OnConflict{DoNothing: true}).
+			Create(&model.DownloadTicketFile{TicketID: hash, FileID: key})
+		continued = result.RowsAffected == 1
+		return result.Error
+	})
+	return continued, err
+}
+
+// pickupFileKey 返回记录在取件中的文件：分享包中的单个文件为其ID，普通分享为分享的文件，分享包的ZIP为uuid.Nil
+func pickupFileKey(share *model.Share, fileID string) (uuid.UUID, error) {
+	if !share.Bundle {
+		return share.FileID, nil
+	}
+	if fileID == "" {
+		return uuid.Nil, nil
+	}
+	id, err := uuid.Parse(fileID)
+	if err != nil {
+		return uuid.Nil, errors.New("文件不存在")
+	}
+	return id, nil
+}
+
+// GetShareForResume 根据取件码和下载凭证获取分享，用于续传请求。
+// 续传属于已计数的同一次下载，因此只检查凭证和分享的有效期，不检查下载次数
+func (s *ShareService) GetShareForResume(code, ticket string) (*model.Share, *model.File, error) {
+	var share model.Share
+
+	result := s.DB.Preload("File").Where("code = ?", code).First(&share)
+	if result.Error != nil {
+		if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+			return nil, nil, errors.New("取件码无效")
+		}
+		return nil, nil, result.Error
+	}
+
+	var record model.DownloadTicket
+	err := s.DB.Where("id = ? AND share_id = ? AND expires_at > ?", ticketHash(ticket), share.ID, time.Now()).
+		First(&record).Error
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, nil, errors.New("无效的下载凭证")
+		}
+		return nil, nil, err
+	}
+
+	if share.IsTimeExpired() {
+		return nil, nil, errors.New("分享已过期或超过下载次数限制")
+	}
+
+	return &share, &share.File, nil
+}
+
+// ticketHash 计算下载凭证的哈希，数据库中只保存哈希
+func ticketHash(ticket string) string {
+	sum := sha256.Sum256([]byte(ticket))
+	return hex.EncodeToString(sum[:])
+}
+
 // IncrementDownloadCount 增加下载次数
 func (s *ShareService) IncrementDownloadCount(shareID uuid.UUID) error {
 	return s.DB.Model(&model.Share{}).Where("id = ?", shareID).
@@ -196,19 +515,15 @@ func (s *ShareService) GetUserShares(userID string, page, pageSize int) ([]Share
 
 	// 转换为响应格式
 	responses := make([]ShareResponse, len(shares))
-	for i, share := range shares {
-		responses[i] = ShareResponse{
-			ID:            share.ID.String(),
-			FileID:        share.FileID.String(),
-			FileName:      share.File.Name,
-			FileSize:      share.File.Size,
-			ContentType:   share.File.ContentType,
-			Code:          share.Code,
-			ExpiresAt:     share.ExpiresAt,
-			DownloadLimit: share.DownloadLimit,
-			DownloadCount: share.DownloadCount,
-			CreatedAt:     share.CreatedAt,
+	for i := range shares {
+		files, err := s.GetShareFiles(&shares[i])
+		if err != nil {
+			return nil, 0, err
 		}
+		if len(files) == 0 {
+			files = []model.File{shares[i].File}
+		}
+		responses[i] = *shareResponse(&shares[i], files)
 	}
 
 	return responses, total, nil
@@ -231,10 +546,39 @@ func (s *ShareService) DeleteShare(shareID string, userID *uuid.UUID) error {
 		return errors.New("无权限删除此分享")
 	}
 
-	// 删除分享
-	if err := s.DB.Delete(&share).Error; err != nil {
+	// 删除分享及分享包中的文件列表
+	return s.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("share_id = ?", share.ID).Delete(&model.ShareFile{}).Error; err != nil {
+			return err
+		}
+		return tx.Delete(&share).Error
+	})
+}
+
+// detachFile 删除文件时更新引用它的分享：普通分享直接删除，分享包中移除该文件。
+// 文件是分享包中排在最前的文件时改为指向下一个文件，分享包中没有剩余文件时删除分享包
+func detachFile(tx *gorm.DB, fileID uuid.UUID) error {
+	if err := tx.Where("file_id = ?", fileID).Delete(&model.ShareFile{}).Error; err != nil {
+		return err
+	}
+
+	var bundles []model.Share
+	if err := tx.Where("file_id = ? AND bundle = ?", fileID, true).Find(&bundles).Error; err != nil {
 		return err
 	}
+	for _, share := range bundles {
+		var next model.ShareFile
+		err := tx.Where("share_id = ?", share.ID).Order("position").First(&next).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if err := tx.Model(&model.Share{}).Where("id = ?", share.ID).Update("file_id", next.FileID).Error; err != nil {
+			return err
+		}
+	}
 
-	return nil
+	return tx.Where("file_id = ?", fileID).Delete(&model.Share{}).Error
 }
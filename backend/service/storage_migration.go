@@ -0,0 +1,167 @@
+package service
+
+import (
+	"errors"
+	"log"
+	"time"
+
+	"github.com/zaunist/filebox/backend/filestore"
+	"github.com/zaunist/filebox/backend/model"
+	"gorm.io/gorm"
+)
+
+// StorageMigrationOptions 存储迁移选项
+type StorageMigrationOptions struct {
+	DryRun bool
+	// From 只迁移该后端中的文件，为空表示迁移所有不在目标后端中的文件
+	From string
+	// To 目标后端，为空表示当前写入的后端
+	To string
+	// DeleteSource 迁移后删除源后端中不再被引用的对象
+	DeleteSource bool
+}
+
+// MigrateStorage 将文件内容原样复制到目标后端，解密校验哈希后再切换文件记录和Blob的存储后端。
+// 迁移期间源对象始终可读，可以在服务运行时执行（服务需要同时配置源和目标后端），
+// 中断后重新执行会跳过已迁移的文件。
+func (s *StorageService) MigrateStorage(opts StorageMigrationOptions) (*MigrationReport, error) {
+	migrator, ok := s.Storage.(filestore.Migrator)
+	if !ok {
+		return nil, errors.New("当前存储不支持存储迁移")
+	}
+	if opts.To == "" {
+		opts.To = migrator.PrimaryBackend()
+	}
+	if opts.From == opts.To {
+		return nil, errors.New("源和目标是同一个存储后端")
+	}
+
+	report := &MigrationReport{}
+	// 共用同一个对象的文件只复制一次
+	migrated := make(map[filestore.BlobRef]bool)
+
+	query := s.DB.Model(&model.File{}).Where("backend <> ?", opts.To)
+	if opts.From != "" {
+		query = query.Where("backend = ?", opts.From)
+	}
+	var files []model.File
+	result := query.FindInBatches(&files, 100, func(tx *gorm.DB, batch int) error {
+		for i := range files {
+			file := &files[i]
+			report.Total++
+
+			loc := location(file)
+			if migrated[loc] {
+				report.Skipped++
+				continue
+			}
+			migrated[loc] = true
+
+			if opts.DryRun {
+				report.Migrated++
+				continue
+			}
+			if err := s.migrateObject(migrator, blobRef(file), file.Hash, opts); err != nil {
+				log.Printf("迁移文件失败 %s: %v", file.ID, err)
+				report.Failed++
+				continue
+			}
+			report.Migrated++
+		}
+		return nil
+	})
+	if result.Error != nil {
+		return report, result.Error
+	}
+
+	// 没有文件记录引用的Blob同样需要迁移，之后引用它的新文件才能读取
+	query = s.DB.Model(&model.Blob{}).Where("backend <> ?", opts.To)
+	if opts.From != "" {
+		query = query.Where("backend = ?", opts.From)
+	}
+	var blobs []model.Blob
+	result = query.FindInBatches(&blobs, 100, func(tx *gorm.DB, batch int) error {
+		for i := range blobs {
+			blob := &blobs[i]
+			ref := blobRefOf(blob)
+			if migrated[filestore.BlobRef{Path: ref.Path, Backend: ref.Backend}] || opts.DryRun {
+				continue
+			}
+			if err := s.migrateObject(migrator, ref, blob.Hash, opts); err != nil {
+				log.Printf("迁移Blob失败 %s: %v", blob.Hash, err)
+				report.Failed++
+			}
+		}
+		return nil
+	})
+	if result.Error != nil {
+		return report, result.Error
+	}
+
+	return report, nil
+}
+
+// migrateObject 复制一个对象到目标后端，校验后将引用它的记录指向目标后端。
+// 切换记录与检查源对象是否仍被引用在同一事务中完成，并锁定Blob与删除文件互斥；
+// 源对象在事务提交后才删除
+func (s *StorageService) migrateObject(migrator filestore.Migrator, ref filestore.BlobRef, hash string, opts StorageMigrationOptions) error {
+	if err := migrator.Copy(ref, opts.To); err != nil {
+		return err
+	}
+
+	dst := ref
+	dst.Backend = opts.To
+	if err := s.verifyHash(dst, hash); err != nil {
+		s.deleteIfUnreferenced(dst)
+		return err
+	}
+
+	// 复制期间记录可能已被删除，此时目标中的副本不再需要。
+	// 同时更新修改时间，避免存储核对把刚迁移到当前后端的文件误判为丢失
+	values := map[string]interface{}{"backend": opts.To, "updated_at": time.Now()}
+	var updated int64
+	orphaned := false
+	err := s.DB.Transaction(func(tx *gorm.DB) error {
+		if _, err := lockBlob(tx, hash); err != nil {
+			return err
+		}
+
+		result := tx.Model(&model.File{}).
+			Where("storage_path = ? AND backend = ? AND hash = ?", ref.Path, ref.Backend, hash).
+			UpdateColumns(values)
+		if result.Error != nil {
+			return result.Error
+		}
+		updated = result.RowsAffected
+
+		result = tx.Model(&model.Blob{}).
+			Where("storage_path = ? AND backend = ? AND hash = ?", ref.Path, ref.Backend, hash).
+			UpdateColumns(values)
+		if result.Error != nil {
+			return result.Error
+		}
+		updated += result.RowsAffected
+
+		if updated == 0 || !opts.DeleteSource {
+			return nil
+		}
+		inUse, err := isReferenced(tx, ref.Path, ref.Backend)
+		orphaned = !inUse
+		return err
+	})
+	if err != nil {
+		s.deleteIfUnreferenced(dst)
+		return err
+	}
+	if updated == 0 {
+		s.deleteIfUnreferenced(dst)
+		return errors.New("文件记录已被删除或修改")
+	}
+
+	if orphaned {
+		if err := s.Storage.Delete(filestore.BlobRef{Path: ref.Path, Backend: ref.Backend}); err != nil {
+			log.Printf("删除旧文件失败 %s: %v", ref.Path, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,451 @@
+package service
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+
+	"github.com/zaunist/filebox/backend/filestore"
+	"github.com/zaunist/filebox/backend/model"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// StorageService 存储维护服务，负责加密格式迁移、密钥轮换等维护任务
+type StorageService struct {
+	DB      *gorm.DB
+	Storage filestore.FileStorage
+	Keys    *filestore.KeyRing
+}
+
+// MigrationReport 迁移结果统计
+type MigrationReport struct {
+	Total    int `json:"total"`
+	Migrated int `json:"migrated"`
+	Skipped  int `json:"skipped"`
+	Failed   int `json:"failed"`
+}
+
+// RecordStorageFormats 读取文件头，为尚未记录存储格式的历史文件和Blob记录格式，
+// 之后读取文件时只按记录的格式解密。每个存储对象只读取一次，读取失败的保持未记录，下次启动时重试
+func (s *StorageService) RecordStorageFormats() (*MigrationReport, error) {
+	upgrader, ok := s.Storage.(filestore.Upgrader)
+	if !ok {
+		return nil, errors.New("当前存储不支持识别存储格式")
+	}
+
+	report := &MigrationReport{}
+	formats := make(map[filestore.BlobRef]int)
+	record := func(table interface{}, ref filestore.BlobRef) {
+		report.Total++
+		loc := filestore.BlobRef{Path: ref.Path, Backend: ref.Backend}
+		format, ok := formats[loc]
+		if !ok {
+			var err error
+			if format, err = upgrader.DetectFormat(ref); err != nil {
+				log.Printf("识别存储格式失败 %s: %v", ref.Path, err)
+				report.Failed++
+				return
+			}
+			formats[loc] = format
+		}
+		// 不更新修改时间，避免影响存储核对
+		if err := s.DB.Model(table).Where("storage_path = ? AND backend = ? AND storage_format = ?", ref.Path, ref.Backend, filestore.FormatUnknown).
+			UpdateColumn("storage_format", format).Error; err != nil {
+			log.Printf("记录存储格式失败 %s: %v", ref.Path, err)
+			report.Failed++
+			return
+		}
+		report.Migrated++
+	}
+
+	var files []model.File
+	result := s.DB.Where("storage_format = ?", filestore.FormatUnknown).FindInBatches(&files, 100, func(tx *gorm.DB, batch int) error {
+		for i := range files {
+			record(&model.File{}, blobRef(&files[i]))
+		}
+		return nil
+	})
+	if result.Error != nil {
+		return report, result.Error
+	}
+
+	var blobs []model.Blob
+	result = s.DB.Where("storage_format = ?", filestore.FormatUnknown).FindInBatches(&blobs, 100, func(tx *gorm.DB, batch int) error {
+		for i := range blobs {
+			record(&model.Blob{}, blobRefOf(&blobs[i]))
+		}
+		return nil
+	})
+	if result.Error != nil {
+		return report, result.Error
+	}
+
+	return report, nil
+}
+
+// MigrateLegacyEncryption 将旧版AES-CFB格式的文件重新加密为当前的AES-GCM分块格式。
+// 新文件写入新路径并校验哈希后才更新数据库记录，迁移过程中旧文件始终可读，
+// 因此可以在服务运行时执行，中断后重新执行即可继续。dryRun为true时只统计需要迁移的文件。
+func (s *StorageService) MigrateLegacyEncryption(dryRun bool) (*MigrationReport, error) {
+	upgrader, ok := s.Storage.(filestore.Upgrader)
+	if !ok {
+		return nil, errors.New("当前存储不支持加密格式迁移")
+	}
+
+	report := &MigrationReport{}
+	// 旧版本中相同内容的文件可能共用同一个存储对象，每个对象只迁移一次
+	migrated := make(map[filestore.BlobRef]bool)
+	var files []model.File
+	result := s.DB.Model(&model.File{}).FindInBatches(&files, 100, func(tx *gorm.DB, batch int) error {
+		for i := range files {
+			file := &files[i]
+			report.Total++
+
+			if migrated[location(file)] {
+				report.Skipped++
+				continue
+			}
+
+			legacy, err := upgrader.NeedsUpgrade(blobRef(file))
+			if err != nil {
+				log.Printf("检查文件格式失败 %s: %v", file.ID, err)
+				report.Failed++
+				continue
+			}
+			if !legacy {
+				report.Skipped++
+				continue
+			}
+
+			if dryRun {
+				report.Migrated++
+				continue
+			}
+
+			if err := s.reencrypt(file); err != nil {
+				log.Printf("迁移文件失败 %s: %v", file.ID, err)
+				report.Failed++
+				continue
+			}
+			migrated[location(file)] = true
+			report.Migrated++
+		}
+		return nil
+	})
+	if result.Error != nil {
+		return report, result.Error
+	}
+
+	return report, nil
+}
+
+// reencrypt 读取文件明文并以当前格式重新写入，校验通过后切换存储路径
+func (s *StorageService) reencrypt(file *model.File) error {
+	src, err := s.Storage.Get(blobRef(file))
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	saved, err := s.Storage.Save(src, filestore.FileMeta{
+		Name:        file.Name,
+		ContentType: file.ContentType,
+		Size:        file.Size,
+	})
+	if err != nil {
+		return err
+	}
+
+	if saved.Hash != file.Hash {
+		_ = s.Storage.Delete(saved.Ref())
+		return fmt.Errorf("哈希校验失败，期望 %s，实际 %s", file.Hash, saved.Hash)
+	}
+
+	// 更新所有引用该存储路径的文件记录和Blob
+	var updated int64
+	err = s.DB.Transaction(func(tx *gorm.DB) error {
+		var err error
+		updated, err = repoint(tx, location(file), file.Hash, saved.Ref())
+		return err
+	})
+	if err != nil {
+		_ = s.Storage.Delete(saved.Ref())
+		return err
+	}
+	if updated == 0 {
+		_ = s.Storage.Delete(saved.Ref())
+		return errors.New("文件记录已被删除或修改")
+	}
+
+	s.deleteIfUnreferenced(location(file))
+	return nil
+}
+
+// repoint 将引用old的文件记录和Blob指向新的存储位置，返回更新的文件记录数
+func repoint(tx *gorm.DB, old filestore.BlobRef, hash string, dst filestore.BlobRef) (int64, error) {
+	values := map[string]interface{}{
+		"storage_path":   dst.Path,
+		"storage_format": dst.Format,
+		"backend":        dst.Backend,
+		"key_id":         dst.KeyID,
+		"data_key":       dst.DataKey,
+	}
+
+	result := tx.Model(&model.File{}).
+		Where("storage_path = ? AND backend = ? AND hash = ?", old.Path, old.Backend, hash).Updates(values)
+	if result.Error != nil {
+		return 0, result.Error
+	}
+	if err := tx.Model(&model.Blob{}).
+		Where("storage_path = ? AND backend = ? AND hash = ?", old.Path, old.Backend, hash).Updates(values).Error; err != nil {
+		return 0, err
+	}
+	return result.RowsAffected, nil
+}
+
+// location 返回文件所在的存储位置（后端和路径），用于判断多个文件是否共用同一个对象
+func location(file *model.File) filestore.BlobRef {
+	return filestore.BlobRef{Path: file.StoragePath, Backend: file.Backend}
+}
+
+// deleteIfUnreferenced 没有文件记录和Blob引用时删除存储中的文件
+func (s *StorageService) deleteIfUnreferenced(ref filestore.BlobRef) {
+	inUse, err := isReferenced(s.DB, ref.Path, ref.Backend)
+	if err != nil {
+		log.Printf("检查文件引用失败 %s: %v", ref.Path, err)
+		return
+	}
+	if inUse {
+		return
+	}
+
+	if err := s.Storage.Delete(ref); err != nil {
+		log.Printf("删除旧文件失败 %s: %v", ref.Path, err)
+	}
+}
+
+// RotateKeys 用当前主密钥重新包装所有文件的数据密钥，不重写文件内容。
+// 完成后即可从配置中移除旧的主密钥。dryRun为true时只统计需要轮换的文件。
+func (s *StorageService) RotateKeys(dryRun bool) (*MigrationReport, error) {
+	if s.Keys == nil {
+		return nil, errors.New("当前存储不支持密钥轮换")
+	}
+
+	primaryID := s.Keys.PrimaryID()
+	report := &MigrationReport{}
+	var files []model.File
+	result := s.DB.Model(&model.File{}).
+		Where("key_id IS NULL OR key_id <> ? OR data_key IS NULL OR data_key = ''", primaryID).
+		FindInBatches(&files, 100, func(tx *gorm.DB, batch int) error {
+			for i := range files {
+				file := &files[i]
+				report.Total++
+
+				if dryRun {
+					report.Migrated++
+					continue
+				}
+
+				keyID, dataKey, err := s.Keys.Rewrap(file.KeyID, file.DataKey)
+				if err != nil {
+					log.Printf("轮换文件密钥失败 %s: %v", file.ID, err)
+					report.Failed++
+					continue
+				}
+
+				// 只有数据密钥未被其他操作修改时才更新
+				result := s.DB.Model(&model.File{}).
+					Where("id = ? AND key_id = ? AND data_key = ?", file.ID, file.KeyID, file.DataKey).
+					Updates(map[string]interface{}{"key_id": keyID, "data_key": dataKey})
+				if result.Error != nil {
+					log.Printf("轮换文件密钥失败 %s: %v", file.ID, result.Error)
+					report.Failed++
+					continue
+				}
+				if result.RowsAffected == 0 {
+					report.Skipped++
+					continue
+				}
+				report.Migrated++
+			}
+			return nil
+		})
+	if result.Error != nil {
+		return report, result.Error
+	}
+
+	// Blob中的数据密钥用于之后引用同一内容的新文件，同样需要轮换
+	var blobs []model.Blob
+	result = s.DB.Model(&model.Blob{}).
+		Where("key_id IS NULL OR key_id <> ? OR data_key IS NULL OR data_key = ''", primaryID).
+		FindInBatches(&blobs, 100, func(tx *gorm.DB, batch int) error {
+			for i := range blobs {
+				blob := &blobs[i]
+				if dryRun {
+					continue
+				}
+
+				keyID, dataKey, err := s.Keys.Rewrap(blob.KeyID, blob.DataKey)
+				if err != nil {
+					log.Printf("轮换Blob密钥失败 %s: %v", blob.Hash, err)
+					report.Failed++
+					continue
+				}
+
+				if err := s.DB.Model(&model.Blob{}).
+					Where("hash = ? AND key_id = ? AND data_key = ?", blob.Hash, blob.KeyID, blob.DataKey).
+					Updates(map[string]interface{}{"key_id": keyID, "data_key": dataKey}).Error; err != nil {
+					log.Printf("轮换Blob密钥失败 %s: %v", blob.Hash, err)
+					report.Failed++
+				}
+			}
+			return nil
+		})
+	if result.Error != nil {
+		return report, result.Error
+	}
+
+	return report, nil
+}
+
+// DeduplicateBlobs 为历史文件建立按内容哈希索引的Blob，并把内容相同但分散存储的文件合并到同一个对象上，
+// 合并后不再被引用的重复对象会被删除。可以在服务运行时执行，重复执行是安全的。
+// dryRun为true时只统计需要合并的文件。
+func (s *StorageService) DeduplicateBlobs(dryRun bool) (*MigrationReport, error) {
+	var hashes []string
+	if err := s.DB.Model(&model.File{}).Distinct("hash").Pluck("hash", &hashes).Error; err != nil {
+		return nil, err
+	}
+
+	report := &MigrationReport{}
+	for _, hash := range hashes {
+		if err := s.deduplicate(hash, dryRun, report); err != nil {
+			log.Printf("合并重复内容失败 %s: %v", hash, err)
+		}
+	}
+
+	return report, nil
+}
+
+// deduplicate 合并哈希为hash的所有文件
+func (s *StorageService) deduplicate(hash string, dryRun bool, report *MigrationReport) error {
+	var files []model.File
+	if err := s.DB.Where("hash = ?", hash).Order("created_at ASC").Find(&files).Error; err != nil {
+		report.Failed++
+		return err
+	}
+	if len(files) == 0 {
+		return nil
+	}
+
+	// 已有Blob时以其为准，否则以最早上传的文件为准
+	var blob model.Blob
+	err := s.DB.First(&blob, "hash = ?", hash).Error
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		report.Failed += len(files)
+		return err
+	}
+	hasBlob := err == nil
+	if !hasBlob {
+		blob = model.Blob{
+			Hash:          hash,
+			StoragePath:   files[0].StoragePath,
+			StorageFormat: files[0].StorageFormat,
+			Backend:       files[0].Backend,
+			Size:          files[0].Size,
+			KeyID:         files[0].KeyID,
+			DataKey:       files[0].DataKey,
+		}
+	}
+
+	// 按存储位置分组找出需要合并的文件
+	var canonical int
+	duplicates := make(map[filestore.BlobRef]int)
+	for i := range files {
+		loc := location(&files[i])
+		if loc.Path == blob.StoragePath && loc.Backend == blob.Backend {
+			canonical++
+		} else {
+			duplicates[loc]++
+		}
+	}
+	report.Total += len(files)
+	report.Skipped += canonical
+
+	if dryRun {
+		for _, count := range duplicates {
+			report.Migrated += count
+		}
+		return nil
+	}
+
+	// 合并前确认保留的对象内容完好，避免删除唯一完好的副本
+	if len(duplicates) > 0 {
+		if err := s.verifyHash(blobRefOf(&blob), hash); err != nil {
+			for _, count := range duplicates {
+				report.Failed += count
+			}
+			return err
+		}
+	}
+
+	err = s.DB.Transaction(func(tx *gorm.DB) error {
+		if !hasBlob {
+			blob.RefCount = canonical
+			result := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&blob)
+			if result.Error != nil {
+				return result.Error
+			}
+			if result.RowsAffected == 0 {
+				return errors.New("Blob已被并发创建，请重新执行")
+			}
+		}
+
+		for loc := range duplicates {
+			updated, err := repoint(tx, loc, hash, blobRefOf(&blob))
+			if err != nil {
+				return err
+			}
+			if err := tx.Model(&model.Blob{}).Where("hash = ?", hash).
+				UpdateColumn("ref_count", gorm.Expr("ref_count + ?", updated)).Error; err != nil {
+				return err
+			}
+			duplicates[loc] = int(updated)
+		}
+		return nil
+	})
+	if err != nil {
+		for _, count := range duplicates {
+			report.Failed += count
+		}
+		return err
+	}
+
+	for loc, count := range duplicates {
+		report.Migrated += count
+		s.deleteIfUnreferenced(loc)
+	}
+	return nil
+}
+
+// verifyHash 读取文件内容并校验哈希
+func (s *StorageService) verifyHash(ref filestore.BlobRef, hash string) error {
+	src, err := s.Storage.Get(ref)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, src); err != nil {
+		return err
+	}
+	if actual := hex.EncodeToString(h.Sum(nil)); actual != hash {
+		return fmt.Errorf("哈希校验失败，期望 %s，实际 %s", hash, actual)
+	}
+	return nil
+}
@@ -0,0 +1,241 @@
+package service
+
+import (
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/zaunist/filebox/backend/filestore"
+	"github.com/zaunist/filebox/backend/model"
+)
+
+// 文件所在的存储层级
+const (
+	TierHot  = "hot"  // 当前写入的存储后端
+	TierCold = "cold" // 冷存储后端
+)
+
+// ErrTieringRunning 已有分层任务正在执行
+var ErrTieringRunning = errors.New("冷热分层正在进行中")
+
+// TieringPolicy 冷热分层策略。满足任一条件的文件从热存储移动到冷存储，
+// 共用同一个存储对象的文件按其中最新的一个判断
+type TieringPolicy struct {
+	ColdBackend string        // 冷存储后端ID，为空表示不分层
+	MaxAge      time.Duration // 上传超过该时长的文件移到冷存储，0表示不按上传时间判断
+	MaxIdle     time.Duration // 超过该时长未被下载的文件移到冷存储，0表示不按下载时间判断
+}
+
+// TieringService 冷热分层服务，定期将较旧或长期未下载的文件移动到冷存储。
+// 冷存储中的文件仍可通过FileService.GetFileContent直接读取
+type TieringService struct {
+	StorageService *StorageService
+	Policy         TieringPolicy
+
+	mu      sync.Mutex
+	running bool
+	last    *TieringReport
+}
+
+// TieringReport 分层结果统计
+type TieringReport struct {
+	Candidates int        `json:"candidates"`
+	Moved      int        `json:"moved"`
+	MovedBytes int64      `json:"moved_bytes"`
+	Failed     int        `json:"failed"`
+	StartedAt  time.Time  `json:"started_at"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+}
+
+// TieringStatus 分层任务状态
+type TieringStatus struct {
+	Enabled     bool           `json:"enabled"`
+	ColdBackend string         `json:"cold_backend,omitempty"`
+	MaxAgeDays  int            `json:"max_age_days,omitempty"`
+	MaxIdleDays int            `json:"max_idle_days,omitempty"`
+	Running     bool           `json:"running"`
+	Last        *TieringReport `json:"last,omitempty"`
+}
+
+// TierStat 某一存储层级中的文件统计
+type TierStat struct {
+	Tier  string `json:"tier"`
+	Count int64  `json:"count"`
+	Bytes int64  `json:"bytes"`
+}
+
+// tieringCandidate 满足分层条件的存储对象
+type tieringCandidate struct {
+	StoragePath string
+	Hash        string
+	Size        int64
+}
+
+// Enabled 是否配置了冷存储
+func (s *TieringService) Enabled() bool {
+	return s.Policy.ColdBackend != "" && (s.Policy.MaxAge > 0 || s.Policy.MaxIdle > 0)
+}
+
+// Run 将满足条件的文件移动到冷存储。dryRun为true时只统计
+func (s *TieringService) Run(dryRun bool) (*TieringReport, error) {
+	if !s.Enabled() {
+		return nil, errors.New("未配置冷存储")
+	}
+	migrator, ok := s.StorageService.Storage.(filestore.Migrator)
+	if !ok {
+		return nil, errors.New("当前存储不支持冷热分层")
+	}
+
+	s.mu.Lock()
+	if s.running {
+		s.mu.Unlock()
+		return nil, ErrTieringRunning
+	}
+	s.running = true
+	report := &TieringReport{StartedAt: time.Now()}
+	s.last = report
+	s.mu.Unlock()
+
+	defer func() {
+		s.mu.Lock()
+		finished := time.Now()
+		report.FinishedAt = &finished
+		s.running = false
+		s.mu.Unlock()
+	}()
+
+	hot := migrator.PrimaryBackend()
+	candidates, err := s.candidates(hot, report.StartedAt)
+	if err != nil {
+		return report, err
+	}
+
+	for _, candidate := range candidates {
+		s.mu.Lock()
+		report.Candidates++
+		s.mu.Unlock()
+		if dryRun {
+			continue
+		}
+
+		// 读取对象需要文件记录中的数据密钥
+		var file model.File
+		if err := s.StorageService.DB.Where("storage_path = ? AND backend = ? AND hash = ?", candidate.StoragePath, hot, candidate.Hash).
+			First(&file).Error; err != nil {
+			continue
+		}
+
+		err := s.StorageService.migrateObject(migrator, blobRef(&file), file.Hash, StorageMigrationOptions{
+			To:           s.Policy.ColdBackend,
+			DeleteSource: true,
+		})
+		s.mu.Lock()
+		if err != nil {
+			log.Printf("移动文件到冷存储失败 %s: %v", candidate.StoragePath, err)
+			report.Failed++
+		} else {
+			report.Moved++
+			report.MovedBytes += candidate.Size
+		}
+		s.mu.Unlock()
+	}
+
+	return report, nil
+}
+
+// candidates 查询热存储中满足分层条件的存储对象
+func (s *TieringService) candidates(hot string, now time.Time) ([]tieringCandidate, error) {
+	query := s.StorageService.DB.Model(&model.File{}).
+		Select("storage_path, hash, MAX(size) AS size").
+		Where("backend = ?", hot).
+		// 隔离区中的对象等待管理员处理，放行时从当前存储中恢复
+		Where("storage_path NOT LIKE ?", filestore.QuarantinePrefix+"/%").
+		Group("storage_path, hash")
+
+	// 任一文件在阈值内上传或下载过的对象仍留在热存储
+	switch {
+	case s.Policy.MaxAge > 0 && s.Policy.MaxIdle > 0:
+		query = query.Having("MAX(created_at) < ? OR MAX(COALESCE(downloaded_at, created_at)) < ?",
+			now.Add(-s.Policy.MaxAge), now.Add(-s.Policy.MaxIdle))
+	case s.Policy.MaxAge > 0:
+		query = query.Having("MAX(created_at) < ?", now.Add(-s.Policy.MaxAge))
+	default:
+		query = query.Having("MAX(COALESCE(downloaded_at, created_at)) < ?", now.Add(-s.Policy.MaxIdle))
+	}
+
+	var candidates []tieringCandidate
+	if err := query.Scan(&candidates).Error; err != nil {
+		return nil, err
+	}
+	return candidates, nil
+}
+
+// StartSchedule 启动定期分层
+func (s *TieringService) StartSchedule(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			report, err := s.Run(false)
+			if err != nil {
+				if !errors.Is(err, ErrTieringRunning) {
+					log.Printf("冷热分层失败: %v", err)
+				}
+			} else if report.Moved > 0 || report.Failed > 0 {
+				log.Printf("冷热分层完成: 移动%d个对象（%d字节），失败%d个", report.Moved, report.MovedBytes, report.Failed)
+			}
+			<-ticker.C
+		}
+	}()
+}
+
+// Status 返回分层配置和最近一次分层的结果
+func (s *TieringService) Status() TieringStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	status := TieringStatus{
+		Enabled:     s.Enabled(),
+		ColdBackend: s.Policy.ColdBackend,
+		MaxAgeDays:  int(s.Policy.MaxAge / (24 * time.Hour)),
+		MaxIdleDays: int(s.Policy.MaxIdle / (24 * time.Hour)),
+		Running:     s.running,
+	}
+	if s.last != nil {
+		last := *s.last
+		status.Last = &last
+	}
+	return status
+}
+
+// Tier 返回存储后端对应的层级，既不是热存储也不是冷存储时返回后端ID
+func (s *TieringService) Tier(backend string) string {
+	if migrator, ok := s.StorageService.Storage.(filestore.Migrator); ok && backend == migrator.PrimaryBackend() {
+		return TierHot
+	}
+	if backend == s.Policy.ColdBackend && s.Policy.ColdBackend != "" {
+		return TierCold
+	}
+	return backend
+}
+
+// TierStats 按存储层级统计文件数和大小
+func (s *TieringService) TierStats() ([]TierStat, error) {
+	var rows []struct {
+		Backend string
+		Count   int64
+		Bytes   int64
+	}
+	if err := s.StorageService.DB.Model(&model.File{}).
+		Select("backend, COUNT(*) AS count, COALESCE(SUM(size), 0) AS bytes").
+		Group("backend").Scan(&rows).Error; err != nil {
+		return nil, err
+	}
+
+	stats := make([]TierStat, 0, len(rows))
+	for _, row := range rows {
+		stats = append(stats, TierStat{Tier: s.Tier(row.Backend), Count: row.Count, Bytes: row.Bytes})
+	}
+	return stats, nil
+}
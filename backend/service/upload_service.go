@@ -0,0 +1,424 @@
+package service
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/zaunist/filebox/backend/config"
+	"github.com/zaunist/filebox/backend/filestore"
+	"github.com/zaunist/filebox/backend/model"
+	"github.com/zaunist/filebox/backend/utils"
+	"gorm.io/gorm"
+)
+
+var (
+	// ErrUploadNotFound 上传会话不存在、已过期或无权访问
+	ErrUploadNotFound = errors.New("上传不存在或已过期")
+	// ErrUploadOffsetMismatch 客户端提交的偏移量与服务端已接收的长度不一致
+	ErrUploadOffsetMismatch = errors.New("上传偏移量不匹配")
+	// ErrUploadLocked 同一上传正在被其他请求写入
+	ErrUploadLocked = errors.New("上传正在进行中，请稍后再试")
+	// ErrUploadTooLarge 上传内容超过声明的长度
+	ErrUploadTooLarge = errors.New("上传内容超过声明的长度")
+	// ErrUploadLengthExceeded 声明的上传长度超过允许的最大文件大小
+	ErrUploadLengthExceeded = errors.New("文件大小超过限制")
+)
+
+// UploadService 断点续传上传服务。上传内容先用每个上传独立的数据密钥加密后追加写入暂存目录，
+// 接收完成后解密为一个完整的流交给FileService写入存储。
+// 暂存目录和写入锁都只在本实例内有效，多实例部署时同一上传的请求需要由同一实例处理（会话保持）
+type UploadService struct {
+	DB           *gorm.DB
+	FileService  *FileService
+	ShareService *ShareService
+	AppConfig    *config.AppConfig
+	Keys         *filestore.KeyRing // 包装暂存内容的数据密钥
+
+	// locks 保证同一上传同时只有一个请求写入，只对本实例内的请求有效
+	locks sync.Map
+}
+
+// CreateUpload 创建上传会话。metadata为tus协议Upload-Metadata头的原始值，
+// 匿名上传可以在其中携带分享参数，上传完成后自动创建分享
+func (s *UploadService) CreateUpload(length int64, metadata string, userID *uuid.UUID) (*model.Upload, error) {
+	var maxSize int64
+	if userID == nil {
+		maxSize = s.AppConfig.MaxAnonymousFileSize
+	} else {
+		maxSize = s.AppConfig.MaxFileSize
+	}
+	if length < 0 {
+		return nil, errors.New("无效的上传长度")
+	}
+	if length > maxSize {
+		return nil, fmt.Errorf("%w，最大允许 %d 字节", ErrUploadLengthExceeded, maxSize)
+	}
+
+	meta, err := ParseUploadMetadata(metadata)
+	if err != nil {
+		return nil, err
+	}
+	if encrypted := meta["encrypted_meta"]; encrypted != "" {
+		if err := validateEncryptedMeta(encrypted); err != nil {
+			return nil, err
+		}
+	} else if _, err := CleanName(meta["filename"]); err != nil {
+		// 与完成上传时的检查一致，提前拒绝，避免传输完内容后才失败
+		return nil, fmt.Errorf("无效的文件名: %w", err)
+	}
+	if code := meta["code"]; userID == nil && code != "" && !utils.IsValidCode(code) {
+		return nil, errors.New("无效的取件码格式")
+	}
+
+	if err := os.MkdirAll(s.AppConfig.UploadPath, 0700); err != nil {
+		return nil, fmt.Errorf("创建暂存目录失败: %w", err)
+	}
+
+	// 暂存内容与存储中的文件一样加密，数据密钥由主密钥包装后保存在上传记录中
+	_, keyID, dataKey, err := s.Keys.NewDataKey()
+	if err != nil {
+		return nil, err
+	}
+
+	upload := &model.Upload{
+		ID:        uuid.New(),
+		UserID:    userID,
+		Length:    length,
+		Metadata:  metadata,
+		KeyID:     keyID,
+		DataKey:   dataKey,
+		ExpiresAt: s.expiration(),
+	}
+
+	if err := filestore.CreateStaging(s.stagingPath(upload.ID)); err != nil {
+		return nil, err
+	}
+
+	if err := s.DB.Create(upload).Error; err != nil {
+		_ = os.Remove(s.stagingPath(upload.ID))
+		return nil, err
+	}
+
+	// 空文件无需再传输内容，直接完成
+	if length == 0 {
+		if err := s.complete(upload); err != nil {
+			return nil, err
+		}
+	}
+
+	return upload, nil
+}
+
+// GetUpload 获取上传会话。注册用户的上传只有本人可以访问，
+// 匿名上传的ID本身即为凭证
+func (s *UploadService) GetUpload(id string, userID *uuid.UUID) (*model.Upload, error) {
+	var upload model.Upload
+	if err := s.DB.First(&upload, "id = ?", id).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrUploadNotFound
+		}
+		return nil, err
+	}
+
+	if upload.UserID != nil && (userID == nil || *upload.UserID != *userID) {
+		return nil, ErrUploadNotFound
+	}
+	if time.Now().After(upload.ExpiresAt) {
+		return nil, ErrUploadNotFound
+	}
+	// 旧版本创建的上传暂存了未加密的内容，不再继续，由清理任务删除
+	if upload.DataKey == "" && upload.FileID == nil {
+		return nil, ErrUploadNotFound
+	}
+
+	return &upload, nil
+}
+
+// WriteChunk 从offset处追加写入上传内容。连接中断时已接收的部分同样会被保存，
+// 客户端查询偏移量后即可从断点继续上传。全部接收后自动写入存储
+func (s *UploadService) WriteChunk(id string, offset int64, src io.Reader, userID *uuid.UUID) (*model.Upload, error) {
+	unlock, err := s.lock(id)
+	if err != nil {
+		return nil, err
+	}
+	// 上传不存在或已完成后不再需要锁
+	done := true
+	defer func() { unlock(done) }()
+
+	// 加锁后重新读取，确保偏移量是最新的
+	upload, err := s.GetUpload(id, userID)
+	if err != nil {
+		return nil, err
+	}
+	done = false
+	if offset != upload.Offset {
+		return nil, ErrUploadOffsetMismatch
+	}
+
+	if upload.Offset < upload.Length {
+		written, err := s.appendChunk(upload, src)
+		if written > 0 {
+			upload.Offset += written
+			upload.ExpiresAt = s.expiration()
+			if err := s.DB.Model(upload).Updates(map[string]interface{}{
+				"upload_offset": upload.Offset,
+				"expires_at":    upload.ExpiresAt,
+			}).Error; err != nil {
+				return nil, err
+			}
+		}
+		if err != nil {
+			return upload, err
+		}
+	}
+
+	// 之前完成时写入存储失败的上传，再次提交时会重试
+	if upload.Offset == upload.Length && upload.FileID == nil {
+		if err := s.complete(upload); err != nil {
+			return upload, err
+		}
+	}
+	done = upload.FileID != nil
+
+	return upload, nil
+}
+
+// appendChunk 将src加密写入暂存文件末尾，返回写入的字节数
+func (s *UploadService) appendChunk(upload *model.Upload, src io.Reader) (int64, error) {
+	key, err := s.Keys.DataKey(upload.KeyID, upload.DataKey)
+	if err != nil {
+		return 0, err
+	}
+
+	// 从已记录的偏移量写入，丢弃上次写入中断时未记录偏移量的内容
+	remaining := upload.Length - upload.Offset
+	written, copyErr := filestore.AppendStaging(s.stagingPath(upload.ID), key, upload.Offset, io.LimitReader(src, remaining+1))
+	if written > remaining {
+		// 超出声明长度的请求整体作废
+		if _, err := filestore.AppendStaging(s.stagingPath(upload.ID), key, upload.Offset, strings.NewReader("")); err != nil {
+			log.Printf("回滚暂存文件失败 %s: %v", upload.ID, err)
+		}
+		return 0, ErrUploadTooLarge
+	}
+	if copyErr != nil {
+		return written, fmt.Errorf("接收上传内容中断: %w", copyErr)
+	}
+	return written, nil
+}
+
+// complete 将接收完成的暂存文件写入存储并创建文件记录，匿名上传同时创建分享
+func (s *UploadService) complete(upload *model.Upload) error {
+	meta, err := ParseUploadMetadata(upload.Metadata)
+	if err != nil {
+		return err
+	}
+
+	key, err := s.Keys.DataKey(upload.KeyID, upload.DataKey)
+	if err != nil {
+		return err
+	}
+	f, err := filestore.OpenStaging(s.stagingPath(upload.ID), key, upload.Length)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	fileInfo, err := s.FileService.UploadFile(f, filestore.FileMeta{
+		Name:          meta["filename"],
+		ContentType:   meta["filetype"],
+		Size:          upload.Length,
+		EncryptedMeta: meta["encrypted_meta"],
+	}, upload.UserID)
+	if err != nil {
+		return err
+	}
+
+	fileID, _ := uuid.Parse(fileInfo.ID)
+	upload.FileID = &fileID
+
+	if upload.UserID == nil {
+		expiresIn, _ := strconv.Atoi(meta["expires_in"])
+		downloadLimit, _ := strconv.Atoi(meta["download_limit"])
+		share, err := s.ShareService.CreateShare(CreateShareRequest{
+			FileID:        fileInfo.ID,
+			Code:          meta["code"],
+			ExpiresIn:     expiresIn,
+			DownloadLimit: downloadLimit,
+		}, nil)
+		if err != nil {
+			// 没有分享的匿名文件无法访问，删除后由客户端重试
+			_ = s.FileService.DeleteFile(fileInfo.ID, nil)
+			upload.FileID = nil
+			return err
+		}
+		upload.ShareCode = share.Code
+	}
+
+	if err := s.DB.Model(upload).Updates(map[string]interface{}{
+		"file_id":    upload.FileID,
+		"share_code": upload.ShareCode,
+	}).Error; err != nil {
+		return err
+	}
+
+	// 上传记录保留到过期，供客户端查询结果；暂存内容已无用
+	f.Close()
+	if err := os.Remove(s.stagingPath(upload.ID)); err != nil {
+		log.Printf("删除暂存文件失败 %s: %v", upload.ID, err)
+	}
+	return nil
+}
+
+// DeleteUpload 终止上传并删除已接收的内容
+func (s *UploadService) DeleteUpload(id string, userID *uuid.UUID) error {
+	unlock, err := s.lock(id)
+	if err != nil {
+		return err
+	}
+	done := true
+	defer func() { unlock(done) }()
+
+	upload, err := s.GetUpload(id, userID)
+	if err != nil {
+		return err
+	}
+
+	if err := s.DB.Delete(upload).Error; err != nil {
+		done = false
+		return err
+	}
+	if err := os.Remove(s.stagingPath(upload.ID)); err != nil && !os.IsNotExist(err) {
+		log.Printf("删除暂存文件失败 %s: %v", upload.ID, err)
+	}
+	return nil
+}
+
+// CleanupExpired 清理过期的上传会话及其暂存内容，以及没有对应会话的暂存文件。
+// 旧版本创建的未完成上传暂存了未加密的内容，同样立即清理
+func (s *UploadService) CleanupExpired() (int, error) {
+	expiredQuery := "expires_at < ? OR (data_key = '' AND file_id IS NULL)"
+	var expired []model.Upload
+	if err := s.DB.Where(expiredQuery, time.Now()).Find(&expired).Error; err != nil {
+		return 0, err
+	}
+
+	removed := 0
+	for i := range expired {
+		upload := &expired[i]
+		unlock, err := s.lock(upload.ID.String())
+		if err != nil {
+			// 正在写入的上传会在写入时延长有效期
+			continue
+		}
+		if err := s.DB.Where("id = ?", upload.ID).Where(expiredQuery, time.Now()).Delete(&model.Upload{}).Error; err != nil {
+			unlock(false)
+			return removed, err
+		}
+		if err := os.Remove(s.stagingPath(upload.ID)); err != nil && !os.IsNotExist(err) {
+			log.Printf("删除暂存文件失败 %s: %v", upload.ID, err)
+		}
+		unlock(true)
+		removed++
+	}
+
+	// 会话记录已删除但暂存文件残留（例如删除文件时进程退出）
+	entries, err := os.ReadDir(s.AppConfig.UploadPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return removed, nil
+		}
+		return removed, err
+	}
+	cutoff := time.Now().Add(-time.Duration(s.AppConfig.UploadExpireHours) * time.Hour)
+	for _, entry := range entries {
+		id, err := uuid.Parse(entry.Name())
+		if err != nil {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil || info.ModTime().After(cutoff) {
+			continue
+		}
+		var count int64
+		if err := s.DB.Model(&model.Upload{}).Where("id = ?", id).Count(&count).Error; err != nil || count > 0 {
+			continue
+		}
+		if err := os.Remove(s.stagingPath(id)); err == nil {
+			removed++
+		}
+	}
+
+	return removed, nil
+}
+
+// StartCleanup 启动时及之后每隔interval清理一次过期的上传
+func (s *UploadService) StartCleanup(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			removed, err := s.CleanupExpired()
+			if err != nil {
+				log.Printf("清理过期上传失败: %v", err)
+			} else if removed > 0 {
+				log.Printf("已清理%d个过期上传", removed)
+			}
+			<-ticker.C
+		}
+	}()
+}
+
+// lock 获取上传的写入锁，已被占用时立即返回ErrUploadLocked。
+// 返回的函数释放锁，参数为true时同时移除锁，用于上传已完成、已删除或不存在的情况，避免锁无限累积
+func (s *UploadService) lock(id string) (func(done bool), error) {
+	value, _ := s.locks.LoadOrStore(id, &sync.Mutex{})
+	mu := value.(*sync.Mutex)
+	if !mu.TryLock() {
+		return nil, ErrUploadLocked
+	}
+	return func(done bool) {
+		if done {
+			// 先移除再解锁，已取得该锁的其他请求只会得到ErrUploadLocked
+			s.locks.CompareAndDelete(id, mu)
+		}
+		mu.Unlock()
+	}, nil
+}
+
+// stagingPath 返回上传的暂存文件路径
+func (s *UploadService) stagingPath(id uuid.UUID) string {
+	return filepath.Join(s.AppConfig.UploadPath, id.String())
+}
+
+// expiration 返回从现在起计算的上传过期时间
+func (s *UploadService) expiration() time.Time {
+	return time.Now().Add(time.Duration(s.AppConfig.UploadExpireHours) * time.Hour)
+}
+
+// ParseUploadMetadata 解析tus协议的Upload-Metadata头，格式为逗号分隔的 "键 base64值"
+func ParseUploadMetadata(header string) (map[string]string, error) {
+	meta := make(map[string]string)
+	for _, pair := range strings.Split(header, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		key, encoded, _ := strings.Cut(pair, " ")
+		value, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("无效的上传元数据: %s", key)
+		}
+		meta[key] = string(value)
+	}
+	return meta, nil
+}